@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type args struct {
+	logPath  string
+	from     time.Time
+	to       time.Time
+	format   outputFormat
+	tables   []string
+	location *time.Location
+}
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseTime(s string, location *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, s, location)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can not parse time %q, use RFC 3339 or 2006-01-02[T15:04[:05]]", s)
+}
+
+func getArgs() (args, error) {
+	logPath := flag.String("log_path", "", "current passer log file; its rotated archives, compressed or not yet, are read too")
+	from := flag.String("from", "", "only count records at or after this time")
+	to := flag.String("to", "", "only count records before this time")
+	format := flag.String("format", "text", "output format: text, csv or json")
+	tables := flag.String("tables", strings.Join(allTables, ","), "comma-separated tables to print: clients, destinations, hours")
+	utc := flag.Bool("utc", false, "interpret --from/--to and group hours in UTC instead of local time")
+	flag.Parse()
+
+	if *logPath == "" {
+		return args{}, errors.New("log_path should not be empty")
+	}
+
+	location := time.Local
+	if *utc {
+		location = time.UTC
+	}
+
+	parsedFrom, err := parseTime(*from, location)
+	if err != nil {
+		return args{}, err
+	}
+	parsedTo, err := parseTime(*to, location)
+	if err != nil {
+		return args{}, err
+	}
+	if !parsedFrom.IsZero() && !parsedTo.IsZero() && !parsedFrom.Before(parsedTo) {
+		return args{}, errors.New("from should be before to")
+	}
+
+	parsedFormat, err := parseOutputFormat(*format)
+	if err != nil {
+		return args{}, err
+	}
+
+	var parsedTables []string
+	for _, name := range strings.Split(*tables, ",") {
+		switch name {
+		case tableClients, tableDestinations, tableHours:
+			parsedTables = append(parsedTables, name)
+		default:
+			return args{}, fmt.Errorf("unknown table %q", name)
+		}
+	}
+
+	return args{
+		logPath:  *logPath,
+		from:     parsedFrom,
+		to:       parsedTo,
+		format:   parsedFormat,
+		tables:   parsedTables,
+		location: location,
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+	"github.com/galqiwi/fair-p/internal/utils"
+)
+
+func main() {
+	err := Main()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func Main() error {
+	args, err := getArgs()
+	if err != nil {
+		return err
+	}
+
+	files, err := logFiles(args)
+	if err != nil {
+		return err
+	}
+
+	r := newReport(args.location, args.from, args.to)
+	for _, path := range files {
+		err := readLogFile(path, r)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %s", path, err)
+		}
+	}
+
+	return writeReport(os.Stdout, args.format, r.Tables(args.tables))
+}
+
+// logFiles returns the archives of args.logPath that may hold records in the requested range,
+// oldest first, followed by the current log file.
+func logFiles(args args) ([]string, error) {
+	archives, err := rotate.ListAllArchives(args.logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
+	for _, archive := range archives {
+		// An archive holds nothing newer than the moment it was written.
+		if !args.from.IsZero() && archive.ModTime.Before(args.from) {
+			continue
+		}
+		output = append(output, archive.Path)
+	}
+	if utils.FileExists(args.logPath) {
+		output = append(output, args.logPath)
+	}
+	return output, nil
+}
+
+func readLogFile(path string, r *report) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !strings.HasSuffix(path, ".gz") {
+		// Compressed since it was listed.
+		path += ".gz"
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var input io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		input = gz
+	}
+
+	return readRecords(input, r)
+}
+
+// readRecords streams input line by line. Lines that do not fit into the buffer are skipped, they
+// are never records.
+func readRecords(input io.Reader, r *report) error {
+	reader := bufio.NewReaderSize(input, 64*1024)
+	skipping := false
+	for {
+		line, err := reader.ReadSlice('\n')
+		switch {
+		case err == bufio.ErrBufferFull:
+			skipping = true
+			continue
+		case skipping:
+			skipping = false
+		default:
+			if rec, ok := parseLine(line); ok {
+				r.Add(rec)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/utils"
+)
+
+// consoleTimeLayout is zapcore.ISO8601TimeEncoder's layout, used by --log_format console.
+const consoleTimeLayout = "2006-01-02T15:04:05.000Z0700"
+
+const (
+	kindTunnel = "tunnel"
+	kindHTTP   = "http"
+)
+
+var recordKinds = map[string]string{
+	"Tunnel closed":           kindTunnel,
+	"HTTP response forwarded": kindHTTP,
+}
+
+// record is a completed tunnel or forwarded HTTP response.
+type record struct {
+	Time          time.Time
+	Kind          string
+	ClientHost    string
+	Destination   string
+	BytesSent     int64
+	BytesReceived int64
+}
+
+type recordFields struct {
+	TS            string `json:"ts"`
+	Msg           string `json:"msg"`
+	ClientHost    string `json:"client_host"`
+	Client        string `json:"client"`
+	Destination   string `json:"destination"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+func mayContainRecord(line []byte) bool {
+	for msg := range recordKinds {
+		if bytes.Contains(line, []byte(msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLine extracts a record from a passer log line in either the console or the JSON format.
+// Lines tagged by rotator ("[name] ...") are accepted too.
+func parseLine(line []byte) (record, bool) {
+	if !mayContainRecord(line) {
+		return record{}, false
+	}
+
+	line = bytes.TrimSpace(line)
+	if len(line) > 0 && line[0] == '[' {
+		if end := bytes.Index(line, []byte("] ")); end >= 0 {
+			line = line[end+2:]
+		}
+	}
+	if len(line) == 0 {
+		return record{}, false
+	}
+
+	var fields recordFields
+	var ts time.Time
+	if line[0] == '{' {
+		if json.Unmarshal(line, &fields) != nil {
+			return record{}, false
+		}
+		var err error
+		ts, err = time.Parse(time.RFC3339Nano, fields.TS)
+		if err != nil {
+			return record{}, false
+		}
+	} else {
+		// Console lines are tab-separated: time, level, optional logger name and caller, message,
+		// then the fields as a JSON object.
+		columns := bytes.Split(line, []byte{'\t'})
+		if len(columns) < 3 {
+			return record{}, false
+		}
+		var err error
+		ts, err = time.Parse(consoleTimeLayout, string(columns[0]))
+		if err != nil {
+			return record{}, false
+		}
+		context := columns[len(columns)-1]
+		if len(context) == 0 || context[0] != '{' || json.Unmarshal(context, &fields) != nil {
+			return record{}, false
+		}
+		for _, column := range columns[1 : len(columns)-1] {
+			if _, ok := recordKinds[string(column)]; ok {
+				fields.Msg = string(column)
+				break
+			}
+		}
+	}
+
+	kind, ok := recordKinds[fields.Msg]
+	if !ok {
+		return record{}, false
+	}
+
+	clientHost := fields.ClientHost
+	if clientHost == "" {
+		clientHost = utils.TryGettingHostFromRemoteAddr(fields.Client)
+	}
+
+	return record{
+		Time:          ts,
+		Kind:          kind,
+		ClientHost:    clientHost,
+		Destination:   fields.Destination,
+		BytesSent:     fields.BytesSent,
+		BytesReceived: fields.BytesReceived,
+	}, true
+}
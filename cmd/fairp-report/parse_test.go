@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	rec, ok := parseLine([]byte("2024-05-01T10:30:00.000Z\tINFO\tTunnel closed\t" +
+		`{"trace_id": "t1", "client_host": "10.0.0.1", "destination": "example.com:443", "client": "10.0.0.1:5555", "bytes_sent": 10, "bytes_received": 20, "closing_side": "client"}` + "\n"))
+	require.True(t, ok)
+	require.True(t, ts.Equal(rec.Time))
+	require.Equal(t, record{Time: rec.Time, Kind: kindTunnel, ClientHost: "10.0.0.1", Destination: "example.com:443", BytesSent: 10, BytesReceived: 20}, rec)
+
+	rec, ok = parseLine([]byte(`{"level":"info","ts":"2024-05-01T10:30:00Z","msg":"HTTP response forwarded","trace_id":"t2","client_host":"10.0.0.2","url":"http://example.com/","destination":"example.com","client":"10.0.0.2:1234","bytes_received":300}`))
+	require.True(t, ok)
+	require.True(t, ts.Equal(rec.Time))
+	require.Equal(t, kindHTTP, rec.Kind)
+	require.Equal(t, "10.0.0.2", rec.ClientHost)
+	require.Equal(t, "example.com", rec.Destination)
+	require.Equal(t, int64(300), rec.BytesReceived)
+
+	// Tagged by rotator, and without client_host.
+	rec, ok = parseLine([]byte("[passer-1] 2024-05-01T13:30:00.000+0300\tINFO\tTunnel closed\t" +
+		`{"destination": "example.com:443", "client": "10.0.0.3:5555", "bytes_sent": 1, "bytes_received": 2}`))
+	require.True(t, ok)
+	require.True(t, ts.Equal(rec.Time))
+	require.Equal(t, "10.0.0.3", rec.ClientHost)
+
+	for _, line := range []string{
+		"",
+		"rotator: 2024/05/01 10:30:00 starting \"/app/passer\"",
+		"2024-05-01T10:30:00.000Z\tINFO\tTunnel established\t{\"duration\": 0.1}",
+		"2024-05-01T10:30:00.000Z\tINFO\tGot request\t{\"url\": \"Tunnel closed\"}",
+		`{"ts":"garbage","msg":"Tunnel closed"}`,
+		"Tunnel closed",
+	} {
+		_, ok := parseLine([]byte(line))
+		require.False(t, ok, line)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+type outputFormat string
+
+const (
+	formatText outputFormat = "text"
+	formatCSV  outputFormat = "csv"
+	formatJSON outputFormat = "json"
+)
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch outputFormat(s) {
+	case formatText, formatCSV, formatJSON:
+		return outputFormat(s), nil
+	}
+	return "", fmt.Errorf("unknown output format %q", s)
+}
+
+const (
+	tableClients      = "clients"
+	tableDestinations = "destinations"
+	tableHours        = "hours"
+)
+
+var allTables = []string{tableClients, tableDestinations, tableHours}
+
+type usage struct {
+	Key           string `json:"key"`
+	Tunnels       int64  `json:"tunnels"`
+	HTTPResponses int64  `json:"http_responses"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+func (u *usage) add(rec record) {
+	switch rec.Kind {
+	case kindTunnel:
+		u.Tunnels++
+	case kindHTTP:
+		u.HTTPResponses++
+	}
+	u.BytesSent += rec.BytesSent
+	u.BytesReceived += rec.BytesReceived
+}
+
+func (u *usage) total() int64 {
+	return u.BytesSent + u.BytesReceived
+}
+
+type table struct {
+	Name string   `json:"name"`
+	Rows []*usage `json:"rows"`
+}
+
+// report aggregates records into one table per grouping.
+type report struct {
+	location *time.Location
+	from, to time.Time
+
+	groups map[string]map[string]*usage
+}
+
+func newReport(location *time.Location, from, to time.Time) *report {
+	groups := make(map[string]map[string]*usage)
+	for _, name := range allTables {
+		groups[name] = make(map[string]*usage)
+	}
+	return &report{location: location, from: from, to: to, groups: groups}
+}
+
+// inRange reports whether t is within [from, to), zero bounds are open.
+func (r *report) inRange(t time.Time) bool {
+	if !r.from.IsZero() && t.Before(r.from) {
+		return false
+	}
+	if !r.to.IsZero() && !t.Before(r.to) {
+		return false
+	}
+	return true
+}
+
+func (r *report) Add(rec record) {
+	if !r.inRange(rec.Time) {
+		return
+	}
+
+	keys := map[string]string{
+		tableClients:      rec.ClientHost,
+		tableDestinations: rec.Destination,
+		tableHours:        rec.Time.In(r.location).Format("2006-01-02 15:00"),
+	}
+	for name, key := range keys {
+		if key == "" {
+			key = "-"
+		}
+		group := r.groups[name]
+		u, ok := group[key]
+		if !ok {
+			u = &usage{Key: key}
+			group[key] = u
+		}
+		u.add(rec)
+	}
+}
+
+// Tables returns the requested tables. Hours are sorted chronologically, everything else by
+// total traffic, largest first.
+func (r *report) Tables(names []string) []table {
+	var output []table
+	for _, name := range names {
+		rows := make([]*usage, 0, len(r.groups[name]))
+		for _, u := range r.groups[name] {
+			rows = append(rows, u)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			if name != tableHours && rows[i].total() != rows[j].total() {
+				return rows[i].total() > rows[j].total()
+			}
+			return rows[i].Key < rows[j].Key
+		})
+		output = append(output, table{Name: name, Rows: rows})
+	}
+	return output
+}
+
+func writeReport(w io.Writer, format outputFormat, tables []table) error {
+	switch format {
+	case formatCSV:
+		return writeCSV(w, tables)
+	case formatJSON:
+		return writeJSON(w, tables)
+	}
+	return writeText(w, tables)
+}
+
+func megabytes(bytes int64) string {
+	return fmt.Sprintf("%.2f", float64(bytes)/1024/1024)
+}
+
+func writeText(w io.Writer, tables []table) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, t := range tables {
+		if i > 0 {
+			_, _ = fmt.Fprintln(tw)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\ttunnels\thttp\tsent (MB)\treceived (MB)\ttotal (MB)\n", t.Name)
+		for _, u := range t.Rows {
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n",
+				u.Key, u.Tunnels, u.HTTPResponses, megabytes(u.BytesSent), megabytes(u.BytesReceived), megabytes(u.total()))
+		}
+	}
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, tables []table) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"table", "key", "tunnels", "http_responses", "bytes_sent", "bytes_received"})
+	for _, t := range tables {
+		for _, u := range t.Rows {
+			_ = cw.Write([]string{
+				t.Name,
+				u.Key,
+				strconv.FormatInt(u.Tunnels, 10),
+				strconv.FormatInt(u.HTTPResponses, 10),
+				strconv.FormatInt(u.BytesSent, 10),
+				strconv.FormatInt(u.BytesReceived, 10),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeJSON(w io.Writer, tables []table) error {
+	output := make(map[string][]*usage, len(tables))
+	for _, t := range tables {
+		output[t.Name] = t.Rows
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tunnelLine(ts time.Time, client, destination string, sent, received int64) string {
+	return fmt.Sprintf("%s\tINFO\tTunnel closed\t{\"client_host\": %q, \"destination\": %q, \"bytes_sent\": %d, \"bytes_received\": %d}\n",
+		ts.Format(consoleTimeLayout), client, destination, sent, received)
+}
+
+func httpLine(ts time.Time, client, destination string, received int64) string {
+	return fmt.Sprintf("{\"ts\":%q,\"msg\":\"HTTP response forwarded\",\"client_host\":%q,\"destination\":%q,\"bytes_received\":%d}\n",
+		ts.Format(time.RFC3339Nano), client, destination, received)
+}
+
+func writeGzipFile(t *testing.T, path string, data string) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+}
+
+func TestReport(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	old := filepath.Join(dir, "passer_2024-04-01_00:00:00.log.gz")
+	writeGzipFile(t, old, tunnelLine(base.Add(-30*24*time.Hour), "10.0.0.9", "old.com:443", 1, 1))
+	oldTime := base.Add(-29 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(old, oldTime, oldTime))
+
+	archive := filepath.Join(dir, "passer_2024-05-01_11:00:00.log.gz")
+	writeGzipFile(t, archive,
+		tunnelLine(base.Add(10*time.Minute), "10.0.0.1", "a.com:443", 100, 1000)+
+			strings.Repeat("x", 200*1024)+"\n"+
+			httpLine(base.Add(20*time.Minute), "10.0.0.2", "b.com", 50))
+	archiveTime := base.Add(time.Hour)
+	require.NoError(t, os.Chtimes(archive, archiveTime, archiveTime))
+
+	require.NoError(t, os.WriteFile(logPath, []byte(
+		tunnelLine(base.Add(70*time.Minute), "10.0.0.1", "b.com:443", 10, 10)+
+			tunnelLine(base.Add(5*time.Hour), "10.0.0.1", "late.com:443", 10, 10)+
+			"2024-05-01T11:15:00.000Z\tINFO\tTunnel clo"), 0644))
+
+	a := args{
+		logPath:  logPath,
+		from:     base,
+		to:       base.Add(2 * time.Hour),
+		location: time.UTC,
+	}
+	files, err := logFiles(a)
+	require.NoError(t, err)
+	require.Equal(t, []string{archive, logPath}, files)
+
+	r := newReport(a.location, a.from, a.to)
+	for _, path := range files {
+		require.NoError(t, readLogFile(path, r))
+	}
+
+	var output bytes.Buffer
+	require.NoError(t, writeReport(&output, formatCSV, r.Tables(allTables)))
+	require.Equal(t, strings.Join([]string{
+		"table,key,tunnels,http_responses,bytes_sent,bytes_received",
+		"clients,10.0.0.1,2,0,110,1010",
+		"clients,10.0.0.2,0,1,0,50",
+		"destinations,a.com:443,1,0,100,1000",
+		"destinations,b.com,0,1,0,50",
+		"destinations,b.com:443,1,0,10,10",
+		"hours,2024-05-01 10:00,1,1,100,1050",
+		"hours,2024-05-01 11:00,1,0,10,10",
+		"",
+	}, "\n"), output.String())
+
+	output.Reset()
+	require.NoError(t, writeReport(&output, formatJSON, r.Tables([]string{tableClients})))
+	var decoded map[string][]usage
+	require.NoError(t, json.Unmarshal(output.Bytes(), &decoded))
+	require.Equal(t, []usage{
+		{Key: "10.0.0.1", Tunnels: 2, BytesSent: 110, BytesReceived: 1010},
+		{Key: "10.0.0.2", HTTPResponses: 1, BytesReceived: 50},
+	}, decoded[tableClients])
+
+	output.Reset()
+	require.NoError(t, writeReport(&output, formatText, r.Tables([]string{tableHours})))
+	require.Contains(t, output.String(), "2024-05-01 10:00")
+	require.Contains(t, output.String(), "0.00")
+}
+
+func TestLogFiles_UncompressedArchives(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	compressed := filepath.Join(dir, "passer_2024-05-01_11:00:00.log.gz")
+	writeGzipFile(t, compressed, tunnelLine(base.Add(10*time.Minute), "10.0.0.1", "a.com:443", 1, 1))
+	// Rotated but not compressed yet, while its predecessor is being compressed.
+	pending := filepath.Join(dir, "passer_2024-05-01_12:00:00.log")
+	require.NoError(t, os.WriteFile(pending, []byte(tunnelLine(base.Add(70*time.Minute), "10.0.0.1", "b.com:443", 2, 2)), 0644))
+	require.NoError(t, os.WriteFile(pending+".gz.tmp", []byte("partial"), 0644))
+	for i, path := range []string{compressed, pending} {
+		modTime := base.Add(time.Duration(i+1) * time.Hour)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	require.NoError(t, os.WriteFile(logPath, []byte(tunnelLine(base.Add(130*time.Minute), "10.0.0.1", "c.com:443", 4, 4)), 0644))
+
+	a := args{logPath: logPath, location: time.UTC}
+	files, err := logFiles(a)
+	require.NoError(t, err)
+	require.Equal(t, []string{compressed, pending, logPath}, files)
+
+	// Compressed after it was listed.
+	writeGzipFile(t, pending+".gz", tunnelLine(base.Add(70*time.Minute), "10.0.0.1", "b.com:443", 2, 2))
+	require.NoError(t, os.Remove(pending))
+
+	r := newReport(a.location, a.from, a.to)
+	for _, path := range files {
+		require.NoError(t, readLogFile(path, r))
+	}
+	clients := r.Tables([]string{tableClients})[0]
+	require.Equal(t, int64(7), clients.Rows[0].BytesSent)
+}
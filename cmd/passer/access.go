@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/galqiwi/fair-p/internal/logutils"
+	"github.com/galqiwi/fair-p/internal/utils"
+	"net/http"
+	"time"
+)
+
+func (run *Runner) newAccessRecord(r *http.Request, traceId string) *logutils.AccessRecord {
+	url := r.URL.String()
+	if r.Method == http.MethodConnect {
+		url = r.Host
+	}
+
+	return &logutils.AccessRecord{
+		Start:       time.Now(),
+		TraceID:     traceId,
+		Client:      r.RemoteAddr,
+		ClientHost:  utils.TryGettingHostFromRemoteAddr(r.RemoteAddr),
+		Method:      r.Method,
+		Destination: r.Host,
+		URL:         run.redactionPolicy.URL(url),
+		Proto:       r.Proto,
+	}
+}
+
+func (run *Runner) logAccess(rec *logutils.AccessRecord) {
+	rec.Duration = time.Since(rec.Start)
+	run.accessLogger.Log(*rec)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/galqiwi/fair-p/internal/history"
+	"github.com/galqiwi/fair-p/internal/hostlimiters"
+	"github.com/galqiwi/fair-p/internal/logutils"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+func (run *Runner) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", run.logRuntimeInfoHandler)
+	mux.HandleFunc("/metrics", run.metricsHandler)
+	mux.HandleFunc("/history", run.historyHandler)
+	mux.HandleFunc("/dashboard", run.dashboardHandler)
+	mux.Handle("/log/level", run.logControl.Level())
+	mux.HandleFunc("/log/sampling", run.logSamplingHandler)
+	mux.HandleFunc("/log/debug_client", run.debugClientHandler)
+	mux.HandleFunc("/connections", run.connectionsHandler)
+	mux.HandleFunc("/clients", run.clientsHandler)
+	mux.HandleFunc("/limiter_tree", run.limiterTreeHandler)
+	mux.HandleFunc("/host_weights", run.hostWeightsHandler)
+	return mux
+}
+
+func (run *Runner) recordHistory() {
+	err := run.history.Add(history.Sample{
+		Time:               time.Now(),
+		UploadRate:         float64(run.mainSendRateCounter.GetRate()),
+		DownloadRate:       float64(run.mainRecvRateCounter.GetRate()),
+		GuaranteedSend:     float64(run.hostSendLimiterStorage.GetGuaranteedThroughput()),
+		GuaranteedRecv:     float64(run.hostRecvLimiterStorage.GetGuaranteedThroughput()),
+		ClientsSend:        run.hostSendLimiterStorage.GetNHosts(),
+		ClientsRecv:        run.hostRecvLimiterStorage.GetNHosts(),
+		ConcurrentRequests: run.concurrentRequests.Get(),
+	})
+	if err != nil {
+		run.logger.Info("Failed to record history", zap.String("err", err.Error()))
+	}
+}
+
+func (run *Runner) historyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(run.history.Samples())
+}
+
+// limiterTreeHandler shows the limiter trees with the effective and current rates of every node.
+func (run *Runner) limiterTreeHandler(w http.ResponseWriter, r *http.Request) {
+	if run.sendTree == nil {
+		http.Error(w, "limiter tree is not configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]hostlimiters.TreeNodeStatus{
+		"send": run.sendTree.Status(),
+		"recv": run.recvTree.Status(),
+	})
+}
+
+// hostWeightsHandler shows the usage and effective weight of every client.
+func (run *Runner) hostWeightsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]hostlimiters.HostWeight{
+		"send": run.hostSendLimiterStorage.GetWeights(),
+		"recv": run.hostRecvLimiterStorage.GetWeights(),
+	})
+}
+
+func (run *Runner) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(dashboardHTML)
+}
+
+type samplingPayload struct {
+	Tick       string `json:"tick"`
+	First      int    `json:"first"`
+	Thereafter int    `json:"thereafter"`
+}
+
+// logSamplingHandler shows (GET) or replaces (PUT) the log sampling parameters.
+func (run *Runner) logSamplingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var payload samplingPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tick, err := time.ParseDuration(payload.Tick)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sampling := logutils.SamplingConfig{Tick: tick, First: payload.First, Thereafter: payload.Thereafter}
+		if err := run.logControl.SetSampling(sampling); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		run.logger.Info("Log sampling changed",
+			zap.Duration("tick", tick),
+			zap.Int("first", payload.First),
+			zap.Int("thereafter", payload.Thereafter),
+		)
+	default:
+		http.Error(w, "only GET and PUT are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sampling := run.logControl.Sampling()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(samplingPayload{
+		Tick:       sampling.Tick.String(),
+		First:      sampling.First,
+		Thereafter: sampling.Thereafter,
+	})
+}
+
+// debugClientHandler lists (GET) or starts and stops (POST client=...&duration=...)
+// full logging for a single client.
+func (run *Runner) debugClientHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		client := r.FormValue("client")
+		if client == "" {
+			http.Error(w, "client should not be empty", http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid duration: %s", err), http.StatusBadRequest)
+			return
+		}
+		run.logControl.DebugClient(client, duration)
+		run.logger.Info("Client debug logging changed",
+			zap.String("debugged_client", client),
+			zap.Duration("duration", duration),
+		)
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(run.logControl.DebuggedClients())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/galqiwi/fair-p/internal/alerting"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const alertEvaluationInterval = time.Second
+
+func (run *Runner) newAlertEngine(rulesPath, webhook string) (*alerting.Engine, error) {
+	rules, err := alerting.LoadRules(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	engine, err := alerting.NewEngine(rules, webhook, func(err error) {
+		run.logger.Info("Alerting error", zap.String("err", err.Error()))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mb := func(get func() float64) func() float64 {
+		return func() float64 { return get() / 1024 / 1024 }
+	}
+
+	engine.AddCounter("concurrent_requests", run.concurrentRequests)
+	engine.AddCounter("bytes_sent", run.mainSendBytesCounter)
+	engine.AddCounter("bytes_received", run.mainRecvBytesCounter)
+	engine.AddDailyCounter("bytes_today", run.mainSendBytesCounter, run.mainRecvBytesCounter)
+	engine.AddGauge("clients_send", func() float64 { return float64(run.hostSendLimiterStorage.GetNHosts()) })
+	engine.AddGauge("clients_recv", func() float64 { return float64(run.hostRecvLimiterStorage.GetNHosts()) })
+	engine.AddGauge("upload_mb_s", mb(func() float64 { return float64(run.mainSendRateCounter.GetRate()) }))
+	engine.AddGauge("download_mb_s", mb(func() float64 { return float64(run.mainRecvRateCounter.GetRate()) }))
+	engine.AddGauge("guaranteed_send_mb_s", mb(func() float64 { return float64(run.hostSendLimiterStorage.GetGuaranteedThroughput()) }))
+	engine.AddGauge("guaranteed_recv_mb_s", mb(func() float64 { return float64(run.hostRecvLimiterStorage.GetGuaranteedThroughput()) }))
+
+	if err := engine.CheckMetrics(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"github.com/galqiwi/fair-p/internal/accounting"
+	"github.com/galqiwi/fair-p/internal/logutils"
+	"github.com/galqiwi/fair-p/internal/rotate"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/time/rate"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -11,24 +18,260 @@ type args struct {
 	port               int
 	runtimeLogInterval time.Duration
 	maxThroughput      rate.Limit
+	usageHalfLife      time.Duration
+	clientPacing       time.Duration
+	mainPacing         time.Duration
 	noIPv4             bool
+	idleTimeout        time.Duration
+	logFormat          logutils.Format
+	logLevel           zapcore.Level
+	logSampling        logutils.SamplingConfig
+	logQueueSize       int
+	logOverflowPolicy  logutils.OverflowPolicy
+	logRotate          rotate.Config
+	syslog             logutils.SyslogConfig
+	syslogOnly         bool
+	accessLogFormat    logutils.AccessLogFormat
+	accessLogPath      string
+	redaction          logutils.RedactionConfig
+	otlpEndpoint       string
+	otlpServiceName    string
+	otlpExportInterval time.Duration
+	adminAddr          string
+	historyDuration    time.Duration
+	historyPath        string
+	alertRulesPath     string
+	alertWebhook       string
+	limiterTreePath    string
+	priorityPath       string
+	accounting         accounting.Config
 }
 
 func getArgs() (args, error) {
 	port := flag.Int("port", 8888, "serve port")
 	runtimeLogIntervalS := flag.Float64("runtime_log_interval_sec", 10., "runtime log interval")
 	maxThroughput := flag.Float64("max_throughput", 0, "Max throughput (MB/s)")
+	usageHalfLifeM := flag.Float64("usage_half_life_min", 0, "shrink the share of clients by their recent usage, which decays by half in this time (0 for equal shares)")
+	clientPacingMs := flag.Float64("client_pacing_ms", 0, "pace every client's data in chunks of what its current rate allows in this time, instead of bursts of up to 2 MB (0 disables pacing)")
+	mainPacingMs := flag.Float64("main_pacing_ms", 0, "same as client_pacing_ms for the total and shared throughput limiters")
 	noIPv4 := flag.Bool("no_ipv4", false, "disable ipv4 (optimisation for dns64 systems)")
+	idleTimeoutS := flag.Float64("idle_timeout_sec", 0, "close tunnels and responses that forward nothing for this long (0 for no limit)")
+	logFormat := flag.String("log_format", "console", "log format: console or json")
+	logLevel := flag.String("log_level", "info", "log level: debug, info, warn or error")
+	logSamplingTickS := flag.Float64("log_sampling_tick_sec", 1., "log sampling interval")
+	logSamplingFirst := flag.Int("log_sampling_first", 10, "log the first N entries with the same message per sampling interval (0 disables sampling)")
+	logSamplingThereafter := flag.Int("log_sampling_thereafter", 10, "after the first entries, log every Nth entry with the same message per sampling interval")
+	logQueueSize := flag.Int("log_queue_size", 1000, "number of log messages queued for the output")
+	logOverflowPolicy := flag.String("log_overflow_policy", "block", "what to do when the log queue is full: block, drop_newest or drop_oldest")
+	logPath := flag.String("log_path", "", "write the log to this rotated file instead of stdout")
+	logMaxSize := flag.Int64("log_max_size", 100, "rotate the log file at this size in MB (0 for no limit)")
+	logRotateInterval := flag.String("log_rotate_interval", "none", "also rotate the log file every hour or day: none, hourly or daily")
+	logRotateUTC := flag.Bool("log_rotate_utc", false, "align time-based rotation to UTC instead of local time")
+	logMaxArchives := flag.Int("log_max_archives", 0, "max number of compressed log archives to keep (0 for no limit)")
+	logMaxAgeH := flag.Float64("log_max_age_hours", 0, "delete log archives older than this (0 for no limit)")
+	logMaxTotalSize := flag.Int64("log_max_total_size", 0, "max total size of log archives in MB (0 for no limit)")
+	syslogAddr := flag.String("syslog_addr", "", "also send the log to syslog as RFC 5424 messages: unixgram:/dev/log, udp:host:port or tcp:host:port")
+	syslogFacility := flag.String("syslog_facility", "daemon", "syslog facility: daemon, user, local0 ... local7")
+	syslogAppName := flag.String("syslog_app_name", "passer", "APP-NAME of syslog messages")
+	syslogOnly := flag.Bool("syslog_only", false, "send the log only to syslog, not to stdout or --log_path")
+	accessLogFormat := flag.String("access_log_format", "none", "access log format: none, json, squid or common")
+	accessLogPath := flag.String("access_log_path", "", "access log file (default: write to the main log stream)")
+	redactHeaders := flag.String("log_redact_headers", strings.Join(logutils.DefaultRedactedHeaders, ","), "comma-separated headers redacted in logs")
+	allowHeaders := flag.String("log_allow_headers", "", "comma-separated headers logged verbatim, all others are redacted (overrides --log_redact_headers)")
+	redactMode := flag.String("log_redact_mode", "mask", "how redacted headers are logged: mask or hash (an HMAC-SHA256 that only correlates while the key is the same, see --log_redact_hash_key_file)")
+	redactHashKeyFile := flag.String("log_redact_hash_key_file", "", "file with the HMAC key of --log_redact_mode hash (default: a random key per process, so hashes do not correlate across restarts)")
+	maxURLLength := flag.Int("log_max_url_length", 0, "truncate logged URLs to this length (0 for no limit)")
+	maxQueryLength := flag.Int("log_max_query_length", -1, "truncate logged query strings to this length (0 drops them, -1 for no limit)")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces (tracing is disabled if empty)")
+	otlpServiceName := flag.String("otlp_service_name", "passer", "service.name reported to the OTLP collector")
+	otlpExportIntervalS := flag.Float64("otlp_export_interval_sec", 5., "span export interval")
+	adminAddr := flag.String("admin_addr", "", "admin listener address, e.g. 127.0.0.1:8889 (disabled if empty)")
+	historyDurationH := flag.Float64("history_duration_hours", 24., "how long runtime samples are kept for the dashboard")
+	historyPath := flag.String("history_path", "", "file to persist runtime samples to (in-memory only if empty)")
+	alertRulesPath := flag.String("alert_rules", "", "JSON file with alert rules (alerting is disabled if empty)")
+	alertWebhook := flag.String("alert_webhook", "", "default webhook URL for alert rules")
+	limiterTreePath := flag.String("limiter_tree", "", "JSON file with a hierarchical limiter tree used instead of per-client fair sharing")
+	priorityPath := flag.String("priority_classes", "", "JSON file with priority classes sharing the max throughput by deficit round-robin (disabled if empty)")
+	accountingPath := flag.String("accounting_path", "", "append per-client usage records to this file (disabled if empty)")
+	accountingFormat := flag.String("accounting_format", "csv", "accounting record format: csv or jsonl")
+	accountingIntervalM := flag.Float64("accounting_interval_min", 5., "length of an accounting period")
+	accountingRollover := flag.String("accounting_rollover", "daily", "start a new accounting file every hour or day (UTC): none, hourly or daily")
 	flag.Parse()
 
 	if *maxThroughput == float64(0) {
 		return args{}, fmt.Errorf("max throughput must be greater than zero")
 	}
 
+	if *runtimeLogIntervalS <= 0 {
+		return args{}, fmt.Errorf("runtime log interval must be greater than zero")
+	}
+
+	if *otlpExportIntervalS <= 0 {
+		return args{}, fmt.Errorf("span export interval must be greater than zero")
+	}
+
+	if *usageHalfLifeM < 0 {
+		return args{}, fmt.Errorf("usage half-life must not be negative")
+	}
+
+	if *clientPacingMs < 0 || *mainPacingMs < 0 {
+		return args{}, fmt.Errorf("pacing time slices must not be negative")
+	}
+
+	if *idleTimeoutS < 0 {
+		return args{}, fmt.Errorf("idle timeout must not be negative")
+	}
+
+	parsedLogFormat, err := logutils.ParseFormat(*logFormat)
+	if err != nil {
+		return args{}, err
+	}
+
+	parsedLogLevel, err := zapcore.ParseLevel(*logLevel)
+	if err != nil {
+		return args{}, err
+	}
+
+	logSampling := logutils.SamplingConfig{
+		Tick:       time.Duration(float64(time.Second) * *logSamplingTickS),
+		First:      *logSamplingFirst,
+		Thereafter: *logSamplingThereafter,
+	}
+	if err := logSampling.Validate(); err != nil {
+		return args{}, err
+	}
+
+	if *logQueueSize <= 0 {
+		return args{}, fmt.Errorf("log queue size must be greater than zero")
+	}
+
+	parsedOverflowPolicy, err := logutils.ParseOverflowPolicy(*logOverflowPolicy)
+	if err != nil {
+		return args{}, err
+	}
+
+	parsedLogRotateInterval, err := rotate.ParseInterval(*logRotateInterval)
+	if err != nil {
+		return args{}, err
+	}
+
+	if *logMaxSize < 0 || *logMaxArchives < 0 || *logMaxAgeH < 0 || *logMaxTotalSize < 0 {
+		return args{}, fmt.Errorf("log rotation limits must not be negative")
+	}
+
+	syslog := logutils.SyslogConfig{AppName: *syslogAppName}
+	if *syslogAddr != "" {
+		syslog.Network, syslog.Addr, err = logutils.ParseSyslogAddr(*syslogAddr)
+		if err != nil {
+			return args{}, err
+		}
+		syslog.Facility, err = logutils.ParseSyslogFacility(*syslogFacility)
+		if err != nil {
+			return args{}, err
+		}
+	} else if *syslogOnly {
+		return args{}, fmt.Errorf("syslog_only needs syslog_addr")
+	}
+
+	parsedAccessLogFormat, err := logutils.ParseAccessLogFormat(*accessLogFormat)
+	if err != nil {
+		return args{}, err
+	}
+	if *syslogOnly && parsedAccessLogFormat != logutils.AccessLogNone && *accessLogPath == "" {
+		return args{}, fmt.Errorf("syslog_only with access_log_format needs access_log_path")
+	}
+
+	parsedRedactMode, err := logutils.ParseRedactionMode(*redactMode)
+	if err != nil {
+		return args{}, err
+	}
+
+	var redactHashKey []byte
+	if *redactHashKeyFile != "" {
+		redactHashKey, err = os.ReadFile(*redactHashKeyFile)
+		if err != nil {
+			return args{}, fmt.Errorf("failed to read redaction hash key: %s", err)
+		}
+		redactHashKey = bytes.TrimSpace(redactHashKey)
+		if len(redactHashKey) == 0 {
+			return args{}, fmt.Errorf("redaction hash key %q is empty", *redactHashKeyFile)
+		}
+	}
+
+	parsedAccountingFormat, err := accounting.ParseFormat(*accountingFormat)
+	if err != nil {
+		return args{}, err
+	}
+
+	parsedAccountingRollover, err := rotate.ParseInterval(*accountingRollover)
+	if err != nil {
+		return args{}, err
+	}
+
+	accountingInterval := time.Duration(float64(time.Minute) * *accountingIntervalM)
+	if accountingInterval < time.Second {
+		return args{}, fmt.Errorf("accounting interval must be at least a second")
+	}
+
 	return args{
 		port:               *port,
 		runtimeLogInterval: time.Duration(float64(time.Second) * *runtimeLogIntervalS),
 		maxThroughput:      rate.Limit(*maxThroughput * 1024 * 1024),
+		usageHalfLife:      time.Duration(float64(time.Minute) * *usageHalfLifeM),
+		clientPacing:       time.Duration(float64(time.Millisecond) * *clientPacingMs),
+		mainPacing:         time.Duration(float64(time.Millisecond) * *mainPacingMs),
 		noIPv4:             *noIPv4,
+		idleTimeout:        time.Duration(float64(time.Second) * *idleTimeoutS),
+		logFormat:          parsedLogFormat,
+		logLevel:           parsedLogLevel,
+		logSampling:        logSampling,
+		logQueueSize:       *logQueueSize,
+		logOverflowPolicy:  parsedOverflowPolicy,
+		logRotate: rotate.Config{
+			Path:     *logPath,
+			MaxSize:  *logMaxSize * 1024 * 1024,
+			Interval: parsedLogRotateInterval,
+			UTC:      *logRotateUTC,
+			Retention: rotate.RetentionPolicy{
+				MaxArchives:  *logMaxArchives,
+				MaxAge:       time.Duration(float64(time.Hour) * *logMaxAgeH),
+				MaxTotalSize: *logMaxTotalSize * 1024 * 1024,
+			},
+		},
+		syslog:          syslog,
+		syslogOnly:      *syslogOnly,
+		accessLogFormat: parsedAccessLogFormat,
+		accessLogPath:   *accessLogPath,
+		redaction: logutils.RedactionConfig{
+			Mode:           parsedRedactMode,
+			DenyHeaders:    splitList(*redactHeaders),
+			AllowHeaders:   splitList(*allowHeaders),
+			MaxURLLength:   *maxURLLength,
+			MaxQueryLength: *maxQueryLength,
+			HashKey:        redactHashKey,
+		},
+		otlpEndpoint:       *otlpEndpoint,
+		otlpServiceName:    *otlpServiceName,
+		otlpExportInterval: time.Duration(float64(time.Second) * *otlpExportIntervalS),
+		adminAddr:          *adminAddr,
+		historyDuration:    time.Duration(float64(time.Hour) * *historyDurationH),
+		historyPath:        *historyPath,
+		alertRulesPath:     *alertRulesPath,
+		alertWebhook:       *alertWebhook,
+		limiterTreePath:    *limiterTreePath,
+		priorityPath:       *priorityPath,
+		accounting: accounting.Config{
+			Path:     *accountingPath,
+			Format:   parsedAccountingFormat,
+			Interval: accountingInterval,
+			Rollover: parsedAccountingRollover,
+		},
 	}, nil
 }
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
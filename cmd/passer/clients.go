@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/ratelimit"
+)
+
+// clientStats are the counters of a client host, kept while it has open connections.
+type clientStats struct {
+	clientHost    string
+	waits         ratelimit.LevelTimers
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+
+	// guarded by clientRegistry.mu
+	connections  int
+	sampledBytes int64
+	sampledAt    time.Time
+	// rate is the achieved rate between the last two samples in bytes per second.
+	rate float64
+}
+
+type byteCounter struct {
+	n *atomic.Int64
+}
+
+func (c byteCounter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (c *clientStats) sendWriter() io.Writer {
+	return byteCounter{&c.bytesSent}
+}
+
+func (c *clientStats) recvWriter() io.Writer {
+	return byteCounter{&c.bytesReceived}
+}
+
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[string]*clientStats
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[string]*clientStats)}
+}
+
+// open returns the stats of clientHost for a new connection. They must be closed.
+func (r *clientRegistry) open(clientHost string) *clientStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.clients[clientHost]
+	if !ok {
+		c = &clientStats{clientHost: clientHost, sampledAt: time.Now()}
+		r.clients[clientHost] = c
+	}
+	c.connections++
+	return c
+}
+
+func (r *clientRegistry) close(c *clientStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c.connections--
+	if c.connections == 0 {
+		delete(r.clients, c.clientHost)
+	}
+}
+
+// sample updates the achieved rate of every client and returns Jain's fairness index over the rates of
+// the clients that moved data since the previous sample, with their number. The index is 1 when every such
+// client got the same rate and 1/n when one of n clients got everything; it is 1 if there are none.
+func (r *clientRegistry) sample(now time.Time) (float64, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rates []float64
+	for _, c := range r.clients {
+		bytes := c.bytesSent.Load() + c.bytesReceived.Load()
+		if elapsed := now.Sub(c.sampledAt).Seconds(); elapsed > 0 {
+			c.rate = float64(bytes-c.sampledBytes) / elapsed
+		}
+		c.sampledBytes = bytes
+		c.sampledAt = now
+
+		if c.rate > 0 {
+			rates = append(rates, c.rate)
+		}
+	}
+	return jainIndex(rates), len(rates)
+}
+
+func jainIndex(rates []float64) float64 {
+	if len(rates) == 0 {
+		return 1
+	}
+
+	sum, sumSquares := 0., 0.
+	for _, rate := range rates {
+		sum += rate
+		sumSquares += rate * rate
+	}
+	return sum * sum / (float64(len(rates)) * sumSquares)
+}
+
+type clientStatus struct {
+	ClientHost    string  `json:"client_host"`
+	Connections   int     `json:"connections"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	Rate          float64 `json:"rate"`
+	// Wait times are in seconds.
+	WaitHost   float64 `json:"wait_host"`
+	WaitShared float64 `json:"wait_shared"`
+	WaitMain   float64 `json:"wait_main"`
+}
+
+func (r *clientRegistry) list() []clientStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	output := make([]clientStatus, 0, len(r.clients))
+	for _, c := range r.clients {
+		output = append(output, clientStatus{
+			ClientHost:    c.clientHost,
+			Connections:   c.connections,
+			BytesSent:     c.bytesSent.Load(),
+			BytesReceived: c.bytesReceived.Load(),
+			Rate:          c.rate,
+			WaitHost:      c.waits.Get(ratelimit.LevelHost).Seconds(),
+			WaitShared:    c.waits.Get(ratelimit.LevelShared).Seconds(),
+			WaitMain:      c.waits.Get(ratelimit.LevelMain).Seconds(),
+		})
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].ClientHost < output[j].ClientHost
+	})
+	return output
+}
+
+// clientsHandler lists the clients with open connections, their traffic and the time they spent
+// waiting at every limiter level.
+func (run *Runner) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(run.clients.list())
+}
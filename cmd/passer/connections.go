@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/accounting"
+	"github.com/galqiwi/fair-p/internal/logutils"
+	"github.com/galqiwi/fair-p/internal/ratelimit"
+	"go.uber.org/zap"
+)
+
+// Causes of an interrupted connection, returned by context.Cause.
+var (
+	errShutdown    = errors.New("proxy is shutting down")
+	errIdleTimeout = errors.New("idle timeout")
+	errKilled      = errors.New("killed on the admin listener")
+)
+
+// connection is a request or tunnel being proxied. Its context is cancelled on shutdown,
+// after idleTimeout without traffic, or by an admin kill.
+type connection struct {
+	TraceID     string    `json:"trace_id"`
+	ClientHost  string    `json:"client_host"`
+	Destination string    `json:"destination"`
+	Method      string    `json:"method"`
+	Start       time.Time `json:"start"`
+	// Class is the priority class, empty without priority classes.
+	Class string `json:"class,omitempty"`
+
+	waitTimer *ratelimit.WaitTimer
+	waits     *ratelimit.LevelTimers
+	client    *clientStats
+	usage     *accounting.Handle
+
+	cancel context.CancelCauseFunc
+	// lastActivity is the time of the last forwarded chunk in nanoseconds since the epoch.
+	lastActivity atomic.Int64
+}
+
+// Write marks the connection as active, it is part of the copy destination.
+func (c *connection) Write(p []byte) (int, error) {
+	c.lastActivity.Store(time.Now().UnixNano())
+	return len(p), nil
+}
+
+type connectionRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*connection
+	wg    sync.WaitGroup
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{conns: make(map[string]*connection)}
+}
+
+// openConnection registers a connection for rec in the given priority class. It must be closed with closeConnection.
+func (run *Runner) openConnection(ctx context.Context, rec *logutils.AccessRecord, class string) (context.Context, *connection) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	conn := &connection{
+		TraceID:     rec.TraceID,
+		ClientHost:  rec.ClientHost,
+		Destination: rec.Destination,
+		Method:      rec.Method,
+		Start:       rec.Start,
+		Class:       class,
+		waitTimer:   &ratelimit.WaitTimer{},
+		waits:       &ratelimit.LevelTimers{},
+		client:      run.clients.open(rec.ClientHost),
+		usage:       run.accounting.Open(rec.ClientHost),
+		cancel:      cancel,
+	}
+	conn.lastActivity.Store(time.Now().UnixNano())
+
+	r := run.connections
+	r.mu.Lock()
+	r.conns[conn.TraceID] = conn
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	if run.idleTimeout > 0 {
+		go conn.watchIdle(ctx, run.idleTimeout)
+	}
+	return ctx, conn
+}
+
+func (run *Runner) closeConnection(conn *connection) {
+	conn.cancel(nil)
+	conn.usage.Close()
+	run.clients.close(conn.client)
+
+	r := run.connections
+	r.mu.Lock()
+	delete(r.conns, conn.TraceID)
+	r.wg.Done()
+	r.mu.Unlock()
+}
+
+// waitFields are the times conn spent waiting at every limiter level.
+func (c *connection) waitFields() []zap.Field {
+	fields := make([]zap.Field, 0, len(ratelimit.Levels))
+	for _, level := range ratelimit.Levels {
+		fields = append(fields, zap.Duration("wait_"+level.String(), c.waits.Get(level)))
+	}
+	return fields
+}
+
+func (c *connection) watchIdle(ctx context.Context, timeout time.Duration) {
+	wait := timeout
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, c.lastActivity.Load()))
+		if idle >= timeout {
+			c.cancel(errIdleTimeout)
+			return
+		}
+		wait = timeout - idle
+	}
+}
+
+// kill interrupts the connections with the given trace id or client host and returns how many matched.
+func (r *connectionRegistry) kill(traceID string, clientHost string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	killed := 0
+	for _, conn := range r.conns {
+		if (traceID != "" && conn.TraceID == traceID) || (clientHost != "" && conn.ClientHost == clientHost) {
+			conn.cancel(errKilled)
+			killed++
+		}
+	}
+	return killed
+}
+
+func (r *connectionRegistry) list() []*connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	output := make([]*connection, 0, len(r.conns))
+	for _, conn := range r.conns {
+		output = append(output, conn)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Start.Before(output[j].Start)
+	})
+	return output
+}
+
+// wait waits until every connection is closed or ctx is done.
+func (r *connectionRegistry) wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// connectionsHandler lists (GET) or kills (POST trace_id=... or client=...) active connections.
+func (run *Runner) connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(run.connections.list())
+	case http.MethodPost:
+		traceID := r.FormValue("trace_id")
+		client := r.FormValue("client")
+		if traceID == "" && client == "" {
+			http.Error(w, "trace_id or client should be set", http.StatusBadRequest)
+			return
+		}
+		killed := run.connections.kill(traceID, client)
+		run.logger.Info("Connections killed",
+			zap.String("killed_trace_id", traceID),
+			zap.String("killed_client", client),
+			zap.Int("killed", killed),
+		)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"killed": killed})
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+	}
+}
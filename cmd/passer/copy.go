@@ -1,32 +1,84 @@
 package main
 
 import (
+	"context"
 	"github.com/galqiwi/fair-p/internal/ratelimit"
 	"io"
 )
 
-func (run *Runner) CopyRecv(dst io.Writer, src io.Reader, remoteHost string) (int64, error) {
-	hostLimiter := run.hostRecvLimiterStorage.GetLimiterHandle(remoteHost)
+// waitObservers receive the waits of c: the connection, its client and the histogram.
+func (c *connection) waitObservers(histogram *ratelimit.WaitHistogram) []ratelimit.WaitObserver {
+	return []ratelimit.WaitObserver{c.waits, &c.client.waits, histogram}
+}
+
+// limiters is the policy applied to every chunk of c: the client's share and the total throughput.
+// With priority classes the total throughput is shared by the classes, and the client's share is taken first.
+func (c *connection) limiters(client ratelimit.Limiter, main ratelimit.Limiter, scheduler *ratelimit.Scheduler, observers []ratelimit.WaitObserver) []ratelimit.Limiter {
+	if scheduler == nil {
+		return []ratelimit.Limiter{
+			ratelimit.NewTimedLimiter(
+				ratelimit.AllOf(client, ratelimit.Labeled(main, ratelimit.LevelMain, observers...)),
+				c.waitTimer, c.usage.WaitTimer(),
+			),
+		}
+	}
+	return []ratelimit.Limiter{
+		ratelimit.NewTimedLimiter(client, c.waitTimer, c.usage.WaitTimer()),
+		ratelimit.NewTimedLimiter(
+			ratelimit.Labeled(scheduler.Class(c.Class), ratelimit.LevelMain, observers...),
+			c.waitTimer, c.usage.WaitTimer(),
+		),
+	}
+}
+
+func (run *Runner) CopyRecv(ctx context.Context, dst io.Writer, src io.Reader, conn *connection) (int64, error) {
+	// The host handle is kept with a limiter tree too, it is counted in the stats.
+	hostLimiter := run.hostRecvLimiterStorage.GetLimiterHandle(conn.ClientHost)
 	defer hostLimiter.CloseHandle()
+
+	observers := conn.waitObservers(run.waitHistogram)
+
+	// The client's guaranteed share, or the shared pool when the share is exhausted.
+	client := ratelimit.FirstOf(
+		ratelimit.Labeled(hostLimiter.Bucket, ratelimit.LevelHost, observers...),
+		ratelimit.Labeled(run.sharedRecvLimiter, ratelimit.LevelShared, observers...),
+	)
+	if run.recvTree != nil {
+		leaf := run.recvTree.Open(conn.ClientHost)
+		defer leaf.Close()
+		client = ratelimit.Labeled(leaf, ratelimit.LevelHost, observers...)
+	}
+
 	return ratelimit.Copy(
-		io.MultiWriter(dst, run.mainRecvRateCounter, run.mainRecvBytesCounter.GetCountingWriter()),
+		ctx,
+		io.MultiWriter(dst, run.mainRecvRateCounter, run.mainRecvBytesCounter.GetCountingWriter(), conn.usage.RecvWriter(), conn.client.recvWriter(), &hostLimiter, conn),
 		src,
-		[]ratelimit.Limiter{
-			ratelimit.NewCombinedLimiter(hostLimiter.Limiter, run.sharedRecvLimiter),
-			run.mainRecvLimiter,
-		},
+		conn.limiters(client, run.mainRecvLimiter, run.recvScheduler, observers),
 	)
 }
 
-func (run *Runner) CopySend(dst io.Writer, src io.Reader, remoteHost string) (int64, error) {
-	hostLimiter := run.hostSendLimiterStorage.GetLimiterHandle(remoteHost)
+func (run *Runner) CopySend(ctx context.Context, dst io.Writer, src io.Reader, conn *connection) (int64, error) {
+	// The host handle is kept with a limiter tree too, it is counted in the stats.
+	hostLimiter := run.hostSendLimiterStorage.GetLimiterHandle(conn.ClientHost)
 	defer hostLimiter.CloseHandle()
+
+	observers := conn.waitObservers(run.waitHistogram)
+
+	// The client's guaranteed share, or the shared pool when the share is exhausted.
+	client := ratelimit.FirstOf(
+		ratelimit.Labeled(hostLimiter.Bucket, ratelimit.LevelHost, observers...),
+		ratelimit.Labeled(run.sharedSendLimiter, ratelimit.LevelShared, observers...),
+	)
+	if run.sendTree != nil {
+		leaf := run.sendTree.Open(conn.ClientHost)
+		defer leaf.Close()
+		client = ratelimit.Labeled(leaf, ratelimit.LevelHost, observers...)
+	}
+
 	return ratelimit.Copy(
-		io.MultiWriter(dst, run.mainSendRateCounter, run.mainSendBytesCounter.GetCountingWriter()),
+		ctx,
+		io.MultiWriter(dst, run.mainSendRateCounter, run.mainSendBytesCounter.GetCountingWriter(), conn.usage.SendWriter(), conn.client.sendWriter(), &hostLimiter, conn),
 		src,
-		[]ratelimit.Limiter{
-			ratelimit.NewCombinedLimiter(hostLimiter.Limiter, run.sharedSendLimiter),
-			run.mainSendLimiter,
-		},
+		conn.limiters(client, run.mainSendLimiter, run.sendScheduler, observers),
 	)
 }
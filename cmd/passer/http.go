@@ -1,45 +1,76 @@
 package main
 
 import (
+	"github.com/galqiwi/fair-p/internal/logutils"
+	"github.com/galqiwi/fair-p/internal/tracing"
 	"github.com/galqiwi/fair-p/internal/utils"
 	"go.uber.org/zap"
 	"net/http"
+	"time"
 )
 
-func (run *Runner) handleHTTP(w http.ResponseWriter, r *http.Request, logger *zap.Logger) {
+func (run *Runner) handleHTTP(w http.ResponseWriter, r *http.Request, logger *zap.Logger, rec *logutils.AccessRecord, span *tracing.Span) {
 	run.concurrentRequests.Add(1)
 	defer run.concurrentRequests.Sub(1)
 
-	remoteHost := utils.TryGettingHostFromRemoteAddr(r.RemoteAddr)
+	ctx, conn := run.openConnection(r.Context(), rec, run.priorityClass(r))
+	defer run.closeConnection(conn)
+	defer func() { rec.ThrottleTime = conn.waitTimer.Get() }()
 
 	logger = logger.With(
-		zap.String("url", r.URL.String()),
+		zap.String("url", run.redactionPolicy.URL(r.URL.String())),
 		zap.String("destination", r.Host),
-		zap.String("client_host", remoteHost),
 		zap.String("client", r.RemoteAddr),
 	)
 
 	logger.Info("Handling HTTP request")
 
+	r.Header.Set(requestIdHeader, rec.TraceID)
+	r.Header.Del(priorityHeader)
+
+	dialSpan := span.StartChild("dial", tracing.SpanKindClient)
 	// TODO: upload limiter?
 	// TODO: noIPv4
-	resp, err := http.DefaultTransport.RoundTrip(r)
+	resp, err := http.DefaultTransport.RoundTrip(r.WithContext(ctx))
 	if err != nil {
-		logger.Info("RoundTrip error", zap.String("err", err.Error()))
+		dialSpan.SetError(err)
+		dialSpan.End()
+		span.SetError(err)
+		logger.Info("RoundTrip error", zap.String("err", run.redactionPolicy.Error(err)))
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		rec.Status = http.StatusServiceUnavailable
 		return
 	}
 	defer resp.Body.Close()
+	logger.Debug("Got upstream response",
+		zap.Int("status", resp.StatusCode),
+		zap.Int64("content_length", resp.ContentLength),
+		zap.String("content_type", resp.Header.Get("Content-Type")),
+	)
+	dialSpan.SetAttributes(tracing.Int64("http.status_code", int64(resp.StatusCode)))
+	dialSpan.End()
+	span.SetAttributes(tracing.Int64("http.status_code", int64(resp.StatusCode)))
+
+	rec.Status = resp.StatusCode
+	rec.ContentType = resp.Header.Get("Content-Type")
+
 	utils.CopyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 
-	recv, err := run.CopyRecv(w, resp.Body, remoteHost)
+	copySpan := span.StartChild("response_copy", tracing.SpanKindInternal)
+	recv, err := run.CopyRecv(ctx, w, resp.Body, conn)
+	rec.BytesReceived = recv
+	copySpan.SetAttributes(
+		tracing.Int64("bytes_received", recv),
+		tracing.Float64("throttle_time_ms", float64(conn.waitTimer.Get())/float64(time.Millisecond)),
+	)
+	copySpan.SetError(err)
+	copySpan.End()
 
 	if err != nil {
 		logger.Info("Error copying response body", zap.String("err", err.Error()))
 		return
 	}
-	logger.Info("HTTP response forwarded",
-		zap.Int64("bytes_received", recv),
-	)
+	fields := append([]zap.Field{zap.Int64("bytes_received", recv)}, conn.waitFields()...)
+	logger.Info("HTTP response forwarded", fields...)
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
-	"github.com/galqiwi/fair-p/internal/utils"
+	"context"
+	"github.com/galqiwi/fair-p/internal/logutils"
+	"github.com/galqiwi/fair-p/internal/tracing"
 	"net"
 	"net/http"
 	"sync"
@@ -17,35 +19,47 @@ func (run *Runner) getNetwork() string {
 	return "tcp"
 }
 
-func (run *Runner) handleTunneling(w http.ResponseWriter, r *http.Request, logger *zap.Logger) {
+func (run *Runner) handleTunneling(w http.ResponseWriter, r *http.Request, logger *zap.Logger, rec *logutils.AccessRecord, span *tracing.Span) {
 	start := time.Now()
 	run.concurrentRequests.Add(1)
 	defer run.concurrentRequests.Sub(1)
 
-	remoteHost := utils.TryGettingHostFromRemoteAddr(r.RemoteAddr)
+	ctx, conn := run.openConnection(r.Context(), rec, run.priorityClass(r))
+	defer run.closeConnection(conn)
+	defer func() { rec.ThrottleTime = conn.waitTimer.Get() }()
 
 	logger = logger.With(
 		zap.String("destination", r.Host),
-		zap.String("client_host", remoteHost),
 		zap.String("client", r.RemoteAddr),
 	)
 
-	destConn, err := net.DialTimeout(run.getNetwork(), r.Host, 10*time.Second)
+	logger.Debug("Dialing destination", zap.String("network", run.getNetwork()))
+	dialSpan := span.StartChild("dial", tracing.SpanKindClient)
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	destConn, err := dialer.DialContext(ctx, run.getNetwork(), r.Host)
+	dialSpan.SetError(err)
+	dialSpan.End()
 	if err != nil {
+		span.SetError(err)
 		logger.Info("Error dialing destination", zap.String("err", err.Error()))
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		rec.Status = http.StatusServiceUnavailable
 		return
 	}
 	dialDuration := time.Since(start)
 
+	w.Header().Set(requestIdHeader, rec.TraceID)
 	w.WriteHeader(http.StatusOK)
+	rec.Status = http.StatusOK
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		logger.Info("Hijacking not supported")
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
-	clientConn, _, err := hijacker.Hijack()
+	// The server may have buffered data the client sent right after the request, so the client side
+	// is read through clientBuf.
+	clientConn, clientBuf, err := hijacker.Hijack()
 	if err != nil {
 		logger.Info("Hijacking error", zap.String("err", err.Error()))
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
@@ -53,6 +67,16 @@ func (run *Runner) handleTunneling(w http.ResponseWriter, r *http.Request, logge
 	}
 	logger.Info("Tunnel established", zap.Duration("duration", dialDuration))
 
+	// Blocked reads and writes are interrupted by closing both sides.
+	stopInterrupt := context.AfterFunc(ctx, func() {
+		destConn.Close()
+		clientConn.Close()
+	})
+	defer stopInterrupt()
+
+	tunnelSpan := span.StartChild("tunnel", tracing.SpanKindInternal)
+	defer tunnelSpan.End()
+
 	sentChan := make(chan int64, 1)
 	recvChan := make(chan int64, 1)
 
@@ -68,7 +92,7 @@ func (run *Runner) handleTunneling(w http.ResponseWriter, r *http.Request, logge
 			clientConn.Close()
 		}()
 
-		n, err := run.CopySend(destConn, clientConn, remoteHost)
+		n, err := run.CopySend(ctx, destConn, clientBuf.Reader, conn)
 
 		sentChan <- n
 
@@ -87,7 +111,7 @@ func (run *Runner) handleTunneling(w http.ResponseWriter, r *http.Request, logge
 			clientConn.Close()
 		}()
 
-		n, err := run.CopyRecv(clientConn, destConn, remoteHost)
+		n, err := run.CopyRecv(ctx, clientConn, destConn, conn)
 
 		recvChan <- n
 
@@ -104,10 +128,24 @@ func (run *Runner) handleTunneling(w http.ResponseWriter, r *http.Request, logge
 
 	closingSide := <-closingSideChan
 
-	logger.Info(
-		"Tunnel closed",
+	rec.BytesSent = sent
+	rec.BytesReceived = recv
+
+	tunnelSpan.SetAttributes(
+		tracing.Int64("bytes_sent", sent),
+		tracing.Int64("bytes_received", recv),
+		tracing.Float64("throttle_time_ms", float64(conn.waitTimer.Get())/float64(time.Millisecond)),
+		tracing.String("closing_side", closingSide),
+	)
+
+	fields := []zap.Field{
 		zap.Int64("bytes_sent", sent),
 		zap.Int64("bytes_received", recv),
 		zap.Any("closing_side", closingSide),
-	)
+	}
+	fields = append(fields, conn.waitFields()...)
+	if ctx.Err() != nil {
+		fields = append(fields, zap.String("interrupted", context.Cause(ctx).Error()))
+	}
+	logger.Info("Tunnel closed", fields...)
 }
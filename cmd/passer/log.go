@@ -1,19 +1,22 @@
 package main
 
 import (
-	"context"
 	"fmt"
+	"github.com/galqiwi/fair-p/internal/rate_counter"
 	"github.com/galqiwi/fair-p/internal/utils"
 	"net/http"
 	"runtime"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func (run *Runner) runRuntimeLogLoop() {
 	for {
 		run.logRuntimeInfo()
+		run.recordHistory()
 		time.Sleep(run.runtimeLogInterval)
 	}
 }
@@ -29,10 +32,14 @@ func (run *Runner) logRuntimeInfo() {
 	gomaxprocs := runtime.GOMAXPROCS(0)
 	numCgoCalls := runtime.NumCgoCall()
 
+	fairnessIndex, fairnessClients := run.clients.sample(time.Now())
+
 	// Log various runtime and memory statistics
 	run.logger.Info("Runtime Info",
 		zap.Float64("UploadSpeed (MB/s)", float64(run.mainSendRateCounter.GetRate()/1024/1024)),
 		zap.Float64("DownloadSpeed (MB/s)", float64(run.mainRecvRateCounter.GetRate()/1024/1024)),
+		zap.Object("UploadSpeeds (MB/s)", rateFields(run.mainSendRateCounter.GetRates())),
+		zap.Object("DownloadSpeeds (MB/s)", rateFields(run.mainRecvRateCounter.GetRates())),
 		zap.Float64("GuaranteedThroughput(send) (MB/s)", float64(run.hostSendLimiterStorage.GetGuaranteedThroughput()/1024/1024)),
 		zap.Float64("GuaranteedThroughput(recv) (MB/s)", float64(run.hostRecvLimiterStorage.GetGuaranteedThroughput()/1024/1024)),
 		zap.Int64("BytesSent", run.mainSendBytesCounter.Get()),
@@ -40,7 +47,10 @@ func (run *Runner) logRuntimeInfo() {
 		zap.Int64("ConcurrentClients(send)", run.hostSendLimiterStorage.GetNHosts()),
 		zap.Int64("ConcurrentClients(recv)", run.hostRecvLimiterStorage.GetNHosts()),
 		zap.Int64("NumConcurrentRequests", run.concurrentRequests.Get()),
-		zap.Int("LoggerQueueSize", run.getLoggerQueueSize()),
+		zap.Float64("FairnessIndex", fairnessIndex),
+		zap.Int("FairnessClients", fairnessClients),
+		zap.Int("LoggerQueueSize", run.output.QueueSize()),
+		zap.Int64("LoggerDroppedMessages", run.output.Dropped()),
 		zap.Int("NumGoroutines", numGoroutines),
 		zap.Int64("MainRecvLimiterTokens", int64(run.mainRecvLimiter.Tokens())),
 		zap.Int64("MainSendLimiterTokens", int64(run.mainSendLimiter.Tokens())),
@@ -54,7 +64,8 @@ func (run *Runner) logRuntimeInfo() {
 	)
 }
 
-func (run *Runner) logRuntimeInfoHandler(w http.ResponseWriter, r *http.Request) {
+// waitHealthLimiter throttles requests to the diagnostic endpoints per client host.
+func (run *Runner) waitHealthLimiter(r *http.Request) error {
 	remoteHost := utils.TryGettingHostFromRemoteAddr(r.RemoteAddr)
 	hostLimiter := run.hostHealthLimiterStorage.GetLimiterHandle(remoteHost)
 
@@ -66,9 +77,13 @@ func (run *Runner) logRuntimeInfoHandler(w http.ResponseWriter, r *http.Request)
 		}()
 	}()
 
-	err := hostLimiter.WaitN(context.Background(), 1)
-	if err != nil {
-		panic(err)
+	return hostLimiter.WaitN(r.Context(), 1)
+}
+
+func (run *Runner) logRuntimeInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if err := run.waitHealthLimiter(r); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
 	}
 
 	// Memory statistics
@@ -83,6 +98,12 @@ func (run *Runner) logRuntimeInfoHandler(w http.ResponseWriter, r *http.Request)
 
 	_, _ = fmt.Fprintf(w, "UploadSpeed: %.2f MB/s\n", float64(run.mainSendRateCounter.GetRate()/1024/1024))
 	_, _ = fmt.Fprintf(w, "DownloadSpeed: %.2f MB/s\n", float64(run.mainRecvRateCounter.GetRate()/1024/1024))
+	for _, rates := range run.mainSendRateCounter.GetRates() {
+		_, _ = fmt.Fprintf(w, "UploadSpeed(%s): %.2f MB/s (EWMA %.2f MB/s)\n", horizonName(rates.Horizon), float64(rates.Window/1024/1024), float64(rates.EWMA/1024/1024))
+	}
+	for _, rates := range run.mainRecvRateCounter.GetRates() {
+		_, _ = fmt.Fprintf(w, "DownloadSpeed(%s): %.2f MB/s (EWMA %.2f MB/s)\n", horizonName(rates.Horizon), float64(rates.Window/1024/1024), float64(rates.EWMA/1024/1024))
+	}
 	_, _ = fmt.Fprintf(w, "GuaranteedThroughput(send): %.2f MB/s\n", float64(run.hostSendLimiterStorage.GetGuaranteedThroughput()/1024/1024))
 	_, _ = fmt.Fprintf(w, "GuaranteedThroughput(recv): %.2f MB/s\n", float64(run.hostRecvLimiterStorage.GetGuaranteedThroughput()/1024/1024))
 	_, _ = fmt.Fprintf(w, "BytesSent: %d\n", run.mainSendBytesCounter.Get())
@@ -90,7 +111,8 @@ func (run *Runner) logRuntimeInfoHandler(w http.ResponseWriter, r *http.Request)
 	_, _ = fmt.Fprintf(w, "ConcurrentClients(send): %d\n", run.hostSendLimiterStorage.GetNHosts())
 	_, _ = fmt.Fprintf(w, "ConcurrentClients(recv): %d\n", run.hostRecvLimiterStorage.GetNHosts())
 	_, _ = fmt.Fprintf(w, "NumConcurrentRequests: %d\n", run.concurrentRequests.Get())
-	_, _ = fmt.Fprintf(w, "LoggerQueueSize: %d\n", run.getLoggerQueueSize())
+	_, _ = fmt.Fprintf(w, "LoggerQueueSize: %d\n", run.output.QueueSize())
+	_, _ = fmt.Fprintf(w, "LoggerDroppedMessages: %d\n", run.output.Dropped())
 	_, _ = fmt.Fprintf(w, "NumGoroutines: %d\n", numGoroutines)
 	_, _ = fmt.Fprintf(w, "MainRecvLimiterTokens: %d\n", int64(run.mainRecvLimiter.Tokens()))
 	_, _ = fmt.Fprintf(w, "MainSendLimiterTokens: %d\n", int64(run.mainSendLimiter.Tokens()))
@@ -102,3 +124,25 @@ func (run *Runner) logRuntimeInfoHandler(w http.ResponseWriter, r *http.Request)
 	_, _ = fmt.Fprintf(w, "SysMemory: %d bytes\n", memStats.Sys)
 	_, _ = fmt.Fprintf(w, "HeapObjects: %d\n", memStats.HeapObjects)
 }
+
+type rateFields []rate_counter.Rates
+
+func (f rateFields) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, rates := range f {
+		enc.AddFloat64(horizonName(rates.Horizon), float64(rates.Window/1024/1024))
+		enc.AddFloat64("ewma_"+horizonName(rates.Horizon), float64(rates.EWMA/1024/1024))
+	}
+	return nil
+}
+
+// horizonName formats d without redundant zero units: 1m instead of 1m0s.
+func horizonName(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/galqiwi/fair-p/internal/testtool"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -31,14 +39,14 @@ func TestMain(m *testing.M) {
 	}())
 }
 
-func startProxy(t *testing.T) (port string, stop func()) {
+func startProxy(t *testing.T, extraArgs ...string) (port string, stop func()) {
 	binary, err := binCache.GetBinary(importPath)
 	require.NoError(t, err)
 
 	port, err = testtool.GetFreePort()
 	require.NoError(t, err, "unable to get free port")
 
-	cmd := exec.Command(binary, "--port", port, "--max_throughput", "1")
+	cmd := exec.Command(binary, append([]string{"--port", port, "--max_throughput", "1"}, extraArgs...)...)
 	cmd.Stdout = nil
 	cmd.Stderr = os.Stderr
 
@@ -97,7 +105,7 @@ func testProxyWithEchoService(t *testing.T, port string, echoService *httptest.S
 	require.Equal(t, msg, string(body))
 }
 
-func testProxy(t *testing.T, testTLS bool, nRequests int) {
+func testProxy(t *testing.T, testTLS bool, nRequests int, extraArgs ...string) {
 	echoHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = io.Copy(w, r.Body)
 		defer func() { _ = r.Body.Close() }()
@@ -112,7 +120,7 @@ func testProxy(t *testing.T, testTLS bool, nRequests int) {
 	}
 	defer echoService.Close()
 
-	port, cleanup := startProxy(t)
+	port, cleanup := startProxy(t, extraArgs...)
 	defer cleanup()
 
 	var wg sync.WaitGroup
@@ -140,3 +148,572 @@ func TestProxy(t *testing.T) {
 		testProxy(t, true, 16)
 	})
 }
+
+func TestPacing(t *testing.T) {
+	testProxy(t, false, 4, "--client_pacing_ms", "20", "--main_pacing_ms", "20")
+	testProxy(t, true, 4, "--client_pacing_ms", "20", "--main_pacing_ms", "20")
+}
+
+func TestAccessLog(t *testing.T) {
+	binary, err := binCache.GetBinary(importPath)
+	require.NoError(t, err)
+
+	echoService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer echoService.Close()
+
+	port, err := testtool.GetFreePort()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	accessLogPath := filepath.Join(dir, "access.log")
+	cmd := exec.Command(binary, "--port", port, "--max_throughput", "1",
+		"--access_log_format", "json", "--access_log_path", accessLogPath)
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+	}()
+	require.NoError(t, testtool.WaitForPort(t, time.Second*5, port))
+
+	testProxyWithEchoService(t, port, echoService)
+
+	// The record is written after the response is sent, give the handler time to finish.
+	time.Sleep(200 * time.Millisecond)
+
+	// Moved away by logrotate, the next record goes to a new file.
+	rotatedPath := filepath.Join(dir, "access.log.1")
+	require.NoError(t, os.Rename(accessLogPath, rotatedPath))
+	require.NoError(t, cmd.Process.Signal(syscall.SIGHUP))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(accessLogPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	testProxyWithEchoService(t, port, echoService)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait())
+
+	for _, path := range []string{rotatedPath, accessLogPath} {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.Len(t, lines, 1)
+
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+
+		require.Equal(t, "access", record["msg"])
+		require.Equal(t, "POST", record["method"])
+		require.Equal(t, float64(http.StatusOK), record["status"])
+		require.Equal(t, float64(len("hello world")), record["bytes_received"])
+		require.NotEmpty(t, record["trace_id"])
+		require.Contains(t, record, "duration")
+		require.Contains(t, record, "throttle_time")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spanNames []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						Name string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spanNames = append(spanNames, span.Name)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	requestIds := make(chan string, 1)
+	echoService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIds <- r.Header.Get("X-Request-Id")
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer echoService.Close()
+
+	port, cleanup := startProxy(t, "--otlp_endpoint", collector.URL+"/v1/traces", "--otlp_export_interval_sec", "0.05")
+	defer cleanup()
+
+	testProxyWithEchoService(t, port, echoService)
+	// The logged trace_id, with dashes.
+	requestId := <-requestIds
+	require.Len(t, requestId, 36)
+	_, err := uuid.Parse(requestId)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	echoHost := strings.TrimPrefix(echoService.URL, "http://")
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoHost, echoHost)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, resp.Header.Get("X-Request-Id"), 36)
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		names := strings.Join(spanNames, ",")
+		return strings.Count(names, "accept") == 2 &&
+			strings.Count(names, "dial") == 2 &&
+			strings.Contains(names, "response_copy") &&
+			strings.Contains(names, "tunnel")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestHealthAndMetrics(t *testing.T) {
+	port, adminURL, cleanup := startProxyWithAdmin(t)
+	defer cleanup()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%s/health", port))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Contains(t, string(body), "UploadSpeed(10s):")
+	require.Contains(t, string(body), "DownloadSpeed(5m):")
+
+	// The metrics are served only by the admin listener.
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%s/metrics", port))
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.NotEqual(t, http.StatusOK, resp.StatusCode)
+	require.NotContains(t, string(body), "fairp_")
+
+	resp, err = http.Get(adminURL + "/metrics")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Contains(t, string(body), `fairp_throughput_bytes_per_second{direction="recv",estimator="ewma",horizon="1m"}`)
+	require.Contains(t, string(body), `fairp_bytes_total{direction="send"}`)
+}
+
+func TestAdminDashboard(t *testing.T) {
+	_, adminURL, cleanup := startProxyWithAdmin(t,
+		"--runtime_log_interval_sec", "0.05",
+		"--history_path", filepath.Join(t.TempDir(), "history.jsonl"),
+	)
+	defer cleanup()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(adminURL + "/history")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		var samples []map[string]any
+		if json.NewDecoder(resp.Body).Decode(&samples) != nil {
+			return false
+		}
+		return len(samples) >= 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resp, err := http.Get(adminURL + "/dashboard")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Contains(t, string(body), "<canvas>")
+}
+
+func startProxyWithAdmin(t *testing.T, extraArgs ...string) (port string, adminURL string, stop func()) {
+	adminPort, err := testtool.GetFreePort()
+	require.NoError(t, err)
+
+	port, stop = startProxy(t, append([]string{"--admin_addr", "127.0.0.1:" + adminPort}, extraArgs...)...)
+	adminURL = fmt.Sprintf("http://127.0.0.1:%s", adminPort)
+
+	if err = testtool.WaitForPort(t, time.Second*5, adminPort); err != nil {
+		stop()
+	}
+	require.NoError(t, err)
+	return
+}
+
+func doAdminRequest(t *testing.T, method, url, body string) (int, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if method == http.MethodPost {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response.StatusCode, string(data)
+}
+
+func TestAdminLogControl(t *testing.T) {
+	_, adminURL, cleanup := startProxyWithAdmin(t, "--log_level", "warn")
+	defer cleanup()
+
+	status, body := doAdminRequest(t, http.MethodGet, adminURL+"/log/level", "")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"level": "warn"}`, body)
+
+	status, body = doAdminRequest(t, http.MethodPut, adminURL+"/log/level", `{"level": "debug"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"level": "debug"}`, body)
+
+	status, body = doAdminRequest(t, http.MethodPut, adminURL+"/log/sampling", `{"tick": "2s", "first": 0, "thereafter": 0}`)
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"tick": "2s", "first": 0, "thereafter": 0}`, body)
+
+	status, _ = doAdminRequest(t, http.MethodPut, adminURL+"/log/sampling", `{"tick": "0s", "first": 1, "thereafter": 0}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, body = doAdminRequest(t, http.MethodPost, adminURL+"/log/debug_client", "client=127.0.0.1&duration=1m")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "127.0.0.1")
+
+	status, body = doAdminRequest(t, http.MethodPost, adminURL+"/log/debug_client", "client=127.0.0.1&duration=0s")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{}`, body)
+}
+
+func TestGracefulShutdownFlushesLogs(t *testing.T) {
+	binary, err := binCache.GetBinary(importPath)
+	require.NoError(t, err)
+
+	port, err := testtool.GetFreePort()
+	require.NoError(t, err)
+
+	stdout := &bytes.Buffer{}
+	cmd := exec.Command(binary, "--port", port, "--max_throughput", "1")
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+
+	if err = testtool.WaitForPort(t, time.Second*5, port); err != nil {
+		_ = cmd.Process.Kill()
+	}
+	require.NoError(t, err)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait())
+
+	// The buffered writer flushes every 10 seconds, so these lines are only there if shutdown flushed them.
+	require.Contains(t, stdout.String(), "Runtime Info")
+	require.Contains(t, stdout.String(), "Shutting down")
+}
+
+func TestLogPath(t *testing.T) {
+	binary, err := binCache.GetBinary(importPath)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+	// Left by a previous run, archived on start.
+	require.NoError(t, os.WriteFile(logPath, []byte("previous run\n"), 0644))
+
+	for i := 0; i < 2; i++ {
+		port, err := testtool.GetFreePort()
+		require.NoError(t, err)
+
+		stdout := &bytes.Buffer{}
+		cmd := exec.Command(binary, "--port", port, "--max_throughput", "1", "--log_path", logPath, "--log_max_archives", "1")
+		cmd.Stdout = stdout
+		cmd.Stderr = os.Stderr
+		require.NoError(t, cmd.Start())
+
+		if err = testtool.WaitForPort(t, time.Second*5, port); err != nil {
+			_ = cmd.Process.Kill()
+		}
+		require.NoError(t, err)
+
+		require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+		require.NoError(t, cmd.Wait())
+
+		require.Empty(t, stdout.String())
+		data, err := os.ReadFile(logPath)
+		require.NoError(t, err)
+		require.Contains(t, string(data), "Runtime Info")
+		require.Contains(t, string(data), "Shutting down")
+	}
+
+	archives, err := filepath.Glob(filepath.Join(dir, "passer_*.log*.gz"))
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+}
+
+func TestAccounting(t *testing.T) {
+	binary, err := binCache.GetBinary(importPath)
+	require.NoError(t, err)
+
+	echoService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer echoService.Close()
+
+	accountingPath := filepath.Join(t.TempDir(), "accounting.csv")
+
+	port, err := testtool.GetFreePort()
+	require.NoError(t, err)
+
+	cmd := exec.Command(binary, "--port", port, "--max_throughput", "1", "--accounting_path", accountingPath, "--accounting_rollover", "none",
+		"--accounting_interval_min", "100000")
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+
+	if err = testtool.WaitForPort(t, time.Second*5, port); err != nil {
+		_ = cmd.Process.Kill()
+	}
+	require.NoError(t, err)
+
+	testProxyWithEchoService(t, port, echoService)
+
+	// The period is still running, so the record is written by the shutdown.
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait())
+
+	data, err := os.ReadFile(accountingPath)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(t, "period_start,period_end,client_host,bytes_sent,bytes_received,connections,throttle_time", lines[0])
+
+	fields := strings.Split(lines[1], ",")
+	require.Equal(t, "127.0.0.1", fields[2])
+	require.Equal(t, fmt.Sprint(len("hello world")), fields[4])
+	require.Equal(t, "1", fields[5])
+}
+
+// openTunnel connects to destination through the proxy with CONNECT.
+func openTunnel(t *testing.T, port string, destination string) net.Conn {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destination, destination)
+	require.NoError(t, err)
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	return conn
+}
+
+// startSink accepts connections and discards everything sent to them.
+func startSink(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startEcho accepts connections and sends everything back.
+func startEcho(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestPipelinedConnect(t *testing.T) {
+	port, cleanup := startProxy(t)
+	defer cleanup()
+
+	destination := startEcho(t)
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The payload arrives together with the request, before the proxy hijacks the connection.
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello", destination, destination)
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	echoed := make([]byte, len("hello"))
+	_, err = io.ReadFull(reader, echoed)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(echoed))
+}
+
+func requireClosedWithin(t *testing.T, conn net.Conn, timeout time.Duration) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(timeout)))
+	_, err := io.Copy(io.Discard, conn)
+	// A reset is fine too: the proxy closes the tunnel with unread data.
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		require.False(t, netErr.Timeout(), "tunnel was not closed in time")
+	}
+}
+
+func TestKillThrottledTunnel(t *testing.T) {
+	port, adminURL, cleanup := startProxyWithAdmin(t)
+	defer cleanup()
+
+	conn := openTunnel(t, port, startSink(t))
+	defer conn.Close()
+
+	// Far more than the burst at 1 MB/s, so the copy is throttled for seconds.
+	go func() {
+		_, _ = conn.Write(make([]byte, 16*1024*1024))
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	status, body := doAdminRequest(t, http.MethodGet, adminURL+"/connections", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `"method":"CONNECT"`)
+
+	status, body = doAdminRequest(t, http.MethodPost, adminURL+"/connections", "client=127.0.0.1")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"killed": 1}`, body)
+
+	requireClosedWithin(t, conn, 2*time.Second)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	port, cleanup := startProxy(t, "--idle_timeout_sec", "0.5")
+	defer cleanup()
+
+	conn := openTunnel(t, port, startSink(t))
+	defer conn.Close()
+
+	start := time.Now()
+	requireClosedWithin(t, conn, 5*time.Second)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestPriorityClasses(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "priorities.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(`{
+		"classes": [{"name": "interactive", "quantum": 64}, {"name": "bulk", "quantum": 16}],
+		"rules": [{"class": "bulk", "domains": ["127.0.0.1"]}]
+	}`), 0644))
+
+	port, adminURL, cleanup := startProxyWithAdmin(t, "--priority_classes", configPath)
+	defer cleanup()
+
+	conn := openTunnel(t, port, startSink(t))
+	defer conn.Close()
+	_, err := conn.Write(make([]byte, 64*1024))
+	require.NoError(t, err)
+
+	status, body := doAdminRequest(t, http.MethodGet, adminURL+"/connections", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `"class":"bulk"`)
+
+	status, body = doAdminRequest(t, http.MethodGet, adminURL+"/metrics", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `fairp_priority_queued_chunks{direction="send",class="interactive"}`)
+}
+
+func TestUsageWeights(t *testing.T) {
+	port, adminURL, cleanup := startProxyWithAdmin(t, "--usage_half_life_min", "10")
+	defer cleanup()
+
+	conn := openTunnel(t, port, startSink(t))
+	defer conn.Close()
+	_, err := conn.Write(make([]byte, 64*1024))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		status, body := doAdminRequest(t, http.MethodGet, adminURL+"/host_weights", "")
+		if status != http.StatusOK {
+			return false
+		}
+		var weights map[string][]map[string]any
+		if json.Unmarshal([]byte(body), &weights) != nil || len(weights["send"]) != 1 {
+			return false
+		}
+		send := weights["send"][0]
+		return send["host"] == "127.0.0.1" && send["usage"].(float64) > 0 && send["weight"].(float64) < 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestLimiterWaits(t *testing.T) {
+	port, adminURL, cleanup := startProxyWithAdmin(t)
+	defer cleanup()
+
+	conn := openTunnel(t, port, startSink(t))
+	defer conn.Close()
+
+	// Far more than the burst at 1 MB/s, so the client's share is exhausted.
+	go func() {
+		_, _ = conn.Write(make([]byte, 16*1024*1024))
+	}()
+
+	require.Eventually(t, func() bool {
+		status, body := doAdminRequest(t, http.MethodGet, adminURL+"/clients", "")
+		if status != http.StatusOK {
+			return false
+		}
+		var clients []map[string]any
+		if json.Unmarshal([]byte(body), &clients) != nil || len(clients) != 1 {
+			return false
+		}
+		return clients[0]["client_host"] == "127.0.0.1" && clients[0]["wait_host"].(float64)+clients[0]["wait_main"].(float64) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	status, body := doAdminRequest(t, http.MethodGet, adminURL+"/metrics", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `fairp_limiter_wait_seconds_bucket{level="host",le="+Inf"}`)
+	require.Contains(t, body, `fairp_limiter_wait_seconds_count{level="main"}`)
+}
+
+func TestJainIndex(t *testing.T) {
+	require.Equal(t, 1., jainIndex(nil))
+	require.InDelta(t, 1, jainIndex([]float64{5, 5, 5}), 1e-9)
+	require.InDelta(t, 0.25, jainIndex([]float64{1, 0, 0, 0}), 1e-9)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"github.com/galqiwi/fair-p/internal/rate_counter"
+	"github.com/galqiwi/fair-p/internal/ratelimit"
+	"io"
+	"net/http"
+	"runtime"
+)
+
+// metricsHandler serves runtime statistics in the Prometheus text exposition format.
+func (run *Runner) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := run.waitHealthLimiter(r); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetricHeader(w, "fairp_throughput_bytes_per_second", "gauge", "Proxied throughput estimated over several horizons.")
+	writeRateMetrics(w, "send", run.mainSendRateCounter.GetRates())
+	writeRateMetrics(w, "recv", run.mainRecvRateCounter.GetRates())
+
+	writeMetricHeader(w, "fairp_guaranteed_throughput_bytes_per_second", "gauge", "Throughput guaranteed to every client.")
+	_, _ = fmt.Fprintf(w, "fairp_guaranteed_throughput_bytes_per_second{direction=\"send\"} %g\n", float64(run.hostSendLimiterStorage.GetGuaranteedThroughput()))
+	_, _ = fmt.Fprintf(w, "fairp_guaranteed_throughput_bytes_per_second{direction=\"recv\"} %g\n", float64(run.hostRecvLimiterStorage.GetGuaranteedThroughput()))
+
+	writeMetricHeader(w, "fairp_bytes_total", "counter", "Bytes proxied since start.")
+	_, _ = fmt.Fprintf(w, "fairp_bytes_total{direction=\"send\"} %d\n", run.mainSendBytesCounter.Get())
+	_, _ = fmt.Fprintf(w, "fairp_bytes_total{direction=\"recv\"} %d\n", run.mainRecvBytesCounter.Get())
+
+	writeMetricHeader(w, "fairp_concurrent_clients", "gauge", "Clients with at least one active connection.")
+	_, _ = fmt.Fprintf(w, "fairp_concurrent_clients{direction=\"send\"} %d\n", run.hostSendLimiterStorage.GetNHosts())
+	_, _ = fmt.Fprintf(w, "fairp_concurrent_clients{direction=\"recv\"} %d\n", run.hostRecvLimiterStorage.GetNHosts())
+
+	if run.priorities != nil {
+		writeMetricHeader(w, "fairp_priority_queued_chunks", "gauge", "Chunks waiting for their priority class's turn.")
+		writeQueuedMetrics(w, "send", run.priorities, run.sendScheduler.Queued())
+		writeQueuedMetrics(w, "recv", run.priorities, run.recvScheduler.Queued())
+	}
+
+	writeMetricHeader(w, "fairp_limiter_wait_seconds", "histogram", "Time chunks waited for the rate limiters, by the level that delayed them.")
+	for _, level := range ratelimit.Levels {
+		writeWaitHistogram(w, level, run.waitHistogram)
+	}
+
+	writeMetricHeader(w, "fairp_concurrent_requests", "gauge", "Requests being proxied.")
+	_, _ = fmt.Fprintf(w, "fairp_concurrent_requests %d\n", run.concurrentRequests.Get())
+
+	writeMetricHeader(w, "fairp_logger_queue_size", "gauge", "Messages waiting in the async log writer.")
+	_, _ = fmt.Fprintf(w, "fairp_logger_queue_size %d\n", run.output.QueueSize())
+
+	writeMetricHeader(w, "fairp_logger_dropped_messages_total", "counter", "Log messages dropped by the overflow policy.")
+	_, _ = fmt.Fprintf(w, "fairp_logger_dropped_messages_total %d\n", run.output.Dropped())
+
+	writeMetricHeader(w, "fairp_goroutines", "gauge", "Number of goroutines.")
+	_, _ = fmt.Fprintf(w, "fairp_goroutines %d\n", runtime.NumGoroutine())
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeRateMetrics(w io.Writer, direction string, rates []rate_counter.Rates) {
+	for _, r := range rates {
+		_, _ = fmt.Fprintf(w, "fairp_throughput_bytes_per_second{direction=%q,estimator=\"window\",horizon=%q} %g\n", direction, horizonName(r.Horizon), float64(r.Window))
+		_, _ = fmt.Fprintf(w, "fairp_throughput_bytes_per_second{direction=%q,estimator=\"ewma\",horizon=%q} %g\n", direction, horizonName(r.Horizon), float64(r.EWMA))
+	}
+}
+
+func writeQueuedMetrics(w io.Writer, direction string, priorities *ratelimit.PriorityConfig, queued map[string]int) {
+	for _, class := range priorities.Classes {
+		_, _ = fmt.Fprintf(w, "fairp_priority_queued_chunks{direction=%q,class=%q} %d\n", direction, class.Name, queued[class.Name])
+	}
+}
+
+func writeWaitHistogram(w io.Writer, level ratelimit.Level, histogram *ratelimit.WaitHistogram) {
+	counts, sum := histogram.Snapshot(level)
+	cumulative := int64(0)
+	for i, bound := range ratelimit.WaitHistogramBounds {
+		cumulative += counts[i]
+		_, _ = fmt.Fprintf(w, "fairp_limiter_wait_seconds_bucket{level=%q,le=\"%g\"} %d\n", level.String(), bound.Seconds(), cumulative)
+	}
+	cumulative += counts[len(counts)-1]
+	_, _ = fmt.Fprintf(w, "fairp_limiter_wait_seconds_bucket{level=%q,le=\"+Inf\"} %d\n", level.String(), cumulative)
+	_, _ = fmt.Fprintf(w, "fairp_limiter_wait_seconds_sum{level=%q} %g\n", level.String(), sum.Seconds())
+	_, _ = fmt.Fprintf(w, "fairp_limiter_wait_seconds_count{level=%q} %d\n", level.String(), cumulative)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// priorityHeader lets a client opt in to background priority: "X-Fairp-Priority: background".
+// It is not forwarded.
+const priorityHeader = "X-Fairp-Priority"
+
+// priorityClass returns the priority class of r, it is empty without priority classes.
+func (run *Runner) priorityClass(r *http.Request) string {
+	if run.priorities == nil {
+		return ""
+	}
+	host, port := destinationHostPort(r)
+	background := strings.EqualFold(r.Header.Get(priorityHeader), "background")
+	return run.priorities.Classify(host, port, background)
+}
+
+func destinationHostPort(r *http.Request) (string, int) {
+	if host, port, err := net.SplitHostPort(r.Host); err == nil {
+		if n, err := strconv.Atoi(port); err == nil {
+			return host, n
+		}
+		return host, 0
+	}
+	if r.URL.Scheme == "https" {
+		return r.Host, 443
+	}
+	return r.Host, 80
+}
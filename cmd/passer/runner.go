@@ -1,107 +1,420 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"github.com/galqiwi/fair-p/internal/accounting"
+	"github.com/galqiwi/fair-p/internal/alerting"
+	"github.com/galqiwi/fair-p/internal/history"
 	"github.com/galqiwi/fair-p/internal/hostlimiters"
 	"github.com/galqiwi/fair-p/internal/logutils"
 	"github.com/galqiwi/fair-p/internal/rate_counter"
 	"github.com/galqiwi/fair-p/internal/ratelimit"
+	"github.com/galqiwi/fair-p/internal/rotate"
+	"github.com/galqiwi/fair-p/internal/tracing"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/galqiwi/fair-p/internal/utils"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/time/rate"
 )
 
+const shutdownTimeout = 5 * time.Second
+
+const logCloseTimeout = 5 * time.Second
+
+// minPacedBurst keeps paced chunks from getting smaller than a few packets.
+const minPacedBurst = 16 * 1024
+
 type Runner struct {
 	runtimeLogInterval time.Duration
 	port               int
+	adminAddr          string
 	noIPv4             bool
+	idleTimeout        time.Duration
+
+	// ctx is the parent of every request context, it is cancelled on shutdown.
+	ctx         context.Context
+	cancel      context.CancelCauseFunc
+	connections *connectionRegistry
+	clients     *clientRegistry
 
 	concurrentRequests       *utils.Counter
 	hostHealthLimiterStorage *hostlimiters.HostLimiterStorage
 	hostSendLimiterStorage   *hostlimiters.HostLimiterStorage
 	hostRecvLimiterStorage   *hostlimiters.HostLimiterStorage
 	logger                   *zap.Logger
+	logControl               *logutils.LogControl
+	accessLogger             logutils.AccessLogger
+	redactionPolicy          *logutils.RedactionPolicy
+	tracer                   *tracing.Tracer
+	history                  *history.Ring
+	alerts                   *alerting.Engine
+	accounting               *accounting.Meter
+	accountingExporter       *accounting.Exporter
 	mainSendLimiter          ratelimit.Limiter
 	sharedSendLimiter        ratelimit.Limiter
-	mainSendRateCounter      *rate_counter.RateCountingWriter
+	mainSendRateCounter      *rate_counter.MultiRateWriter
 	mainSendBytesCounter     *utils.Counter
 	mainRecvLimiter          ratelimit.Limiter
 	sharedRecvLimiter        ratelimit.Limiter
-	mainRecvRateCounter      *rate_counter.RateCountingWriter
+	mainRecvRateCounter      *rate_counter.MultiRateWriter
 	mainRecvBytesCounter     *utils.Counter
+	waitHistogram            *ratelimit.WaitHistogram
+
+	// sendTree and recvTree are nil unless a limiter tree is configured.
+	sendTree *hostlimiters.Tree
+	recvTree *hostlimiters.Tree
+	// priorities and the schedulers are nil unless priority classes are configured.
+	priorities    *ratelimit.PriorityConfig
+	sendScheduler *ratelimit.Scheduler
+	recvScheduler *ratelimit.Scheduler
 
-	getLoggerQueueSize func() int
+	output *logutils.Output
+	// syslog is nil unless the log is also sent to syslog.
+	syslog *logutils.SyslogOutput
+	// logFile is the rotated log file, nil when logging to stdout.
+	logFile *rotate.Writer
+	// accessLogFile and accessOutput are nil unless the access log has a file of its own.
+	accessLogFile *rotate.Writer
+	accessOutput  *logutils.Output
 }
 
 func NewRunner(a args) (*Runner, error) {
 	burstSize := 2 * 1024 * 1024
+	clientPacing := ratelimit.Pacing{Slice: a.clientPacing, MinBurst: minPacedBurst}
+	mainPacing := ratelimit.Pacing{Slice: a.mainPacing, MinBurst: minPacedBurst}
 	rateCounterDuration := time.Second
 
 	healthLimit := rate.Every(time.Second)
 	healthBurst := 3
 
-	logger, queueSizeGetter, err := logutils.NewLogger()
+	var logWS zapcore.WriteSyncer = os.Stdout
+	var logFile *rotate.Writer
+	if a.logRotate.Path != "" {
+		var err error
+		logFile, err = rotate.Open(a.logRotate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %s", err)
+		}
+		logWS = logFile
+	}
+
+	output := logutils.NewOutput(logWS, a.logQueueSize, a.logOverflowPolicy)
+
+	logControl, err := logutils.NewLogControl(a.logLevel, a.logSampling)
 	if err != nil {
 		return nil, err
 	}
-	return &Runner{
+
+	var syslog *logutils.SyslogOutput
+	if a.syslog.Network != "" {
+		syslog, err = logutils.NewSyslogOutput(a.syslog, a.logQueueSize, a.logOverflowPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var loggerWS zapcore.WriteSyncer = output
+	if a.syslogOnly {
+		loggerWS = nil
+	}
+
+	logger, err := logutils.NewLogger(loggerWS, syslog, a.logFormat, logControl)
+	if err != nil {
+		return nil, err
+	}
+
+	var accessWS zapcore.WriteSyncer = output
+	var accessLogFile *rotate.Writer
+	var accessOutput *logutils.Output
+	if a.accessLogPath != "" {
+		accessRotate := a.logRotate
+		accessRotate.Path = a.accessLogPath
+		accessLogFile, err = rotate.Open(accessRotate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log %q: %s", a.accessLogPath, err)
+		}
+		accessOutput = logutils.NewOutput(accessLogFile, a.logQueueSize, a.logOverflowPolicy)
+		accessWS = accessOutput
+	}
+
+	accessLogger, err := logutils.NewAccessLogger(accessWS, a.accessLogFormat)
+	if err != nil {
+		return nil, err
+	}
+	var tracer *tracing.Tracer
+	if a.otlpEndpoint != "" {
+		tracer = tracing.NewTracer(
+			tracing.NewOTLPExporter(a.otlpEndpoint, a.otlpServiceName),
+			512,
+			a.otlpExportInterval,
+			func(err error) {
+				logger.Info("Failed to export spans", zap.String("err", err.Error()))
+			},
+		)
+	}
+
+	historyCapacity := int(a.historyDuration / a.runtimeLogInterval)
+	if historyCapacity < 1 {
+		historyCapacity = 1
+	}
+	historyRing := history.NewRing(historyCapacity)
+	if a.historyPath != "" {
+		historyRing, err = history.OpenRing(historyCapacity, a.historyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	run := &Runner{
 		runtimeLogInterval: a.runtimeLogInterval,
 		port:               a.port,
+		adminAddr:          a.adminAddr,
 		noIPv4:             a.noIPv4,
+		idleTimeout:        a.idleTimeout,
+
+		ctx:         ctx,
+		cancel:      cancel,
+		connections: newConnectionRegistry(),
+		clients:     newClientRegistry(),
 
 		concurrentRequests:       utils.NewCounter(),
 		hostHealthLimiterStorage: hostlimiters.NewHostLimiterStorage(healthLimit, healthBurst),
-		hostSendLimiterStorage:   hostlimiters.NewHostLimiterStorage(a.maxThroughput/2, burstSize),
-		hostRecvLimiterStorage:   hostlimiters.NewHostLimiterStorage(a.maxThroughput/2, burstSize),
+		hostSendLimiterStorage:   hostlimiters.NewWeightedHostLimiterStorage(a.maxThroughput/2, burstSize, a.usageHalfLife),
+		hostRecvLimiterStorage:   hostlimiters.NewWeightedHostLimiterStorage(a.maxThroughput/2, burstSize, a.usageHalfLife),
 		logger:                   logger,
-		mainSendLimiter:          rate.NewLimiter(a.maxThroughput, burstSize),
-		sharedSendLimiter:        rate.NewLimiter(a.maxThroughput/2, burstSize),
-		mainSendRateCounter:      rate_counter.NewRateCountingWriter(rateCounterDuration),
+		logControl:               logControl,
+		accessLogger:             accessLogger,
+		redactionPolicy:          logutils.NewRedactionPolicy(a.redaction),
+		tracer:                   tracer,
+		history:                  historyRing,
+		mainSendLimiter:          ratelimit.NewPacedBucket(a.maxThroughput, burstSize, mainPacing),
+		sharedSendLimiter:        ratelimit.NewPacedBucket(a.maxThroughput/2, burstSize, mainPacing),
+		mainSendRateCounter:      rate_counter.NewMultiRateWriter(rateCounterDuration, rate_counter.DefaultHorizons),
 		mainSendBytesCounter:     utils.NewCounter(),
-		mainRecvLimiter:          rate.NewLimiter(a.maxThroughput, burstSize),
-		sharedRecvLimiter:        rate.NewLimiter(a.maxThroughput/2, burstSize),
-		mainRecvRateCounter:      rate_counter.NewRateCountingWriter(rateCounterDuration),
+		mainRecvLimiter:          ratelimit.NewPacedBucket(a.maxThroughput, burstSize, mainPacing),
+		sharedRecvLimiter:        ratelimit.NewPacedBucket(a.maxThroughput/2, burstSize, mainPacing),
+		mainRecvRateCounter:      rate_counter.NewMultiRateWriter(rateCounterDuration, rate_counter.DefaultHorizons),
 		mainRecvBytesCounter:     utils.NewCounter(),
+		waitHistogram:            &ratelimit.WaitHistogram{},
+
+		output:        output,
+		syslog:        syslog,
+		logFile:       logFile,
+		accessLogFile: accessLogFile,
+		accessOutput:  accessOutput,
+	}
+
+	run.hostSendLimiterStorage.SetPacing(clientPacing)
+	run.hostRecvLimiterStorage.SetPacing(clientPacing)
+
+	if a.accounting.Path != "" {
+		run.accounting = accounting.NewMeter()
+		run.accountingExporter = accounting.NewExporter(run.accounting, a.accounting, func(err error) {
+			run.logger.Info("Accounting error", zap.String("err", err.Error()))
+		})
+	}
+
+	if a.limiterTreePath != "" {
+		treeConfig, err := hostlimiters.LoadTreeConfig(a.limiterTreePath)
+		if err != nil {
+			return nil, err
+		}
+		run.sendTree = hostlimiters.NewTree(treeConfig, burstSize, clientPacing)
+		run.recvTree = hostlimiters.NewTree(treeConfig, burstSize, clientPacing)
+	}
 
-		getLoggerQueueSize: queueSizeGetter,
-	}, nil
+	if a.priorityPath != "" {
+		priorities, err := ratelimit.LoadPriorityConfig(a.priorityPath)
+		if err != nil {
+			return nil, err
+		}
+		run.priorities = &priorities
+		run.sendScheduler = ratelimit.NewScheduler(run.mainSendLimiter, priorities.SchedulerClasses())
+		run.recvScheduler = ratelimit.NewScheduler(run.mainRecvLimiter, priorities.SchedulerClasses())
+	}
+
+	if a.alertRulesPath != "" {
+		run.alerts, err = run.newAlertEngine(a.alertRulesPath, a.alertWebhook)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return run, nil
 }
 
 func (run *Runner) Run() error {
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%v", run.port),
 		Handler: http.HandlerFunc(run.mainHandler),
+		BaseContext: func(net.Listener) context.Context {
+			return run.ctx
+		},
 		// Disable HTTP/2.
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
 	go run.runRuntimeLogLoop()
 
-	return server.ListenAndServe()
+	if run.alerts != nil {
+		go run.alerts.Run(alertEvaluationInterval)
+	}
+
+	if run.accountingExporter != nil {
+		go run.accountingExporter.Run()
+	}
+
+	servers := []*http.Server{&server}
+	if run.adminAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:    run.adminAddr,
+			Handler: run.newAdminHandler(),
+		})
+	}
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func() {
+			errs <- fmt.Errorf("listener %s: %w", s.Addr, s.ListenAndServe())
+		}()
+	}
+
+	// SIGHUP is sent on log rotation, by logrotate or by rotator forwarding it, and must not stop the proxy.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	var err error
+wait:
+	for {
+		select {
+		case err = <-errs:
+			break wait
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				run.reopenLogs()
+				continue
+			}
+			run.logger.Info("Shutting down", zap.String("signal", sig.String()))
+			break wait
+		}
+	}
+
+	run.shutdown(servers)
+	return err
+}
+
+// reopenLogs reopens the log files, if any, after they were moved away by an external rotation.
+// What is queued is written to the old files first.
+func (run *Runner) reopenLogs() {
+	files := []struct {
+		file   *rotate.Writer
+		output *logutils.Output
+	}{
+		{run.logFile, run.output},
+		{run.accessLogFile, run.accessOutput},
+	}
+	reopened := false
+	for _, f := range files {
+		if f.file == nil {
+			continue
+		}
+		reopened = true
+		_ = f.output.Sync()
+		if err := f.file.Reopen(); err != nil {
+			run.logger.Error("Failed to reopen log file", zap.String("path", f.file.Path()), zap.String("err", err.Error()))
+			continue
+		}
+		run.logger.Info("Reopened log file", zap.String("path", f.file.Path()))
+	}
+	if !reopened {
+		run.logger.Info("Ignoring SIGHUP, not logging to a file")
+	}
+}
+
+// shutdown interrupts the proxied connections, stops the listeners and flushes everything
+// that is buffered: spans, alerts, history, accounting and logs.
+func (run *Runner) shutdown(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	run.cancel(errShutdown)
+	for _, s := range servers {
+		_ = s.Shutdown(ctx)
+	}
+	// Tunnels are hijacked, so the servers do not wait for them.
+	run.connections.wait(ctx)
+
+	_ = run.tracer.Shutdown(ctx)
+	if run.alerts != nil {
+		if err := run.alerts.Close(ctx); err != nil {
+			run.logger.Info("Failed to send alerts", zap.String("err", err.Error()))
+		}
+	}
+	_ = run.history.Close()
+	if err := run.accountingExporter.Close(); err != nil {
+		run.logger.Info("Failed to close accounting file", zap.String("err", err.Error()))
+	}
+
+	// A stalled log destination must not hold up the exit, the logs get a deadline of their own.
+	logCtx, logCancel := context.WithTimeout(context.Background(), logCloseTimeout)
+	defer logCancel()
+	dropped := run.output.Dropped()
+	if err := run.output.CloseContext(logCtx); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s, %d messages dropped\n", err, run.output.Dropped()-dropped)
+	}
+	if run.syslog != nil {
+		_ = run.syslog.CloseContext(logCtx)
+	}
+	if run.accessOutput != nil {
+		dropped := run.accessOutput.Dropped()
+		if err := run.accessOutput.CloseContext(logCtx); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "access log: %s, %d records dropped\n", err, run.accessOutput.Dropped()-dropped)
+		}
+		_ = run.accessLogFile.Close()
+	}
+	if run.logFile != nil {
+		_ = run.logFile.Close()
+	}
 }
 
 func (run *Runner) mainHandler(w http.ResponseWriter, r *http.Request) {
 	traceId := uuid.New()
 
-	logger := run.logger.With(zap.String("trace_id", traceId.String()))
+	logger := run.logger.With(
+		zap.String("trace_id", traceId.String()),
+		zap.String(logutils.ClientKeyField, utils.TryGettingHostFromRemoteAddr(r.RemoteAddr)),
+	)
 
-	logutils.LogHttpRequest(logger, r)
+	logutils.LogHttpRequest(logger, r, run.redactionPolicy)
 
 	if r.Method == http.MethodConnect {
-		run.handleTunneling(w, r, logger)
+		rec := run.newAccessRecord(r, traceId.String())
+		defer run.logAccess(rec)
+
+		span := run.startRequestSpan(r, traceId)
+		defer span.End()
+
+		run.handleTunneling(w, r, logger, rec, span)
 		return
 	}
 
 	if strings.HasPrefix(r.URL.String(), "/register") {
 		logger.Info(
 			fmt.Sprintf("Registered host (%v)", r.RemoteAddr),
-			zap.String("url", r.URL.String()),
+			zap.String("url", run.redactionPolicy.URL(r.URL.String())),
 			zap.String("client", r.RemoteAddr),
 		)
 		_, _ = fmt.Fprintf(w, "Thank you for registering :)\n")
@@ -113,5 +426,11 @@ func (run *Runner) mainHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	run.handleHTTP(w, r, logger)
+	rec := run.newAccessRecord(r, traceId.String())
+	defer run.logAccess(rec)
+
+	span := run.startRequestSpan(r, traceId)
+	defer span.End()
+
+	run.handleHTTP(w, r, logger, rec, span)
 }
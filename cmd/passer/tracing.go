@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/galqiwi/fair-p/internal/tracing"
+	"github.com/galqiwi/fair-p/internal/utils"
+	"github.com/google/uuid"
+	"net/http"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// startRequestSpan starts the root ("accept") span of a proxied request.
+// The trace id is the request's trace_id, so spans and log records can be joined.
+func (run *Runner) startRequestSpan(r *http.Request, traceId uuid.UUID) *tracing.Span {
+	span := run.tracer.Start(tracing.TraceID(traceId), nil, "accept", tracing.SpanKindServer)
+	span.SetAttributes(
+		tracing.String("http.method", r.Method),
+		tracing.String("destination", r.Host),
+		tracing.String("client_host", utils.TryGettingHostFromRemoteAddr(r.RemoteAddr)),
+		tracing.String("trace_id", traceId.String()),
+	)
+	return span
+}
@@ -1,26 +1,163 @@
 package main
 
 import (
+	"compress/gzip"
 	"errors"
 	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
 )
 
 type args struct {
 	logPath string
-	maxSize int64
+	rotate  rotate.Config
+
+	maxLineSize    int
+	oversizedLines oversizedPolicy
+
+	exec              bool
+	command           []string
+	stderrLogPath     string
+	restartBackoff    time.Duration
+	maxRestartBackoff time.Duration
+
+	listen         string
+	perSourceFiles bool
+	stdinName      string
 }
 
 func getArgs() (args, error) {
 	logPath := flag.String("log_path", "", "log file name")
-	maxSize := flag.Int64("max_size", 100, "max log file size in MB")
+	maxSize := flag.Int64("max_size", 100, "max log file size in MB, 0 for unlimited")
+	interval := flag.String("rotate_interval", "none", "additionally rotate at the start of every period: none, hourly or daily")
+	rotateUTC := flag.Bool("rotate_utc", false, "align time-based rotation to UTC instead of the local time zone")
+	maxArchives := flag.Int("max_archives", 0, "max number of .gz archives to keep, 0 for unlimited")
+	maxAgeHours := flag.Int("max_age_hours", 0, "delete archives older than this, 0 for unlimited")
+	maxTotalSize := flag.Int64("max_total_size", 0, "max total size of .gz archives in MB, 0 for unlimited")
+	syncIntervalMs := flag.Int("sync_interval_ms", 0, "fsync the log file at most every N ms instead of after every line")
+	syncBytes := flag.Int64("sync_bytes", 0, "fsync the log file after every N bytes instead of after every line")
+	gzipLevel := flag.Int("gzip_level", gzip.DefaultCompression, "gzip compression level of archives, from 1 (fastest) to 9 (best)")
+	maxLineSize := flag.Int("max_line_size", 10*1024*1024, "max line length in bytes")
+	oversizedLines := flag.String("oversized_lines", "truncate", "what to do with lines over max_line_size: truncate (with a marker) or split")
+	execMode := flag.Bool("exec", false, "run the command given after the flags and log its stdout and stderr instead of reading stdin")
+	stderrLogPath := flag.String("stderr_log_path", "", "log file name for the child's stderr in exec mode, defaults to log_path with a .stderr suffix before the extension")
+	restartBackoffMs := flag.Int("restart_backoff_ms", 1000, "delay before restarting a failed child in exec mode, doubled after every failure")
+	maxRestartBackoffSec := flag.Int("max_restart_backoff_sec", 60, "max delay before restarting a failed child in exec mode")
+	listenAddr := flag.String("listen", "", "also accept writers on unix:/path/to/socket or tcp:host:port; the first line a writer sends is its name")
+	perSourceFiles := flag.Bool("per_source_files", false, "with --listen, write every source to log_path with its name inserted before the extension instead of tagging lines in log_path")
+	stdinName := flag.String("stdin_name", "stdin", "source name of stdin with --listen")
+	currentLink := flag.String("current_link", baseNamePlaceholder+".current", "symlink kept pointing to log_path, relative to the log directory; "+baseNamePlaceholder+" is the name of log_path without the extension (disabled if empty)")
+	statusPath := flag.String("status_path", baseNamePlaceholder+".status.json", "file with the current log file name, bytes written and archives created, relative to the log directory; "+baseNamePlaceholder+" is the name of log_path without the extension (disabled if empty)")
 	flag.Parse()
 
 	if *logPath == "" {
 		return args{}, errors.New("log_path should not be empty")
 	}
 
+	parsedInterval, err := rotate.ParseInterval(*interval)
+	if err != nil {
+		return args{}, err
+	}
+
+	if *maxSize < 0 {
+		return args{}, fmt.Errorf("max_size should not be negative")
+	}
+
+	if *maxArchives < 0 || *maxAgeHours < 0 || *maxTotalSize < 0 {
+		return args{}, fmt.Errorf("retention limits should not be negative")
+	}
+
+	if *syncIntervalMs < 0 || *syncBytes < 0 {
+		return args{}, fmt.Errorf("sync_interval_ms and sync_bytes should not be negative")
+	}
+
+	if *gzipLevel != gzip.DefaultCompression && (*gzipLevel < gzip.BestSpeed || *gzipLevel > gzip.BestCompression) {
+		return args{}, fmt.Errorf("invalid gzip_level %d", *gzipLevel)
+	}
+
+	parsedOversizedLines, err := parseOversizedPolicy(*oversizedLines)
+	if err != nil {
+		return args{}, err
+	}
+
+	if *maxLineSize <= 0 {
+		return args{}, fmt.Errorf("max_line_size should be positive")
+	}
+
+	if *execMode && flag.NArg() == 0 {
+		return args{}, errors.New("exec mode needs a command after the flags")
+	}
+	if !*execMode && flag.NArg() != 0 {
+		return args{}, fmt.Errorf("unexpected arguments %q, did you mean to pass --exec?", flag.Args())
+	}
+	if *restartBackoffMs <= 0 || *maxRestartBackoffSec <= 0 {
+		return args{}, errors.New("restart_backoff_ms and max_restart_backoff_sec should be positive")
+	}
+
+	if *listenAddr != "" && *execMode {
+		return args{}, errors.New("listen can not be combined with exec")
+	}
+	if !sourceNameRe.MatchString(*stdinName) {
+		return args{}, fmt.Errorf("invalid stdin_name %q", *stdinName)
+	}
+
+	if *stderrLogPath == "" {
+		ext := filepath.Ext(*logPath)
+		*stderrLogPath = (*logPath)[:len(*logPath)-len(ext)] + ".stderr" + ext
+	}
+	if *execMode && *stderrLogPath == *logPath {
+		return args{}, errors.New("stderr_log_path should differ from log_path")
+	}
+
 	return args{
 		logPath: *logPath,
-		maxSize: *maxSize,
+		rotate: rotate.Config{
+			Path:     *logPath,
+			MaxSize:  *maxSize * 1024 * 1024,
+			Interval: parsedInterval,
+			UTC:      *rotateUTC,
+			Retention: rotate.RetentionPolicy{
+				MaxArchives:  *maxArchives,
+				MaxAge:       time.Duration(*maxAgeHours) * time.Hour,
+				MaxTotalSize: *maxTotalSize * 1024 * 1024,
+			},
+			Sync: rotate.SyncPolicy{
+				Interval: time.Duration(*syncIntervalMs) * time.Millisecond,
+				Bytes:    *syncBytes,
+			},
+			GzipLevel:   *gzipLevel,
+			CurrentLink: inLogDir(*logPath, *currentLink),
+			StatusPath:  inLogDir(*logPath, *statusPath),
+		},
+		maxLineSize:    *maxLineSize,
+		oversizedLines: parsedOversizedLines,
+
+		exec:              *execMode,
+		command:           flag.Args(),
+		stderrLogPath:     *stderrLogPath,
+		restartBackoff:    time.Duration(*restartBackoffMs) * time.Millisecond,
+		maxRestartBackoff: time.Duration(*maxRestartBackoffSec) * time.Second,
+
+		listen:         *listenAddr,
+		perSourceFiles: *perSourceFiles,
+		stdinName:      *stdinName,
 	}, nil
 }
+
+// baseNamePlaceholder is replaced with the log file name without the extension, so that rotators of
+// different logs in one directory do not share a symlink or a status file.
+const baseNamePlaceholder = "{base}"
+
+// inLogDir expands baseNamePlaceholder in path and resolves it against the directory of logPath if relative.
+func inLogDir(logPath string, path string) string {
+	base := filepath.Base(logPath)
+	path = strings.ReplaceAll(path, baseNamePlaceholder, base[:len(base)-len(filepath.Ext(base))])
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(logPath), path)
+}
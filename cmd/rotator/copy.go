@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+)
+
+// copyLines writes every line of input to w until input is exhausted. Lines are prefixed with tag
+// unless it is empty.
+func copyLines(w *rotate.Writer, input io.Reader, tag string, args args) error {
+	lines := newLineReader(input, args.maxLineSize, args.oversizedLines)
+	defer func() {
+		stats := lines.Stats()
+		log.Printf("%s: input %sfinished: %d oversized lines, %d unterminated lines",
+			w.Path(), tagPrefix(tag), stats.oversized, stats.unterminated)
+	}()
+
+	var buf []byte
+	for {
+		line, err := lines.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read input: %s", err)
+		}
+
+		buf = append(buf[:0], tagPrefix(tag)...)
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func tagPrefix(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	return "[" + tag + "] "
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+)
+
+type oversizedPolicy string
+
+const (
+	oversizedTruncate oversizedPolicy = "truncate"
+	oversizedSplit    oversizedPolicy = "split"
+)
+
+func parseOversizedPolicy(s string) (oversizedPolicy, error) {
+	switch oversizedPolicy(s) {
+	case oversizedTruncate, oversizedSplit:
+		return oversizedPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown oversized line policy %q", s)
+}
+
+type lineStats struct {
+	oversized    int64
+	unterminated int64
+}
+
+// lineReader splits its input into lines like bufio.Scanner with ScanLines, but never fails on long
+// lines: lines longer than maxLen are either truncated with a marker or split into several lines.
+type lineReader struct {
+	r      *bufio.Reader
+	maxLen int
+	policy oversizedPolicy
+
+	line []byte
+
+	// rest holds the part of a split line that is returned by the next ReadLine.
+	rest    []byte
+	restErr error
+	// splitting is set while the parts of a split line are being returned.
+	splitting bool
+
+	stats lineStats
+}
+
+func newLineReader(r io.Reader, maxLen int, policy oversizedPolicy) *lineReader {
+	return &lineReader{
+		r:      bufio.NewReaderSize(r, 64*1024),
+		maxLen: maxLen,
+		policy: policy,
+	}
+}
+
+// ReadLine returns the next line without the line ending. The result is valid until the next call.
+// It returns io.EOF once the input is exhausted.
+func (l *lineReader) ReadLine() ([]byte, error) {
+	l.line = l.line[:0]
+	dropped := 0
+
+	for {
+		var chunk []byte
+		var err error
+		if l.rest != nil {
+			chunk, err = l.rest, l.restErr
+			l.rest, l.restErr = nil, nil
+		} else {
+			chunk, err = l.r.ReadSlice('\n')
+		}
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return nil, err
+		}
+
+		terminated := err == nil
+		content := chunk
+		if terminated {
+			content = chunk[:len(chunk)-1]
+		}
+
+		space := l.maxLen - len(l.line)
+		if len(content) > space {
+			if !l.splitting {
+				l.splitting = true
+				l.stats.oversized++
+			}
+			l.line = append(l.line, content[:space]...)
+
+			if l.policy == oversizedSplit {
+				l.rest = append([]byte(nil), chunk[space:]...)
+				l.restErr = err
+				return l.line, nil
+			}
+			dropped += len(content) - space
+		} else {
+			l.line = append(l.line, content...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err == io.EOF {
+			if len(l.line) == 0 && dropped == 0 && !l.splitting {
+				return nil, io.EOF
+			}
+			l.stats.unterminated++
+			log.Printf("flushing unterminated line of %d bytes at end of input", len(l.line)+dropped)
+		}
+
+		if l.splitting {
+			log.Printf("line longer than %d bytes handled with policy %q (%d so far)", l.maxLen, l.policy, l.stats.oversized)
+			l.splitting = false
+		}
+		if dropped > 0 {
+			l.line = fmt.Appendf(l.line, " ...[truncated %d bytes]", dropped)
+		} else {
+			l.line = bytes.TrimSuffix(l.line, []byte{'\r'})
+		}
+		return l.line, nil
+	}
+}
+
+func (l *lineReader) Stats() lineStats {
+	return l.stats
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAllLines(t *testing.T, l *lineReader) []string {
+	var output []string
+	for {
+		line, err := l.ReadLine()
+		if err == io.EOF {
+			return output
+		}
+		require.NoError(t, err)
+		output = append(output, string(line))
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	l := newLineReader(strings.NewReader("a\r\nbb\n\nccc"), 10, oversizedTruncate)
+	require.Equal(t, []string{"a", "bb", "", "ccc"}, readAllLines(t, l))
+	require.Equal(t, lineStats{unterminated: 1}, l.Stats())
+
+	l = newLineReader(strings.NewReader(""), 10, oversizedTruncate)
+	require.Empty(t, readAllLines(t, l))
+	require.Equal(t, lineStats{}, l.Stats())
+}
+
+func TestLineReader_Truncate(t *testing.T) {
+	long := strings.Repeat("x", 200*1024)
+	l := newLineReader(strings.NewReader("short\n"+long+"\nafter\n"), 100, oversizedTruncate)
+
+	lines := readAllLines(t, l)
+	require.Len(t, lines, 3)
+	require.Equal(t, "short", lines[0])
+	require.Equal(t, strings.Repeat("x", 100)+" ...[truncated 204700 bytes]", lines[1])
+	require.Equal(t, "after", lines[2])
+	require.Equal(t, lineStats{oversized: 1}, l.Stats())
+}
+
+func TestLineReader_Split(t *testing.T) {
+	l := newLineReader(strings.NewReader("0123456789abcdefghij0123\nafter\n0123456789ab"), 10, oversizedSplit)
+
+	require.Equal(t, []string{"0123456789", "abcdefghij", "0123", "after", "0123456789", "ab"}, readAllLines(t, l))
+	require.Equal(t, lineStats{oversized: 2, unterminated: 1}, l.Stats())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+)
+
+var sourceNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// listen opens a "unix:/path/to/socket" or "tcp:host:port" listener.
+func listen(addr string) (net.Listener, error) {
+	network, address, ok := strings.Cut(addr, ":")
+	if !ok || (network != "unix" && network != "tcp") {
+		return nil, fmt.Errorf("listen address %q should look like unix:/path or tcp:host:port", addr)
+	}
+
+	if network == "unix" {
+		conn, err := net.Dial("unix", address)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", address)
+		}
+		// Left behind by a previous run.
+		err = os.Remove(address)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// sources maps source names to writers: either every source shares the file at args.logPath with its
+// lines tagged by name, or every source gets a file of its own.
+type sources struct {
+	mu      sync.Mutex
+	args    args
+	writers map[string]*rotate.Writer
+	closed  bool
+}
+
+func newSources(args args) *sources {
+	return &sources{args: args, writers: make(map[string]*rotate.Writer)}
+}
+
+// writerFor returns the writer for name and the tag to prefix its lines with.
+// The empty name stands for the main log file.
+func (s *sources) writerFor(name string) (*rotate.Writer, string, error) {
+	path, tag := s.args.logPath, name
+	if s.args.perSourceFiles {
+		tag = ""
+		if name != "" {
+			ext := filepath.Ext(s.args.logPath)
+			path = s.args.logPath[:len(s.args.logPath)-len(ext)] + "." + name + ext
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, "", rotate.ErrClosed
+	}
+	output, ok := s.writers[path]
+	if !ok {
+		var err error
+		output, err = openWriter(s.args.rotateConfig(path))
+		if err != nil {
+			return nil, "", err
+		}
+		s.writers[path] = output
+	}
+	return output, tag, nil
+}
+
+func (s *sources) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var output error
+	for _, w := range s.writers {
+		err := closeWriter(w)
+		if err != nil && output == nil {
+			output = err
+		}
+	}
+	return output
+}
+
+// readSourceName reads the first line of a connection, which names the writer.
+func readSourceName(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read source name: %s", err)
+	}
+	name := string(bytes.TrimRight(line, "\r\n"))
+	if !sourceNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid source name %q", name)
+	}
+	return name, nil
+}
+
+// runListen merges lines from stdin and from every connection to args.listen until a signal arrives on stop.
+func runListen(args args, stdin io.Reader, stop <-chan os.Signal) error {
+	ln, err := listen(args.listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on %s", args.listen)
+
+	srcs := newSources(args)
+
+	var (
+		connsMu sync.Mutex
+		conns   = make(map[net.Conn]struct{})
+		wg      sync.WaitGroup
+	)
+
+	handle := func(conn net.Conn) {
+		defer wg.Done()
+		defer func() {
+			connsMu.Lock()
+			delete(conns, conn)
+			connsMu.Unlock()
+			conn.Close()
+		}()
+
+		r := bufio.NewReaderSize(conn, 4096)
+		name, err := readSourceName(r)
+		if err != nil {
+			log.Printf("rejecting %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+
+		w, tag, err := srcs.writerFor(name)
+		if err != nil {
+			log.Printf("source %q: %s", name, err)
+			return
+		}
+		log.Printf("source %q connected", name)
+		err = copyLines(w, r, tag, args)
+		if err != nil {
+			log.Printf("source %q: %s", name, err)
+			return
+		}
+		log.Printf("source %q disconnected", name)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("accept failed: %s", err)
+				continue
+			}
+
+			connsMu.Lock()
+			conns[conn] = struct{}{}
+			connsMu.Unlock()
+
+			wg.Add(1)
+			go handle(conn)
+		}
+	}()
+
+	// Stdin can not be interrupted, so shutdown does not wait for it.
+	go func() {
+		name := args.stdinName
+		if args.perSourceFiles {
+			name = ""
+		}
+		w, tag, err := srcs.writerFor(name)
+		if err == nil {
+			err = copyLines(w, stdin, tag, args)
+		}
+		if err != nil {
+			log.Printf("stdin: %s", err)
+		}
+	}()
+
+	sig := <-stop
+	log.Printf("received %s, shutting down", sig)
+
+	ln.Close()
+	connsMu.Lock()
+	for conn := range conns {
+		conn.Close()
+	}
+	connsMu.Unlock()
+	wg.Wait()
+
+	return srcs.Close()
+}
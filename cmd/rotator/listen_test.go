@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+)
+
+func listenTestArgs(dir string) args {
+	return args{
+		logPath:        filepath.Join(dir, "passer.log"),
+		rotate:         rotate.Config{MaxSize: 100 * 1024 * 1024},
+		maxLineSize:    1024,
+		oversizedLines: oversizedTruncate,
+		listen:         "unix:" + filepath.Join(dir, "rotator.sock"),
+		stdinName:      "stdin",
+	}
+}
+
+// writeSource connects as name and writes every line in two halves, so that partial lines of
+// different sources overlap in time.
+func writeSource(t *testing.T, socket string, name string, lines int) {
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		var err error
+		conn, err = net.Dial("unix", socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer conn.Close()
+
+	_, err := fmt.Fprintf(conn, "%s\n", name)
+	require.NoError(t, err)
+	for i := 0; i < lines; i++ {
+		_, err = fmt.Fprintf(conn, "%s line", name)
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+		_, err = fmt.Fprintf(conn, " %d\n", i)
+		require.NoError(t, err)
+	}
+}
+
+func runListenWithSources(t *testing.T, a args, stdin string, names ...string) {
+	stop := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- runListen(a, strings.NewReader(stdin), stop)
+	}()
+
+	socket := strings.TrimPrefix(a.listen, "unix:")
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writeSource(t, socket, name, 20)
+		}()
+	}
+	wg.Wait()
+
+	// Rejected: invalid name.
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	_, _ = conn.Write([]byte("../evil\nline\n"))
+	conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	stop <- syscall.SIGTERM
+	require.NoError(t, <-done)
+}
+
+func readLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func expectedLines(prefix string, name string) []string {
+	var output []string
+	for i := 0; i < 20; i++ {
+		output = append(output, fmt.Sprintf("%s%s line %d", prefix, name, i))
+	}
+	sort.Strings(output)
+	return output
+}
+
+func TestRunListen_Shared(t *testing.T) {
+	dir := t.TempDir()
+	a := listenTestArgs(dir)
+
+	runListenWithSources(t, a, "from stdin\n", "a", "b")
+
+	expected := append(expectedLines("[a] ", "a"), expectedLines("[b] ", "b")...)
+	expected = append(expected, "[stdin] from stdin")
+	sort.Strings(expected)
+	require.Equal(t, expected, readLines(t, a.logPath))
+	require.NoFileExists(t, filepath.Join(dir, "rotator.sock"))
+}
+
+func TestRunListen_PerSource(t *testing.T) {
+	dir := t.TempDir()
+	a := listenTestArgs(dir)
+	a.perSourceFiles = true
+
+	runListenWithSources(t, a, "from stdin\n", "a", "b")
+
+	require.Equal(t, []string{"from stdin"}, readLines(t, a.logPath))
+	require.Equal(t, expectedLines("", "a"), readLines(t, filepath.Join(dir, "passer.a.log")))
+	require.Equal(t, expectedLines("", "b"), readLines(t, filepath.Join(dir, "passer.b.log")))
+}
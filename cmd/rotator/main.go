@@ -1,19 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"time"
-
-	"github.com/galqiwi/fair-p/internal/utils"
+	"os/signal"
+	"syscall"
 )
 
-var bufferSize = 10 * 1024 * 1024
-
 func main() {
 	err := Main()
 	if err != nil {
@@ -28,108 +22,35 @@ func Main() error {
 		return err
 	}
 
-	if utils.FileExists(args.logPath) {
-		err = archiveFile(args.logPath)
-		if err != nil {
-			return err
-		}
-	}
-
-	f, err := os.Create(args.logPath)
-	if err != nil {
-		return fmt.Errorf("failed to open %q: %s\n", args.logPath, err)
-	}
-
-	maxSizeBytes := args.maxSize * 1024 * 1024
-
-	remaining := maxSizeBytes
+	logSignals := make(chan os.Signal, 1)
+	signal.Notify(logSignals, syscall.SIGHUP, syscall.SIGUSR1)
+	go openWriters.handleSignals(logSignals)
 
-	s := bufio.NewScanner(os.Stdin)
-
-	buf := make([]byte, 0, bufferSize)
-	s.Buffer(buf, bufferSize)
-
-	for s.Scan() {
-		if int64(len(s.Text())) > remaining {
-			err := f.Sync()
-			if err != nil {
-				return fmt.Errorf("failed to sync: %s\n", err)
-			}
-
-			err = f.Close()
-			if err != nil {
-				return fmt.Errorf("error closing: %s\n", err)
-			}
-
-			err = archiveFile(args.logPath)
-			if err != nil {
-				return fmt.Errorf("error archiving: %s\n", err)
-			}
-
-			f, err = os.Create(args.logPath)
-			if err != nil {
-				return fmt.Errorf("error creating new file: %s\n", err)
-			}
-
-			remaining = maxSizeBytes
-		}
-		n, err := fmt.Fprintln(f, s.Text())
-		if err != nil {
-			return fmt.Errorf("failed to write: %s\n", err)
-		}
-		err = f.Sync()
-		if err != nil {
-			return fmt.Errorf("failed to sync: %s\n", err)
-		}
-		remaining -= int64(n)
+	if args.exec {
+		return runExec(args)
 	}
-	if s.Err() != nil {
-		return fmt.Errorf("scanner failed with %q\n", s.Err())
+	if args.listen != "" {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+		return runListen(args, os.Stdin, stop)
 	}
-
-	return nil
+	return runStream(args.logPath, os.Stdin, args)
 }
 
-func archiveFile(filename string) error {
-	stamp := time.Now().Format("2006-01-02_15:04:05")
-	ext := filepath.Ext(filename)
-	newNamePrefix := fmt.Sprintf("%s_%s%s", filename[:len(filename)-len(ext)], stamp, ext)
-
-	newName := newNamePrefix
-
-	for i := 1; utils.FileExists(newName); i++ {
-		newName = fmt.Sprintf("%s.%v", newNamePrefix, i)
-	}
-
-	err := os.Rename(filename, newName)
+// runStream copies lines from input into the rotated log file at logPath until input is exhausted.
+func runStream(logPath string, input io.Reader, args args) error {
+	w, err := openWriter(args.rotateConfig(logPath))
 	if err != nil {
-		return err
+		return fmt.Errorf("%s\n", err)
 	}
 
-	return compressFileInplace(newName)
-}
-
-func compressFileInplace(filename string) error {
-	sourceFile, err := os.Open(filename)
+	err = copyLines(w, input, "", args)
+	closeErr := closeWriter(w)
 	if err != nil {
-		return fmt.Errorf("could not open source file: %v", err)
+		return fmt.Errorf("%s\n", err)
 	}
-	defer sourceFile.Close()
-
-	destinationFilename := filename + ".gz"
-	destinationFile, err := os.Create(destinationFilename)
-	if err != nil {
-		return fmt.Errorf("could not create destination file: %v", err)
+	if closeErr != nil {
+		return fmt.Errorf("%s\n", closeErr)
 	}
-	defer destinationFile.Close()
-
-	gzipWriter := gzip.NewWriter(destinationFile)
-	defer gzipWriter.Close()
-
-	_, err = io.Copy(gzipWriter, sourceFile)
-	if err != nil {
-		return fmt.Errorf("could not copy data to gzip writer: %v", err)
-	}
-
-	return os.Remove(filename)
+	return nil
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// supervisor runs a child command and restarts it with exponential backoff when it fails.
+type supervisor struct {
+	command    []string
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	signals chan os.Signal
+	events  *log.Logger
+}
+
+// run supervises the command until it exits successfully, a SIGTERM or SIGINT arrives, or
+// streamErr reports that its output can not be written anymore.
+func (s *supervisor) run(stdout, stderr *os.File, streamErr <-chan error) error {
+	backoff := s.backoff
+	for {
+		start := time.Now()
+		err, stopping, failure := s.runOnce(stdout, stderr, streamErr)
+		if failure != nil {
+			return failure
+		}
+		if stopping {
+			return nil
+		}
+		if err == nil {
+			s.events.Printf("child exited successfully, not restarting")
+			return nil
+		}
+
+		if time.Since(start) > s.maxBackoff {
+			// The child was healthy for a while, start over with the shortest delay.
+			backoff = s.backoff
+		}
+
+		s.events.Printf("restarting child in %s", backoff)
+		stopping, failure = s.sleep(backoff, streamErr)
+		if failure != nil {
+			return failure
+		}
+		if stopping {
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// runOnce starts the child and waits for it to exit, forwarding signals to it.
+func (s *supervisor) runOnce(stdout, stderr *os.File, streamErr <-chan error) (err error, stopping bool, failure error) {
+	cmd := exec.Command(s.command[0], s.command[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// Logged before Start so that it precedes everything the child writes.
+	s.events.Printf("starting %q", strings.Join(s.command, " "))
+	start := time.Now()
+	err = cmd.Start()
+	if err != nil {
+		s.events.Printf("failed to start: %s", err)
+		return err, false, nil
+	}
+	pid := cmd.Process.Pid
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case err = <-done:
+			status := "exit status 0"
+			if err != nil {
+				status = err.Error()
+			}
+			s.events.Printf("child pid %d exited after %s: %s", pid, time.Since(start).Round(time.Millisecond), status)
+			return err, stopping, failure
+		case sig := <-s.signals:
+			s.events.Printf("forwarding %s to child pid %d", sig, pid)
+			_ = cmd.Process.Signal(sig)
+			if sig != syscall.SIGHUP {
+				stopping = true
+			}
+		case failure = <-streamErr:
+			s.events.Printf("stopping child pid %d: %s", pid, failure)
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+			stopping = true
+		}
+	}
+}
+
+func (s *supervisor) sleep(d time.Duration, streamErr <-chan error) (stopping bool, failure error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return false, nil
+		case sig := <-s.signals:
+			if sig == syscall.SIGHUP {
+				continue
+			}
+			s.events.Printf("received %s, not restarting child", sig)
+			return true, nil
+		case failure = <-streamErr:
+			return true, failure
+		}
+	}
+}
+
+// runExec runs args.command as a child and writes its stdout and stderr into two rotated logs.
+func runExec(args args) error {
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	streamErr := make(chan error, 2)
+	var wg sync.WaitGroup
+	for _, stream := range []struct {
+		path  string
+		input *os.File
+	}{
+		{args.logPath, stdoutR},
+		{args.stderrLogPath, stderrR},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.input.Close()
+			err := runStream(stream.path, stream.input, args)
+			if err != nil {
+				streamErr <- fmt.Errorf("%s: %s", stream.path, strings.TrimSpace(err.Error()))
+			}
+		}()
+	}
+
+	s := &supervisor{
+		command:    args.command,
+		backoff:    args.restartBackoff,
+		maxBackoff: args.maxRestartBackoff,
+		signals:    make(chan os.Signal, 1),
+		// Events go to the stdout log, after everything the child wrote there.
+		events: log.New(io.MultiWriter(os.Stderr, stdoutW), "rotator: ", log.LstdFlags),
+	}
+	signal.Notify(s.signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(s.signals)
+
+	failure := s.run(stdoutW, stderrW, streamErr)
+
+	stdoutW.Close()
+	stderrW.Close()
+	wg.Wait()
+
+	if failure != nil {
+		return failure
+	}
+	select {
+	case err := <-streamErr:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+	"github.com/galqiwi/fair-p/internal/testtool"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newTestSupervisor(command string, events *syncBuffer) *supervisor {
+	return &supervisor{
+		command:    []string{"sh", "-c", command},
+		backoff:    10 * time.Millisecond,
+		maxBackoff: 40 * time.Millisecond,
+		signals:    make(chan os.Signal, 1),
+		events:     log.New(events, "", 0),
+	}
+}
+
+func TestSupervisor_Restart(t *testing.T) {
+	var events syncBuffer
+	s := newTestSupervisor("exit 3", &events)
+
+	done := make(chan error)
+	go func() {
+		done <- s.run(os.Stdout, os.Stderr, nil)
+	}()
+
+	require.Eventually(t, func() bool {
+		return strings.Count(events.String(), "exit status 3") >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.signals <- syscall.SIGTERM
+	require.NoError(t, <-done)
+
+	output := events.String()
+	require.Contains(t, output, "restarting child in 10ms")
+	require.Contains(t, output, "restarting child in 20ms")
+	require.Contains(t, output, "restarting child in 40ms")
+	require.NotContains(t, output, "restarting child in 80ms")
+}
+
+func TestSupervisor_ForwardSignals(t *testing.T) {
+	var events syncBuffer
+	s := newTestSupervisor(`trap 'echo hup' HUP; trap 'echo term; exit 0' TERM; echo ready; while true; do sleep 0.01; done`, &events)
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	var output syncBuffer
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		_, _ = output.buf.ReadFrom(r)
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- s.run(w, os.Stderr, nil)
+	}()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(events.String(), "starting")
+	}, 5*time.Second, 10*time.Millisecond)
+	// Give the shell time to install its traps.
+	time.Sleep(200 * time.Millisecond)
+
+	s.signals <- syscall.SIGHUP
+	time.Sleep(100 * time.Millisecond)
+	s.signals <- syscall.SIGTERM
+	require.NoError(t, <-done)
+
+	w.Close()
+	<-copied
+	require.Equal(t, "ready\nhup\nterm\n", output.buf.String())
+	require.Contains(t, events.String(), "forwarding hangup")
+	require.Contains(t, events.String(), "exit status 0")
+	require.NotContains(t, events.String(), "restarting")
+}
+
+func TestRunExec(t *testing.T) {
+	dir := t.TempDir()
+	a := args{
+		logPath:           filepath.Join(dir, "passer.log"),
+		stderrLogPath:     filepath.Join(dir, "passer.stderr.log"),
+		rotate:            rotate.Config{MaxSize: 100 * 1024 * 1024},
+		maxLineSize:       1024,
+		oversizedLines:    oversizedTruncate,
+		exec:              true,
+		command:           []string{"sh", "-c", "echo out; echo err >&2"},
+		restartBackoff:    time.Millisecond,
+		maxRestartBackoff: time.Millisecond,
+	}
+	require.NoError(t, runExec(a))
+
+	stdout, err := os.ReadFile(a.logPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(stdout)), "\n")
+	require.Len(t, lines, 4)
+	require.Contains(t, lines[0], "rotator: ")
+	require.Contains(t, lines[0], "starting")
+	require.Equal(t, "out", lines[1])
+	require.Contains(t, lines[2], "exit status 0")
+
+	stderr, err := os.ReadFile(a.stderrLogPath)
+	require.NoError(t, err)
+	require.Equal(t, "err\n", string(stderr))
+}
+
+func TestExec_PasserSurvivesSIGHUP(t *testing.T) {
+	binCache, teardown := testtool.NewBinCache()
+	defer teardown()
+	rotator, err := binCache.GetBinary("github.com/galqiwi/fair-p/cmd/rotator")
+	require.NoError(t, err)
+	passer, err := binCache.GetBinary("github.com/galqiwi/fair-p/cmd/passer")
+	require.NoError(t, err)
+
+	port, err := testtool.GetFreePort()
+	require.NoError(t, err)
+
+	logPath := filepath.Join(t.TempDir(), "passer.log")
+	cmd := exec.Command(rotator, "--log_path", logPath, "--exec", "--", passer, "--port", port, "--max_throughput", "1")
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	defer func() {
+		_ = cmd.Process.Kill()
+	}()
+
+	require.NoError(t, testtool.WaitForPort(t, 5*time.Second, port))
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGHUP))
+	time.Sleep(500 * time.Millisecond)
+	require.NoError(t, testtool.WaitForPort(t, time.Second, port))
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("rotator did not stop")
+	}
+
+	output, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Contains(t, string(output), "forwarding hangup")
+	require.Equal(t, 1, strings.Count(string(output), "exited after"), string(output))
+	require.NotContains(t, string(output), "restarting child")
+}
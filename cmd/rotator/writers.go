@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+)
+
+// writerSet tracks the open log files so that signals can reach all of them.
+type writerSet struct {
+	mu      sync.Mutex
+	writers map[*rotate.Writer]struct{}
+}
+
+var openWriters = &writerSet{writers: make(map[*rotate.Writer]struct{})}
+
+// rotateConfig returns the configuration for the log file at path. Only the main log file keeps
+// the current symlink and the status file.
+func (a args) rotateConfig(path string) rotate.Config {
+	cfg := a.rotate
+	cfg.Path = path
+	if path != a.logPath {
+		cfg.CurrentLink = ""
+		cfg.StatusPath = ""
+	}
+	return cfg
+}
+
+func openWriter(cfg rotate.Config) (*rotate.Writer, error) {
+	w, err := rotate.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	openWriters.mu.Lock()
+	openWriters.writers[w] = struct{}{}
+	openWriters.mu.Unlock()
+	return w, nil
+}
+
+func closeWriter(w *rotate.Writer) error {
+	openWriters.mu.Lock()
+	delete(openWriters.writers, w)
+	openWriters.mu.Unlock()
+
+	return w.Close()
+}
+
+// handleSignals reopens every log file on SIGHUP, for logrotate, and rotates them on SIGUSR1.
+func (s *writerSet) handleSignals(signals <-chan os.Signal) {
+	for sig := range signals {
+		s.mu.Lock()
+		for w := range s.writers {
+			var err error
+			switch sig {
+			case syscall.SIGHUP:
+				err = w.Reopen()
+			case syscall.SIGUSR1:
+				err = w.Rotate()
+			}
+			if err != nil {
+				log.Printf("%s: failed to handle %s: %s", w.Path(), sig, err)
+				continue
+			}
+			log.Printf("%s: handled %s", w.Path(), sig)
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSet_HandleSignals(t *testing.T) {
+	dir := t.TempDir()
+	a := args{logPath: filepath.Join(dir, "passer.log")}
+	a.rotate.CurrentLink = filepath.Join(dir, "current")
+
+	w, err := openWriter(a.rotateConfig(a.logPath))
+	require.NoError(t, err)
+	other, err := openWriter(a.rotateConfig(filepath.Join(dir, "passer.other.log")))
+	require.NoError(t, err)
+
+	signals := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		openWriters.handleSignals(signals)
+	}()
+
+	signals <- syscall.SIGUSR1
+	require.NoError(t, os.Rename(a.logPath, a.logPath+".moved"))
+	signals <- syscall.SIGHUP
+	close(signals)
+	<-done
+
+	require.FileExists(t, a.logPath)
+	require.Equal(t, int64(1), w.Status().ArchivesCreated)
+	require.Equal(t, int64(1), other.Status().ArchivesCreated)
+
+	require.NoError(t, closeWriter(w))
+	require.NoError(t, closeWriter(other))
+	require.Empty(t, openWriters.writers)
+
+	// Only the main log file has the symlink.
+	target, err := os.Readlink(a.rotate.CurrentLink)
+	require.NoError(t, err)
+	require.Equal(t, "passer.log", target)
+}
+
+func TestInLogDir(t *testing.T) {
+	require.Equal(t, "/logs/passer-1.current", inLogDir("/logs/passer-1.log", "{base}.current"))
+	require.Equal(t, "/logs/status.json", inLogDir("/logs/passer-1.log", "status.json"))
+	require.Equal(t, "/run/passer-1.status.json", inLogDir("/logs/passer-1.log", "/run/{base}.status.json"))
+	require.Equal(t, "", inLogDir("/logs/passer-1.log", ""))
+}
@@ -0,0 +1,235 @@
+package accounting
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+)
+
+// maxPendingBatches bounds the batches kept in memory while the file can not be written.
+const maxPendingBatches = 1000
+
+type Config struct {
+	// Path is the file records are appended to. With a rollover, the start of the period
+	// is inserted before the extension: accounting_2024-05-01.csv.
+	Path   string
+	Format Format
+	// Interval is the length of a period. Periods are aligned to multiples of Interval.
+	Interval time.Duration
+	Rollover rotate.Interval
+}
+
+type batch struct {
+	start   time.Time
+	records []Record
+}
+
+// Exporter appends the usage collected by a meter to a file once per period.
+//
+// Every batch is written with a single write and fsynced. If that fails, the file is truncated
+// back to where the batch started and the batch is retried with the next one. On open, a line
+// torn by a crash is cut off. The meter is reset as soon as usage is collected, so after a crash
+// usage is at worst missing from the file, never repeated.
+type Exporter struct {
+	meter   *Meter
+	cfg     Config
+	onError func(error)
+
+	periodStart time.Time
+	pending     []batch
+
+	file     *os.File
+	fileName string
+	size     int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewExporter(meter *Meter, cfg Config, onError func(error)) *Exporter {
+	return &Exporter{
+		meter:       meter,
+		cfg:         cfg,
+		onError:     onError,
+		periodStart: now(),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// Run exports a batch at the end of every period until Close is called.
+func (e *Exporter) Run() {
+	defer close(e.done)
+
+	for {
+		next := e.periodStart.Truncate(e.cfg.Interval).Add(e.cfg.Interval)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			e.export()
+		case <-e.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Close stops Run, exports the usage of the current, partial period and closes the file.
+func (e *Exporter) Close() error {
+	if e == nil {
+		return nil
+	}
+
+	close(e.stop)
+	<-e.done
+
+	e.export()
+	if e.file == nil {
+		return nil
+	}
+	return e.file.Close()
+}
+
+func (e *Exporter) export() {
+	end := now()
+	records := newRecords(e.periodStart, end, e.meter.Collect())
+	if len(records) != 0 {
+		e.pending = append(e.pending, batch{start: e.periodStart, records: records})
+	}
+	e.periodStart = end
+
+	if len(e.pending) > maxPendingBatches {
+		dropped := len(e.pending) - maxPendingBatches
+		e.pending = e.pending[dropped:]
+		e.onError(fmt.Errorf("dropped %d accounting batches that could not be written", dropped))
+	}
+
+	for len(e.pending) != 0 {
+		err := e.write(e.pending[0])
+		if err != nil {
+			e.onError(err)
+			return
+		}
+		e.pending = e.pending[1:]
+	}
+}
+
+func (e *Exporter) write(b batch) error {
+	name := e.fileNameFor(b.start)
+	if e.file == nil || e.fileName != name {
+		err := e.openFile(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	err := encode(&buf, e.cfg.Format, b.records, e.size == 0)
+	if err != nil {
+		return fmt.Errorf("failed to encode accounting records: %s", err)
+	}
+
+	_, err = e.file.Write(buf.Bytes())
+	if err == nil {
+		err = e.file.Sync()
+	}
+	if err != nil {
+		return e.rollback(fmt.Errorf("failed to write accounting records to %q: %s", e.fileName, err))
+	}
+
+	e.size += int64(buf.Len())
+	return nil
+}
+
+// rollback cuts the file back to its size before a failed write, so that a retry does not
+// repeat records. If that fails too, the batch is dropped: its records may be partially written.
+func (e *Exporter) rollback(writeErr error) error {
+	err := e.file.Truncate(e.size)
+	if err == nil {
+		return writeErr
+	}
+
+	_ = e.file.Close()
+	e.file = nil
+	e.pending = e.pending[1:]
+	return fmt.Errorf("%s, dropping the batch after failing to truncate: %s", writeErr, err)
+}
+
+func (e *Exporter) openFile(name string) error {
+	if e.file != nil {
+		_ = e.file.Close()
+		e.file = nil
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open accounting file %q: %s", name, err)
+	}
+
+	size, err := cutTornLine(f)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to repair accounting file %q: %s", name, err)
+	}
+
+	e.file = f
+	e.fileName = name
+	e.size = size
+	return nil
+}
+
+func (e *Exporter) fileNameFor(start time.Time) string {
+	var layout string
+	switch e.cfg.Rollover {
+	case rotate.IntervalHourly:
+		layout = "2006-01-02_15"
+	case rotate.IntervalDaily:
+		layout = "2006-01-02"
+	default:
+		return e.cfg.Path
+	}
+
+	ext := filepath.Ext(e.cfg.Path)
+	return e.cfg.Path[:len(e.cfg.Path)-len(ext)] + "_" + start.Format(layout) + ext
+}
+
+// cutTornLine truncates f after its last newline and returns the resulting size.
+func cutTornLine(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+	buf := make([]byte, 64*1024)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+
+	if end == size {
+		return size, nil
+	}
+	return end, f.Truncate(end)
+}
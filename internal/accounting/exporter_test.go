@@ -0,0 +1,114 @@
+package accounting
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/rotate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeterCollect(t *testing.T) {
+	m := NewMeter()
+
+	h1 := m.Open("10.0.0.1")
+	h2 := m.Open("10.0.0.1")
+	h3 := m.Open("10.0.0.2")
+	_, _ = h1.SendWriter().Write(make([]byte, 10))
+	_, _ = h2.RecvWriter().Write(make([]byte, 20))
+	h3.WaitTimer().Add(time.Second)
+	h3.Close()
+
+	require.Equal(t, []Usage{
+		{ClientHost: "10.0.0.1", BytesSent: 10, BytesReceived: 20, Connections: 2},
+		{ClientHost: "10.0.0.2", Connections: 1, ThrottledTime: time.Second},
+	}, m.Collect())
+
+	// Counters are reset, idle clients are omitted and closed ones are forgotten.
+	_, _ = h1.RecvWriter().Write(make([]byte, 5))
+	require.Equal(t, []Usage{{ClientHost: "10.0.0.1", BytesReceived: 5}}, m.Collect())
+	require.Empty(t, m.Collect())
+	require.Len(t, m.clients, 1)
+
+	h1.Close()
+	h2.Close()
+	require.Empty(t, m.Collect())
+	require.Empty(t, m.clients)
+
+	var nilMeter *Meter
+	h := nilMeter.Open("10.0.0.1")
+	_, _ = h.SendWriter().Write([]byte("x"))
+	require.Nil(t, h.WaitTimer())
+	h.Close()
+}
+
+func TestExporterCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounting.csv")
+
+	m := NewMeter()
+	e := NewExporter(m, Config{Path: path, Format: FormatCSV, Interval: time.Hour, Rollover: rotate.IntervalNone}, func(err error) {
+		require.NoError(t, err)
+	})
+
+	h := m.Open("10.0.0.1")
+	_, _ = h.SendWriter().Write(make([]byte, 100))
+	h.Close()
+	e.export()
+
+	// Nothing happened during this period, so nothing is written.
+	e.export()
+
+	h = m.Open("10.0.0.2")
+	h.WaitTimer().Add(1500 * time.Millisecond)
+	h.Close()
+	go e.Run()
+	require.NoError(t, e.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "period_start,period_end,client_host,bytes_sent,bytes_received,connections,throttle_time", lines[0])
+	require.True(t, strings.HasSuffix(lines[1], ",10.0.0.1,100,0,1,0.000"), lines[1])
+	require.True(t, strings.HasSuffix(lines[2], ",10.0.0.2,0,0,1,1.500"), lines[2])
+}
+
+func TestExporterCutsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounting.jsonl")
+	complete := `{"client_host":"10.0.0.1"}` + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(complete+`{"client_ho`), 0644))
+
+	m := NewMeter()
+	e := NewExporter(m, Config{Path: path, Format: FormatJSONL, Interval: time.Hour}, func(err error) {
+		require.NoError(t, err)
+	})
+	m.Open("10.0.0.2").Close()
+	e.export()
+	require.NoError(t, e.file.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(data), complete))
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 2)
+	var rec Record
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &rec))
+	require.Equal(t, "10.0.0.2", rec.ClientHost)
+	require.Equal(t, int64(1), rec.Connections)
+}
+
+func TestExporterRollover(t *testing.T) {
+	dir := t.TempDir()
+	e := NewExporter(NewMeter(), Config{Path: filepath.Join(dir, "accounting.csv"), Rollover: rotate.IntervalDaily}, nil)
+
+	start := time.Date(2024, 5, 1, 23, 55, 0, 0, time.UTC)
+	require.Equal(t, filepath.Join(dir, "accounting_2024-05-01.csv"), e.fileNameFor(start))
+
+	e.cfg.Rollover = rotate.IntervalHourly
+	require.Equal(t, filepath.Join(dir, "accounting_2024-05-01_23.csv"), e.fileNameFor(start))
+}
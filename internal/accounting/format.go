@@ -0,0 +1,91 @@
+package accounting
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatCSV   Format = "csv"
+	FormatJSONL Format = "jsonl"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatCSV, FormatJSONL:
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("unknown accounting format %q", s)
+}
+
+// Record is one exported line: the usage of a client during [PeriodStart, PeriodEnd).
+// A client has at most one record per period, so (period_start, client_host) identifies a record.
+type Record struct {
+	PeriodStart   time.Time `json:"period_start"`
+	PeriodEnd     time.Time `json:"period_end"`
+	ClientHost    string    `json:"client_host"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Connections   int64     `json:"connections"`
+	// ThrottleTime is in seconds.
+	ThrottleTime float64 `json:"throttle_time"`
+}
+
+var csvHeader = []string{
+	"period_start", "period_end", "client_host", "bytes_sent", "bytes_received", "connections", "throttle_time",
+}
+
+func newRecords(start, end time.Time, usages []Usage) []Record {
+	records := make([]Record, 0, len(usages))
+	for _, usage := range usages {
+		records = append(records, Record{
+			PeriodStart:   start,
+			PeriodEnd:     end,
+			ClientHost:    usage.ClientHost,
+			BytesSent:     usage.BytesSent,
+			BytesReceived: usage.BytesReceived,
+			Connections:   usage.Connections,
+			ThrottleTime:  usage.ThrottledTime.Seconds(),
+		})
+	}
+	return records
+}
+
+// encode appends records to buf, preceded by the CSV header if header is set.
+func encode(buf *bytes.Buffer, format Format, records []Record, header bool) error {
+	switch format {
+	case FormatCSV:
+		w := csv.NewWriter(buf)
+		if header {
+			_ = w.Write(csvHeader)
+		}
+		for _, rec := range records {
+			_ = w.Write([]string{
+				rec.PeriodStart.Format(time.RFC3339),
+				rec.PeriodEnd.Format(time.RFC3339),
+				rec.ClientHost,
+				strconv.FormatInt(rec.BytesSent, 10),
+				strconv.FormatInt(rec.BytesReceived, 10),
+				strconv.FormatInt(rec.Connections, 10),
+				strconv.FormatFloat(rec.ThrottleTime, 'f', 3, 64),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	case FormatJSONL:
+		enc := json.NewEncoder(buf)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown accounting format %q", format)
+}
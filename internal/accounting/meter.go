@@ -0,0 +1,143 @@
+// Package accounting keeps per-client usage counters and periodically exports them as records
+// for billing.
+package accounting
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/ratelimit"
+)
+
+// Usage is the usage of one client (fairness key) during one period.
+type Usage struct {
+	ClientHost    string
+	BytesSent     int64
+	BytesReceived int64
+	// Connections is the number of requests and tunnels opened during the period.
+	Connections   int64
+	ThrottledTime time.Duration
+}
+
+type counters struct {
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	connections   atomic.Int64
+	throttled     ratelimit.WaitTimer
+
+	// handles is guarded by Meter.mu.
+	handles int
+}
+
+// Meter counts usage per client host. A nil *Meter is valid and produces nil handles,
+// which count nothing.
+type Meter struct {
+	mu      sync.Mutex
+	clients map[string]*counters
+}
+
+func NewMeter() *Meter {
+	return &Meter{clients: make(map[string]*counters)}
+}
+
+// Handle counts the usage of one connection. It must be closed when the connection is done.
+type Handle struct {
+	meter      *Meter
+	clientHost string
+	c          *counters
+}
+
+// Open starts counting a new connection of clientHost.
+func (m *Meter) Open(clientHost string) *Handle {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.clients[clientHost]
+	if !ok {
+		c = &counters{}
+		m.clients[clientHost] = c
+	}
+	c.handles++
+	c.connections.Add(1)
+	return &Handle{meter: m, clientHost: clientHost, c: c}
+}
+
+func (h *Handle) Close() {
+	if h == nil {
+		return
+	}
+
+	h.meter.mu.Lock()
+	defer h.meter.mu.Unlock()
+	h.c.handles--
+}
+
+// SendWriter counts bytes written to it as sent by the client.
+func (h *Handle) SendWriter() io.Writer {
+	if h == nil {
+		return io.Discard
+	}
+	return countingWriter{&h.c.bytesSent}
+}
+
+// RecvWriter counts bytes written to it as received by the client.
+func (h *Handle) RecvWriter() io.Writer {
+	if h == nil {
+		return io.Discard
+	}
+	return countingWriter{&h.c.bytesReceived}
+}
+
+// WaitTimer accumulates the throttled time of the client. It is nil for a nil handle.
+func (h *Handle) WaitTimer() *ratelimit.WaitTimer {
+	if h == nil {
+		return nil
+	}
+	return &h.c.throttled
+}
+
+// Collect returns the usage counted since the previous call, sorted by client host,
+// and resets the counters. Clients without usage are omitted.
+func (m *Meter) Collect() []Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []Usage
+	for clientHost, c := range m.clients {
+		usage := Usage{
+			ClientHost:    clientHost,
+			BytesSent:     c.bytesSent.Swap(0),
+			BytesReceived: c.bytesReceived.Swap(0),
+			Connections:   c.connections.Swap(0),
+			ThrottledTime: c.throttled.Reset(),
+		}
+		if c.handles == 0 {
+			delete(m.clients, clientHost)
+		}
+		if usage == (Usage{ClientHost: clientHost}) {
+			continue
+		}
+		result = append(result, usage)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ClientHost < result[j].ClientHost
+	})
+	return result
+}
+
+type countingWriter struct {
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return len(p), nil
+}
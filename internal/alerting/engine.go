@@ -0,0 +1,370 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/utils"
+)
+
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Alert is the JSON body posted to webhooks.
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Status    string    `json:"status"`
+	Metric    string    `json:"metric"`
+	Op        string    `json:"op"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"`
+	StartedAt time.Time `json:"started_at"`
+	Time      time.Time `json:"time"`
+}
+
+type ruleState struct {
+	Rule
+
+	pendingSince time.Time
+	firing       bool
+	firingSince  time.Time
+	lastSent     time.Time
+}
+
+type notification struct {
+	url   string
+	alert Alert
+}
+
+// Engine evaluates rules against registered metrics and posts state changes to webhooks.
+type Engine struct {
+	mu sync.Mutex
+
+	rules          []*ruleState
+	metrics        map[string]func() float64
+	defaultWebhook string
+	onError        func(error)
+
+	client        *http.Client
+	notifications chan notification
+	wake          chan struct{}
+
+	// subscriptions are removed from their counters by Close.
+	subscriptions []subscription
+	// closed is set by Close, guarded by mu like every send to notifications.
+	closed bool
+	stop   chan struct{}
+	// postCtx is cancelled when Close gives up on the queued notifications.
+	postCtx    context.Context
+	cancelPost context.CancelFunc
+	notifyDone chan struct{}
+}
+
+type subscription struct {
+	counter *utils.Counter
+	id      int64
+}
+
+func NewEngine(rules []Rule, defaultWebhook string, onError func(error)) (*Engine, error) {
+	e := &Engine{
+		metrics:        make(map[string]func() float64),
+		defaultWebhook: defaultWebhook,
+		onError:        onError,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		notifications:  make(chan notification, 1000),
+		wake:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		notifyDone:     make(chan struct{}),
+	}
+	e.postCtx, e.cancelPost = context.WithCancel(context.Background())
+
+	names := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := names[rule.Name]; ok {
+			return nil, fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+		if rule.Webhook == "" && defaultWebhook == "" {
+			return nil, fmt.Errorf("rule %q: no webhook configured", rule.Name)
+		}
+		e.rules = append(e.rules, &ruleState{Rule: rule})
+	}
+
+	go e.notifyLoop()
+	return e, nil
+}
+
+func (e *Engine) AddGauge(name string, get func() float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.metrics[name] = get
+}
+
+// AddCounter exposes c as a metric. Every change of c triggers an evaluation.
+func (e *Engine) AddCounter(name string, c *utils.Counter) {
+	var value atomic.Int64
+	value.Store(c.Get())
+	id := c.Subscribe(func(v int64) {
+		value.Store(v)
+		e.nudge()
+	})
+	e.subscribe(c, id)
+	e.AddGauge(name, func() float64 {
+		return float64(value.Load())
+	})
+}
+
+// AddDailyCounter exposes the growth of the sum of counters since the start of the current UTC day.
+func (e *Engine) AddDailyCounter(name string, counters ...*utils.Counter) {
+	values := make([]atomic.Int64, len(counters))
+	for i, c := range counters {
+		values[i].Store(c.Get())
+		id := c.Subscribe(func(v int64) {
+			values[i].Store(v)
+		})
+		e.subscribe(c, id)
+	}
+
+	var mu sync.Mutex
+	var baseline int64
+	var day time.Time
+	e.AddGauge(name, func() float64 {
+		var sum int64
+		for i := range values {
+			sum += values[i].Load()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		if !today.Equal(day) {
+			day = today
+			baseline = sum
+		}
+		return float64(sum - baseline)
+	})
+}
+
+func (e *Engine) subscribe(c *utils.Counter, id int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subscriptions = append(e.subscriptions, subscription{c, id})
+}
+
+// CheckMetrics returns an error if a rule uses a metric that was not registered.
+func (e *Engine) CheckMetrics() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, rule := range e.rules {
+		if _, ok := e.metrics[rule.Metric]; !ok {
+			return fmt.Errorf("rule %q: unknown metric %q (known: %v)", rule.Name, rule.Metric, e.metricNames())
+		}
+	}
+	return nil
+}
+
+func (e *Engine) metricNames() []string {
+	names := make([]string, 0, len(e.metrics))
+	for name := range e.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *Engine) nudge() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// minEvaluationGap bounds how often counter changes (e.g. every proxied chunk) trigger evaluations.
+const minEvaluationGap = 100 * time.Millisecond
+
+// Run evaluates the rules every interval and soon after every change of a registered counter,
+// until Close is called.
+func (e *Engine) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastEvaluation time.Time
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		case <-e.wake:
+			if gap := time.Since(lastEvaluation); gap < minEvaluationGap {
+				time.Sleep(minEvaluationGap - gap)
+			}
+		}
+		lastEvaluation = time.Now()
+		e.Evaluate(lastEvaluation)
+	}
+}
+
+func (e *Engine) Evaluate(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+
+	for _, rule := range e.rules {
+		get, ok := e.metrics[rule.Metric]
+		if !ok {
+			continue
+		}
+		e.evaluateRule(rule, get(), now)
+	}
+}
+
+func (e *Engine) evaluateRule(rule *ruleState, value float64, now time.Time) {
+	if rule.firing {
+		if rule.recovered(value) {
+			rule.firing = false
+			rule.pendingSince = time.Time{}
+			e.send(rule, StatusResolved, value, now)
+			return
+		}
+		if rule.RepeatInterval > 0 && now.Sub(rule.lastSent) >= time.Duration(rule.RepeatInterval) {
+			e.send(rule, StatusFiring, value, now)
+		}
+		return
+	}
+
+	if !rule.breached(value) {
+		rule.pendingSince = time.Time{}
+		return
+	}
+	if rule.pendingSince.IsZero() {
+		rule.pendingSince = now
+	}
+	if now.Sub(rule.pendingSince) < time.Duration(rule.For) {
+		return
+	}
+
+	rule.firing = true
+	rule.firingSince = rule.pendingSince
+	e.send(rule, StatusFiring, value, now)
+}
+
+func (e *Engine) send(rule *ruleState, status string, value float64, now time.Time) {
+	rule.lastSent = now
+
+	url := rule.Webhook
+	if url == "" {
+		url = e.defaultWebhook
+	}
+
+	n := notification{
+		url: url,
+		alert: Alert{
+			Rule:      rule.Name,
+			Status:    status,
+			Metric:    rule.Metric,
+			Op:        rule.Op,
+			Threshold: rule.Threshold,
+			Value:     value,
+			StartedAt: rule.firingSince,
+			Time:      now,
+		},
+	}
+
+	select {
+	case e.notifications <- n:
+	default:
+		e.reportError(fmt.Errorf("alert queue is full, dropped %s notification for %q", status, rule.Name))
+	}
+}
+
+func (e *Engine) notifyLoop() {
+	defer close(e.notifyDone)
+
+	for n := range e.notifications {
+		if e.postCtx.Err() != nil {
+			// Close gave up and reported what was left.
+			continue
+		}
+		if err := e.post(n); err != nil {
+			e.reportError(err)
+		}
+	}
+}
+
+// Close stops Run and the counter subscriptions, and sends the queued notifications. If ctx is done
+// first, the rest is dropped and an error reports how many notifications were not sent.
+func (e *Engine) Close(ctx context.Context) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	close(e.stop)
+	for _, s := range e.subscriptions {
+		s.counter.Unsubscribe(s.id)
+	}
+	e.subscriptions = nil
+	close(e.notifications)
+	e.mu.Unlock()
+
+	select {
+	case <-e.notifyDone:
+		e.cancelPost()
+		return nil
+	case <-ctx.Done():
+		// The notification being posted is interrupted, the queued ones are skipped.
+		n := len(e.notifications)
+		e.cancelPost()
+		return fmt.Errorf("%d alert notifications not sent: %s", n, ctx.Err())
+	}
+}
+
+func (e *Engine) post(n notification) error {
+	body, err := json.Marshal(n.alert)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(e.postCtx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post alert %q: %s", n.alert.Rule, err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook for alert %q returned %s", n.alert.Rule, resp.Status)
+	}
+	return nil
+}
+
+func (e *Engine) reportError(err error) {
+	if e.onError != nil {
+		e.onError(err)
+	}
+}
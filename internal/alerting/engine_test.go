@@ -0,0 +1,235 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func newWebhook(t *testing.T) (string, <-chan Alert) {
+	alerts := make(chan Alert, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, alerts
+}
+
+func receive(t *testing.T, alerts <-chan Alert) Alert {
+	select {
+	case alert := <-alerts:
+		return alert
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert received")
+		return Alert{}
+	}
+}
+
+func requireNoAlert(t *testing.T, alerts <-chan Alert) {
+	select {
+	case alert := <-alerts:
+		t.Fatalf("unexpected alert: %+v", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEngine_ForAndHysteresis(t *testing.T) {
+	url, alerts := newWebhook(t)
+
+	e, err := NewEngine([]Rule{{
+		Name:       "too many requests",
+		Metric:     "requests",
+		Op:         ">",
+		Threshold:  10,
+		For:        Duration(time.Minute),
+		Hysteresis: 2,
+	}}, url, func(err error) { t.Error(err) })
+	require.NoError(t, err)
+
+	c := utils.NewCounter()
+	e.AddCounter("requests", c)
+	require.NoError(t, e.CheckMetrics())
+
+	start := time.Now()
+
+	c.Add(11)
+	e.Evaluate(start)
+	e.Evaluate(start.Add(30 * time.Second))
+	requireNoAlert(t, alerts)
+
+	e.Evaluate(start.Add(time.Minute))
+	alert := receive(t, alerts)
+	require.Equal(t, StatusFiring, alert.Status)
+	require.Equal(t, "too many requests", alert.Rule)
+	require.Equal(t, float64(11), alert.Value)
+
+	// Still firing: deduplicated.
+	e.Evaluate(start.Add(2 * time.Minute))
+	// Within hysteresis: not resolved yet.
+	c.Sub(2)
+	e.Evaluate(start.Add(3 * time.Minute))
+	requireNoAlert(t, alerts)
+
+	c.Sub(1)
+	e.Evaluate(start.Add(4 * time.Minute))
+	alert = receive(t, alerts)
+	require.Equal(t, StatusResolved, alert.Status)
+	require.Equal(t, float64(8), alert.Value)
+}
+
+func TestEngine_PendingResets(t *testing.T) {
+	url, alerts := newWebhook(t)
+
+	value := 0.
+	e, err := NewEngine([]Rule{{
+		Name:      "low guarantee",
+		Metric:    "guaranteed",
+		Op:        "<",
+		Threshold: 1,
+		For:       Duration(time.Minute),
+	}}, url, func(err error) { t.Error(err) })
+	require.NoError(t, err)
+	e.AddGauge("guaranteed", func() float64 { return value })
+
+	start := time.Now()
+	e.Evaluate(start)
+	value = 2
+	e.Evaluate(start.Add(50 * time.Second))
+	value = 0
+	e.Evaluate(start.Add(70 * time.Second))
+	requireNoAlert(t, alerts)
+
+	e.Evaluate(start.Add(130 * time.Second))
+	require.Equal(t, StatusFiring, receive(t, alerts).Status)
+}
+
+func TestEngine_Repeat(t *testing.T) {
+	url, alerts := newWebhook(t)
+
+	e, err := NewEngine([]Rule{{
+		Name:           "always",
+		Metric:         "one",
+		Op:             ">",
+		Threshold:      0,
+		RepeatInterval: Duration(time.Hour),
+	}}, url, func(err error) { t.Error(err) })
+	require.NoError(t, err)
+	e.AddGauge("one", func() float64 { return 1 })
+
+	start := time.Now()
+	e.Evaluate(start)
+	require.Equal(t, StatusFiring, receive(t, alerts).Status)
+
+	e.Evaluate(start.Add(time.Minute))
+	requireNoAlert(t, alerts)
+
+	e.Evaluate(start.Add(time.Hour))
+	require.Equal(t, StatusFiring, receive(t, alerts).Status)
+}
+
+func TestEngine_DailyCounter(t *testing.T) {
+	e, err := NewEngine(nil, "", nil)
+	require.NoError(t, err)
+
+	sent := utils.NewCounter()
+	recv := utils.NewCounter()
+	sent.Add(100)
+	e.AddDailyCounter("bytes_today", sent, recv)
+
+	get := e.metrics["bytes_today"]
+	require.Equal(t, float64(0), get())
+
+	sent.Add(5)
+	recv.Add(7)
+	require.Equal(t, float64(12), get())
+}
+
+func TestEngine_Validation(t *testing.T) {
+	_, err := NewEngine([]Rule{{Name: "a", Metric: "m", Op: ">="}}, "http://localhost", nil)
+	require.Error(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a", Metric: "m", Op: ">"}}, "", nil)
+	require.Error(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a", Metric: "m", Op: ">"}, {Name: "a", Metric: "m", Op: "<"}}, "http://localhost", nil)
+	require.Error(t, err)
+
+	e, err := NewEngine([]Rule{{Name: "a", Metric: "m", Op: ">"}}, "http://localhost", nil)
+	require.NoError(t, err)
+	require.Error(t, e.CheckMetrics())
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "busy", "metric": "concurrent_requests", "op": ">", "threshold": 100, "for": "1m", "hysteresis": 10}
+	]`), 0644))
+
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	require.Equal(t, Duration(time.Minute), rules[0].For)
+	require.Equal(t, float64(10), rules[0].Hysteresis)
+}
+
+func TestEngine_Close(t *testing.T) {
+	url, alerts := newWebhook(t)
+
+	e, err := NewEngine([]Rule{{Name: "busy", Metric: "requests", Op: ">", Threshold: 0}}, url, func(err error) { t.Error(err) })
+	require.NoError(t, err)
+	c := utils.NewCounter()
+	e.AddCounter("requests", c)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(time.Hour)
+	}()
+
+	c.Add(1)
+	e.Evaluate(time.Now())
+	require.NoError(t, e.Close(context.Background()))
+	<-done
+
+	// Queued before Close, so it was sent.
+	require.Equal(t, StatusFiring, receive(t, alerts).Status)
+
+	// Nothing is evaluated or sent anymore.
+	c.Sub(1)
+	e.Evaluate(time.Now())
+	requireNoAlert(t, alerts)
+	require.NoError(t, e.Close(context.Background()))
+}
+
+func TestEngine_CloseDeadline(t *testing.T) {
+	// Hangs until the engine gives up on the request.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	e, err := NewEngine([]Rule{
+		{Name: "first", Metric: "requests", Op: ">", Threshold: 0},
+		{Name: "second", Metric: "requests", Op: ">", Threshold: 0},
+	}, server.URL, nil)
+	require.NoError(t, err)
+	e.AddGauge("requests", func() float64 { return 1 })
+	e.Evaluate(time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = e.Close(ctx)
+	require.ErrorContains(t, err, "1 alert notifications not sent")
+}
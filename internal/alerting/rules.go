@@ -0,0 +1,90 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration that is written as "1m30s" in rule files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"1m\": %s", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Rule fires when Metric compares to Threshold with Op for at least For.
+// A firing rule resolves only after the metric crosses back past Threshold by more than Hysteresis.
+type Rule struct {
+	Name       string   `json:"name"`
+	Metric     string   `json:"metric"`
+	Op         string   `json:"op"`
+	Threshold  float64  `json:"threshold"`
+	For        Duration `json:"for"`
+	Hysteresis float64  `json:"hysteresis"`
+	// Webhook overrides the engine's default webhook URL.
+	Webhook string `json:"webhook"`
+	// RepeatInterval re-sends the firing notification while the rule keeps firing.
+	// Zero sends it once per incident.
+	RepeatInterval Duration `json:"repeat_interval"`
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule without a name")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("rule %q: metric is empty", r.Name)
+	}
+	if r.Op != ">" && r.Op != "<" {
+		return fmt.Errorf("rule %q: op should be \">\" or \"<\", got %q", r.Name, r.Op)
+	}
+	if r.Hysteresis < 0 {
+		return fmt.Errorf("rule %q: hysteresis should not be negative", r.Name)
+	}
+	return nil
+}
+
+// breached reports whether value satisfies the firing condition.
+func (r *Rule) breached(value float64) bool {
+	if r.Op == ">" {
+		return value > r.Threshold
+	}
+	return value < r.Threshold
+}
+
+// recovered reports whether value is far enough from the threshold to resolve the alert.
+func (r *Rule) recovered(value float64) bool {
+	if r.Op == ">" {
+		return value <= r.Threshold-r.Hysteresis
+	}
+	return value >= r.Threshold+r.Hysteresis
+}
+
+// LoadRules reads a JSON array of rules.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert rules: %s", err)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse alert rules %q: %s", path, err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,196 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sample is a snapshot of the proxy state. Rates are in bytes per second.
+type Sample struct {
+	Time               time.Time `json:"time"`
+	UploadRate         float64   `json:"upload_rate"`
+	DownloadRate       float64   `json:"download_rate"`
+	GuaranteedSend     float64   `json:"guaranteed_send"`
+	GuaranteedRecv     float64   `json:"guaranteed_recv"`
+	ClientsSend        int64     `json:"clients_send"`
+	ClientsRecv        int64     `json:"clients_recv"`
+	ConcurrentRequests int64     `json:"concurrent_requests"`
+}
+
+// Ring keeps the last capacity samples in memory.
+// If it was opened with a path, every sample is also appended to that file as a JSON line,
+// and the file is compacted once it holds twice the capacity.
+type Ring struct {
+	mu sync.RWMutex
+
+	samples []Sample
+	next    int
+	full    bool
+
+	path string
+	// file is nil if the last compaction could not reopen it, the next Add compacts again.
+	file     *os.File
+	appended int
+	closed   bool
+}
+
+func NewRing(capacity int) *Ring {
+	if capacity <= 0 {
+		panic(fmt.Sprintf("invalid ring capacity: %d", capacity))
+	}
+	return &Ring{samples: make([]Sample, capacity)}
+}
+
+// OpenRing creates a ring persisted at path, loading the samples already stored there.
+func OpenRing(capacity int, path string) (*Ring, error) {
+	r := NewRing(capacity)
+	r.path = path
+
+	f, err := os.Open(path)
+	if err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var sample Sample
+			if json.Unmarshal(s.Bytes(), &sample) != nil {
+				// Skip a line torn by a crash.
+				continue
+			}
+			r.push(sample)
+		}
+		err = s.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history %q: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open history %q: %s", path, err)
+	}
+
+	if err := r.compact(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Ring) push(sample Sample) {
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *Ring) Add(sample Sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.push(sample)
+
+	if r.path == "" || r.closed {
+		return nil
+	}
+	if r.file == nil {
+		// Writes the new sample as well.
+		return r.compact()
+	}
+
+	line, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to persist history: %s", err)
+	}
+
+	r.appended++
+	if r.appended >= 2*len(r.samples) {
+		return r.compact()
+	}
+	return nil
+}
+
+// Samples returns the stored samples, oldest first.
+func (r *Ring) Samples() []Sample {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshot()
+}
+
+func (r *Ring) snapshot() []Sample {
+	if !r.full {
+		return append([]Sample(nil), r.samples[:r.next]...)
+	}
+	output := make([]Sample, 0, len(r.samples))
+	output = append(output, r.samples[r.next:]...)
+	return append(output, r.samples[:r.next]...)
+}
+
+// compact rewrites the history file with the in-memory samples only. The file is replaced only once
+// the rewrite is complete, so on failure it is kept as is, still open for appending, and the compaction
+// is retried by the next Add.
+func (r *Ring) compact() error {
+	if r.path == "" {
+		return nil
+	}
+
+	tmpPath := r.path + ".tmp"
+	samples := r.snapshot()
+	if err := writeSamples(tmpPath, samples); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact history: %s", err)
+	}
+	if err := os.Rename(tmpPath, r.path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact history: %s", err)
+	}
+
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history %q: %s", r.path, err)
+	}
+	r.file = file
+	r.appended = len(samples)
+	return nil
+}
+
+func writeSamples(path string, samples []Sample) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, sample := range samples {
+		if err := enc.Encode(sample); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (r *Ring) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
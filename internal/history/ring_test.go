@@ -0,0 +1,92 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sampleAt(i int) Sample {
+	return Sample{Time: time.Unix(int64(i), 0).UTC(), UploadRate: float64(i)}
+}
+
+func TestRing_Samples(t *testing.T) {
+	r := NewRing(3)
+	require.Empty(t, r.Samples())
+
+	require.NoError(t, r.Add(sampleAt(1)))
+	require.NoError(t, r.Add(sampleAt(2)))
+	require.Equal(t, []Sample{sampleAt(1), sampleAt(2)}, r.Samples())
+
+	require.NoError(t, r.Add(sampleAt(3)))
+	require.NoError(t, r.Add(sampleAt(4)))
+	require.Equal(t, []Sample{sampleAt(2), sampleAt(3), sampleAt(4)}, r.Samples())
+}
+
+func TestRing_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	r, err := OpenRing(3, path)
+	require.NoError(t, err)
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, r.Add(sampleAt(i)))
+	}
+	require.NoError(t, r.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	// Compaction keeps the file bounded.
+	require.LessOrEqual(t, strings.Count(string(data), "\n"), 6)
+
+	// A torn last line is skipped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"time":`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	r, err = OpenRing(3, path)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, []Sample{sampleAt(8), sampleAt(9), sampleAt(10)}, r.Samples())
+}
+
+func TestRing_CompactionFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	r, err := OpenRing(2, path)
+	require.NoError(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+
+	// The temporary file can not be created while a non-empty directory is in its place.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".tmp", "blocker"), 0755))
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, r.Add(sampleAt(i)))
+	}
+	require.Error(t, r.Add(sampleAt(4)))
+	// Samples are still appended, and the compaction is retried.
+	require.Error(t, r.Add(sampleAt(5)))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 5, strings.Count(string(data), "\n"))
+
+	require.NoError(t, os.RemoveAll(path+".tmp"))
+	require.NoError(t, r.Add(sampleAt(6)))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(data), "\n"))
+	require.NoFileExists(t, path+".tmp")
+
+	require.NoError(t, r.Add(sampleAt(7)))
+	require.NoError(t, r.Close())
+	r, err = OpenRing(2, path)
+	require.NoError(t, err)
+	require.Equal(t, []Sample{sampleAt(6), sampleAt(7)}, r.Samples())
+}
@@ -2,10 +2,21 @@ package hostlimiters
 
 import (
 	"fmt"
+	"github.com/galqiwi/fair-p/internal/ratelimit"
 	"golang.org/x/time/rate"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// rebalanceInterval is how often usage weighted limits are recomputed while bytes are counted.
+const rebalanceInterval = time.Second
+
+// minTrackedUsage is the decayed byte count below which the usage of a key is forgotten.
+const minTrackedUsage = 1024
+
 type HostLimiterStorage struct {
 	mu sync.RWMutex
 
@@ -13,23 +24,54 @@ type HostLimiterStorage struct {
 	burst         int
 
 	limiterUsage map[string]int64
-	limiters     map[string]*rate.Limiter
+	limiters     map[string]*ratelimit.Bucket
+
+	pacing ratelimit.Pacing
+
+	// halfLife is zero unless shares are weighted by usage.
+	halfLife    time.Duration
+	usage       map[string]*usageCounter
+	totalWeight float64
+	// lastRebalance is in Unix nanoseconds, it is read by HostLimiterHandle.Write without the mutex.
+	lastRebalance atomic.Int64
 }
 
 func NewHostLimiterStorage(maxThroughput rate.Limit, burst int) *HostLimiterStorage {
+	return NewWeightedHostLimiterStorage(maxThroughput, burst, 0)
+}
+
+// NewWeightedHostLimiterStorage returns a storage that scales the share of every key by its recent usage:
+// the weight of a key is 1 / (1 + usage / (maxThroughput * halfLife)), where usage is its byte count
+// decaying by half every halfLife. Bytes are counted by HostLimiterHandle.Write. A zero halfLife gives
+// every key the same share.
+func NewWeightedHostLimiterStorage(maxThroughput rate.Limit, burst int, halfLife time.Duration) *HostLimiterStorage {
 	return &HostLimiterStorage{
 		maxThroughput: maxThroughput,
 		burst:         burst,
 		limiterUsage:  make(map[string]int64),
-		limiters:      make(map[string]*rate.Limiter),
+		limiters:      make(map[string]*ratelimit.Bucket),
+		halfLife:      halfLife,
+		usage:         make(map[string]*usageCounter),
+		totalWeight:   1,
 	}
 }
 
+// SetPacing makes the burst of every key follow its limit, up to the storage's burst.
+// It should be called before the first handle is taken.
+func (s *HostLimiterStorage) SetPacing(pacing ratelimit.Pacing) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pacing = pacing
+}
+
 type HostLimiterHandle struct {
-	*rate.Limiter
+	*ratelimit.Bucket
 
 	host    string
 	storage *HostLimiterStorage
+	// usage is nil unless shares are weighted by usage.
+	usage *usageCounter
 }
 
 func (s *HostLimiterStorage) GetNHosts() int64 {
@@ -46,6 +88,10 @@ func (s *HostLimiterStorage) GetGuaranteedThroughput() rate.Limit {
 	if len(s.limiters) == 0 {
 		return getLimit(int64(1), s.maxThroughput)
 	}
+	if s.halfLife != 0 {
+		// The share of a key without recent usage.
+		return rate.Limit(float64(s.maxThroughput) / (s.totalWeight + 1))
+	}
 	return getLimit(int64(len(s.limiters)), s.maxThroughput)
 }
 
@@ -61,7 +107,23 @@ func (s *HostLimiterStorage) GetLimiterHandle(host string) HostLimiterHandle {
 	if oldLimiterUsage != 0 {
 		limiter := s.limiters[host]
 		s.validateInnerMaps(host)
-		return HostLimiterHandle{limiter, host, s}
+		return HostLimiterHandle{limiter, host, s, s.usage[host]}
+	}
+
+	if s.halfLife != 0 {
+		now := time.Now()
+		counter, ok := s.usage[host]
+		if !ok {
+			counter = &usageCounter{decayedCounter: decayedCounter{updated: now}}
+			s.usage[host] = counter
+		}
+
+		output := ratelimit.NewPacedBucket(0, s.burst, s.pacing)
+		s.limiters[host] = output
+		s.rebalance(now)
+
+		s.validateInnerMaps(host)
+		return HostLimiterHandle{output, host, s, counter}
 	}
 
 	nHosts := int64(len(s.limiters) + 1)
@@ -72,11 +134,11 @@ func (s *HostLimiterStorage) GetLimiterHandle(host string) HostLimiterHandle {
 		limiter.SetLimit(newThroughput)
 	}
 
-	output := rate.NewLimiter(newThroughput, s.burst)
+	output := ratelimit.NewPacedBucket(newThroughput, s.burst, s.pacing)
 	s.limiters[host] = output
 
 	s.validateInnerMaps(host)
-	return HostLimiterHandle{output, host, s}
+	return HostLimiterHandle{output, host, s, nil}
 }
 
 func (l *HostLimiterHandle) CloseHandle() {
@@ -107,6 +169,13 @@ func (l *HostLimiterHandle) CloseHandle() {
 	delete(s.limiters, host)
 	delete(s.limiterUsage, host)
 
+	if s.halfLife != 0 {
+		// Also forgets the usage of the key if it is negligible.
+		s.rebalance(time.Now())
+		s.validateInnerMaps(host)
+		return
+	}
+
 	nHosts := int64(len(s.limiters))
 
 	if nHosts == 0 {
@@ -123,6 +192,143 @@ func (l *HostLimiterHandle) CloseHandle() {
 	s.validateInnerMaps(host)
 }
 
+// Write counts p as used by the key of the handle, it is part of the copy destination.
+// The storage is only locked when the limits are due to be rebalanced.
+func (l *HostLimiterHandle) Write(p []byte) (int, error) {
+	if l.usage == nil {
+		return len(p), nil
+	}
+	l.usage.pending.Add(int64(len(p)))
+
+	s := l.storage
+	now := time.Now()
+	if now.UnixNano()-s.lastRebalance.Load() < int64(rebalanceInterval) {
+		return len(p), nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Another writer may have rebalanced while this one was waiting.
+	if now.UnixNano()-s.lastRebalance.Load() >= int64(rebalanceInterval) {
+		s.rebalance(now)
+	}
+	return len(p), nil
+}
+
+// rebalance sets the limit of every key to its weighted share. The shared pool has weight 1.
+func (s *HostLimiterStorage) rebalance(now time.Time) {
+	s.lastRebalance.Store(now.UnixNano())
+
+	for host, counter := range s.usage {
+		counter.flush(now, s.halfLife)
+		if _, ok := s.limiters[host]; !ok && counter.get(now, s.halfLife) < minTrackedUsage {
+			delete(s.usage, host)
+		}
+	}
+
+	weights := make(map[string]float64, len(s.limiters))
+	s.totalWeight = 1
+	for host := range s.limiters {
+		weights[host] = s.weight(host, now)
+		s.totalWeight += weights[host]
+	}
+	for host, limiter := range s.limiters {
+		limiter.SetLimit(rate.Limit(float64(s.maxThroughput) * weights[host] / s.totalWeight))
+	}
+}
+
+func (s *HostLimiterStorage) weight(host string, now time.Time) float64 {
+	counter, ok := s.usage[host]
+	if !ok {
+		return 1
+	}
+	scale := float64(s.maxThroughput) * s.halfLife.Seconds()
+	return 1 / (1 + counter.total(now, s.halfLife)/scale)
+}
+
+// HostWeight is the current state of a key of a usage weighted storage.
+type HostWeight struct {
+	Host string `json:"host"`
+	// Usage is the decayed byte count.
+	Usage  float64 `json:"usage"`
+	Weight float64 `json:"weight"`
+	// Limit is the current share in bytes per second, zero if the key has no open handles.
+	Limit float64 `json:"limit"`
+}
+
+// GetWeights returns the keys with open handles or recent usage, sorted by host.
+func (s *HostLimiterStorage) GetWeights() []HostWeight {
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts := make(map[string]bool)
+	for host := range s.limiters {
+		hosts[host] = true
+	}
+	for host := range s.usage {
+		hosts[host] = true
+	}
+
+	output := make([]HostWeight, 0, len(hosts))
+	for host := range hosts {
+		weight := HostWeight{Host: host, Weight: 1}
+		if s.halfLife != 0 {
+			weight.Weight = s.weight(host, now)
+		}
+		if counter, ok := s.usage[host]; ok {
+			weight.Usage = counter.total(now, s.halfLife)
+		}
+		if limiter, ok := s.limiters[host]; ok {
+			weight.Limit = float64(limiter.Limit())
+		}
+		output = append(output, weight)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Host < output[j].Host
+	})
+	return output
+}
+
+// decayedCounter is a byte count that halves every half-life.
+type decayedCounter struct {
+	value   float64
+	updated time.Time
+}
+
+func (c *decayedCounter) get(now time.Time, halfLife time.Duration) float64 {
+	elapsed := now.Sub(c.updated)
+	if elapsed <= 0 {
+		return c.value
+	}
+	return c.value * math.Exp2(-elapsed.Seconds()/halfLife.Seconds())
+}
+
+func (c *decayedCounter) add(n float64, now time.Time, halfLife time.Duration) {
+	c.value = c.get(now, halfLife) + n
+	c.updated = now
+}
+
+// usageCounter is the usage of a key. Writes only add to pending, which is folded into the decayed count
+// under the storage mutex.
+type usageCounter struct {
+	decayedCounter
+	pending atomic.Int64
+}
+
+func (c *usageCounter) flush(now time.Time, halfLife time.Duration) {
+	if n := c.pending.Swap(0); n != 0 {
+		c.add(float64(n), now, halfLife)
+	}
+}
+
+// total is the decayed count with the bytes not folded in yet.
+func (c *usageCounter) total(now time.Time, halfLife time.Duration) float64 {
+	return c.get(now, halfLife) + float64(c.pending.Load())
+}
+
 func (s *HostLimiterStorage) validateInnerMaps(host string) {
 	if s.mu.TryLock() {
 		panic("should be called inside the mutex")
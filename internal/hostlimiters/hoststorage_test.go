@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/galqiwi/fair-p/internal/ratelimit"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
@@ -17,11 +18,11 @@ func TestHostLimiterStorage_GetLimiterHandle(t *testing.T) {
 
 	hls := NewHostLimiterStorage(maxThroughput, burst)
 	handle := hls.GetLimiterHandle(host)
-	require.NotNil(t, handle.Limiter)
+	require.NotNil(t, handle.Bucket)
 
 	require.Equal(t, handle.host, host)
 	require.Equal(t, handle.storage, hls)
-	require.Equal(t, handle.Limiter, hls.limiters[host])
+	require.Equal(t, handle.Bucket, hls.limiters[host])
 	require.Equal(t, int64(1), hls.limiterUsage[host])
 
 	handle.CloseHandle()
@@ -58,3 +59,71 @@ func TestHostLimiterStorage_Concurrency(t *testing.T) {
 	require.Empty(t, hls.limiters)
 	require.Empty(t, hls.limiterUsage)
 }
+
+func TestHostLimiterStorage_UsageWeights(t *testing.T) {
+	hls := NewWeightedHostLimiterStorage(rate.Limit(1000), 5, time.Minute)
+
+	heavy := hls.GetLimiterHandle("heavy")
+	light := hls.GetLimiterHandle("light")
+	require.InDelta(t, 1000./3, float64(light.Limit()), 0.01)
+
+	// The heavy key has moved as much as the whole throughput in one half-life, so its weight is about 1/2.
+	_, err := heavy.Write(make([]byte, 60000))
+	require.NoError(t, err)
+	hls.mu.Lock()
+	hls.rebalance(time.Now())
+	hls.mu.Unlock()
+
+	weights := hls.GetWeights()
+	require.Len(t, weights, 2)
+	require.Equal(t, "heavy", weights[0].Host)
+	require.InDelta(t, 0.5, weights[0].Weight, 0.01)
+	require.InDelta(t, 1, weights[1].Weight, 0.01)
+	require.InDelta(t, 2*float64(heavy.Limit()), float64(light.Limit()), 1)
+
+	// Usage is remembered after the handle is closed.
+	heavy.CloseHandle()
+	light.CloseHandle()
+	weights = hls.GetWeights()
+	require.Len(t, weights, 1)
+	require.Equal(t, "heavy", weights[0].Host)
+	require.Zero(t, weights[0].Limit)
+}
+
+func TestHostLimiterStorage_WriteWithoutLock(t *testing.T) {
+	hls := NewWeightedHostLimiterStorage(rate.Limit(1000), 5, time.Minute)
+	handle := hls.GetLimiterHandle("a")
+	defer handle.CloseHandle()
+
+	// Until a rebalance is due, usage is counted without the storage mutex.
+	hls.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = handle.Write(make([]byte, 100))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked on the storage mutex")
+	}
+	hls.mu.Unlock()
+
+	require.InDelta(t, 100, hls.GetWeights()[0].Usage, 0.01)
+}
+
+func TestHostLimiterStorage_Pacing(t *testing.T) {
+	hls := NewHostLimiterStorage(rate.Limit(3000), 1000)
+	hls.SetPacing(ratelimit.Pacing{Slice: 100 * time.Millisecond, MinBurst: 10})
+
+	a := hls.GetLimiterHandle("a")
+	require.Equal(t, 150, a.Burst())
+
+	b := hls.GetLimiterHandle("b")
+	require.Equal(t, 100, a.Burst())
+	require.Equal(t, 100, b.Burst())
+
+	b.CloseHandle()
+	require.Equal(t, 150, a.Burst())
+	a.CloseHandle()
+}
@@ -0,0 +1,333 @@
+package hostlimiters
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/rate_counter"
+	"github.com/galqiwi/fair-p/internal/ratelimit"
+	"golang.org/x/time/rate"
+)
+
+const mb = 1024 * 1024
+
+// minTreeRate keeps the buckets of nodes without a share refilling:
+// x/time/rate treats a zero limit as a bucket that never refills.
+const minTreeRate = rate.Limit(1)
+
+// Tree is a hierarchical token bucket. Every node has an assured rate and an optional ceil,
+// connections are the leaves. A node that has used up its own rate borrows the unused rate of
+// its ancestors, up to its ceil and theirs.
+type Tree struct {
+	mu sync.Mutex
+
+	burst       int
+	pacing      ratelimit.Pacing
+	root        *treeNode
+	clients     map[string]*treeNode
+	defaultNode *treeNode
+}
+
+type treeNode struct {
+	config   TreeConfig
+	parent   *treeNode
+	children []*treeNode
+
+	// rate refills at the effective rate of the node, ceil at its configured ceil.
+	rate *ratelimit.Bucket
+	ceil *ratelimit.Bucket
+
+	// guarded by Tree.mu
+	effectiveRate rate.Limit
+	connections   int
+	leaves        map[*TreeLeaf]struct{}
+
+	granted *rate_counter.RateCountingWriter
+}
+
+// NewTree returns a tree whose buckets hold at most burst tokens, or less if they are paced.
+func NewTree(config TreeConfig, burst int, pacing ratelimit.Pacing) *Tree {
+	t := &Tree{
+		burst:   burst,
+		pacing:  pacing,
+		clients: make(map[string]*treeNode),
+	}
+	t.root = t.newNode(config, nil)
+	if t.root.ceil == nil {
+		t.root.ceil = t.newBucket(rate.Limit(config.Rate * mb))
+	}
+	t.rebalance()
+	return t
+}
+
+func (t *Tree) newNode(config TreeConfig, parent *treeNode) *treeNode {
+	node := &treeNode{
+		config:  config,
+		parent:  parent,
+		rate:    t.newBucket(minTreeRate),
+		leaves:  make(map[*TreeLeaf]struct{}),
+		granted: rate_counter.NewRateCountingWriter(time.Second),
+	}
+	node.config.Children = nil
+	if config.Ceil > 0 {
+		node.ceil = t.newBucket(rate.Limit(config.Ceil * mb))
+	}
+
+	for _, client := range config.Clients {
+		t.clients[client] = node
+	}
+	if config.Default {
+		t.defaultNode = node
+	}
+	for _, child := range config.Children {
+		node.children = append(node.children, t.newNode(child, node))
+	}
+	return node
+}
+
+func (t *Tree) newBucket(limit rate.Limit) *ratelimit.Bucket {
+	return ratelimit.NewPacedBucket(limit, t.burst, t.pacing)
+}
+
+// Open adds a connection of clientHost to the node that lists it, the default node or the root.
+// The leaf must be closed.
+func (t *Tree) Open(clientHost string) *TreeLeaf {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node, ok := t.clients[clientHost]
+	if !ok {
+		node = t.defaultNode
+	}
+	if node == nil {
+		node = t.root
+	}
+
+	leaf := &TreeLeaf{
+		tree: t,
+		node: node,
+		rate: t.newBucket(minTreeRate),
+	}
+	node.leaves[leaf] = struct{}{}
+	for n := node; n != nil; n = n.parent {
+		n.connections++
+	}
+
+	t.rebalance()
+	return leaf
+}
+
+// rebalance recomputes the effective rates after a connection was opened or closed.
+func (t *Tree) rebalance() {
+	t.root.effectiveRate = rate.Limit(t.root.config.Rate * mb)
+	t.root.distribute()
+}
+
+// distribute sets the effective rates of the children and leaves of n. Children with an explicit rate get it,
+// the rest of the effective rate of n is shared by active children without one and by the leaves of n
+// in proportion to their weights. Connections have weight 1.
+func (n *treeNode) distribute() {
+	n.rate.SetLimit(max(n.effectiveRate, minTreeRate))
+
+	remaining := n.effectiveRate
+	weights := float64(len(n.leaves))
+	for _, child := range n.children {
+		if child.connections == 0 {
+			continue
+		}
+		if child.config.Rate > 0 {
+			remaining -= rate.Limit(child.config.Rate * mb)
+		} else {
+			weights += child.config.weight()
+		}
+	}
+	remaining = max(remaining, 0)
+
+	share := func(weight float64) rate.Limit {
+		if weights == 0 {
+			return 0
+		}
+		return remaining * rate.Limit(weight/weights)
+	}
+
+	for _, child := range n.children {
+		switch {
+		case child.config.Rate > 0:
+			child.effectiveRate = rate.Limit(child.config.Rate * mb)
+		case child.connections == 0:
+			child.effectiveRate = 0
+		default:
+			child.effectiveRate = share(child.config.weight())
+		}
+		child.distribute()
+	}
+	for leaf := range n.leaves {
+		leaf.rate.SetLimit(max(share(1), minTreeRate))
+	}
+}
+
+// TreeLeaf is a connection in a Tree. It implements ratelimit.Limiter.
+type TreeLeaf struct {
+	tree *Tree
+	node *treeNode
+	rate *ratelimit.Bucket
+}
+
+var _ ratelimit.Limiter = (*TreeLeaf)(nil)
+
+func (l *TreeLeaf) Close() {
+	t := l.tree
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := l.node.leaves[l]; !ok {
+		return
+	}
+	delete(l.node.leaves, l)
+	for n := l.node; n != nil; n = n.parent {
+		n.connections--
+	}
+	t.rebalance()
+}
+
+// Burst is the smallest burst on the path to the root, it changes with the rates if the tree is paced.
+func (l *TreeLeaf) Burst() int {
+	burst := l.rate.Burst()
+	for node := l.node; node != nil; node = node.parent {
+		burst = min(burst, node.rate.Burst())
+		if node.ceil != nil {
+			burst = min(burst, node.ceil.Burst())
+		}
+	}
+	return burst
+}
+
+func (l *TreeLeaf) Tokens() float64 {
+	return l.rate.Tokens()
+}
+
+func (l *TreeLeaf) AllowN(t time.Time, n int) bool {
+	r := l.ReserveN(t, n)
+	if r.OK() && r.DelayFrom(t) == 0 {
+		return true
+	}
+	r.CancelAt(t)
+	return false
+}
+
+// ReserveN takes n tokens from the leaf, from every node up to the root and from their ceils.
+// The tokens may be used as soon as any of the leaf and its ancestors has them (borrowing) and every ceil allows it.
+//
+// A bucket that is more than a burst in debt is skipped: it is neither charged nor lends, so borrowing
+// for long does not leave a node unable to use its own rate later. The root is always charged.
+func (l *TreeLeaf) ReserveN(t time.Time, n int) ratelimit.Reservation {
+	r := &treeReservation{ok: true}
+	inDebt := func(bucket *ratelimit.Bucket) bool {
+		return bucket.TokensAt(t)-float64(n) < -float64(bucket.Burst())
+	}
+
+	if !inDebt(l.rate) {
+		r.rates = append(r.rates, l.rate.ReserveN(t, n))
+	}
+	for node := l.node; node != nil; node = node.parent {
+		if node.parent == nil || !inDebt(node.rate) {
+			r.rates = append(r.rates, node.rate.ReserveN(t, n))
+		}
+		if node.ceil != nil {
+			r.ceils = append(r.ceils, node.ceil.ReserveN(t, n))
+		}
+	}
+
+	for _, parts := range [][]ratelimit.Reservation{r.rates, r.ceils} {
+		for _, part := range parts {
+			if !part.OK() {
+				r.ok = false
+				r.CancelAt(t)
+				return r
+			}
+		}
+	}
+
+	for node := l.node; node != nil; node = node.parent {
+		node.granted.Add(int64(n))
+	}
+	return r
+}
+
+func (l *TreeLeaf) WaitN(ctx context.Context, n int) error {
+	return ratelimit.WaitReserved(ctx, l, n)
+}
+
+// treeReservation may be used when the first of rates and all of ceils allow it.
+type treeReservation struct {
+	ok    bool
+	rates []ratelimit.Reservation
+	ceils []ratelimit.Reservation
+}
+
+func (r *treeReservation) OK() bool {
+	return r.ok
+}
+
+func (r *treeReservation) DelayFrom(t time.Time) time.Duration {
+	if !r.ok {
+		return rate.InfDuration
+	}
+
+	delay := time.Duration(math.MaxInt64)
+	for _, part := range r.rates {
+		delay = min(delay, part.DelayFrom(t))
+	}
+	for _, part := range r.ceils {
+		delay = max(delay, part.DelayFrom(t))
+	}
+	return delay
+}
+
+func (r *treeReservation) CancelAt(t time.Time) {
+	for _, part := range r.rates {
+		part.CancelAt(t)
+	}
+	for _, part := range r.ceils {
+		part.CancelAt(t)
+	}
+}
+
+// TreeNodeStatus is a node of Tree.Status. Rates are in MB/s.
+type TreeNodeStatus struct {
+	Name          string  `json:"name"`
+	Rate          float64 `json:"rate"`
+	Ceil          float64 `json:"ceil"`
+	Weight        float64 `json:"weight"`
+	EffectiveRate float64 `json:"effective_rate"`
+	// CurrentRate is the rate granted to the connections of the subtree over the last second.
+	CurrentRate float64          `json:"current_rate"`
+	Connections int              `json:"connections"`
+	Children    []TreeNodeStatus `json:"children,omitempty"`
+}
+
+func (t *Tree) Status() TreeNodeStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.root.status()
+}
+
+func (n *treeNode) status() TreeNodeStatus {
+	status := TreeNodeStatus{
+		Name:          n.config.Name,
+		Rate:          n.config.Rate,
+		Ceil:          n.config.Ceil,
+		Weight:        n.config.weight(),
+		EffectiveRate: float64(n.effectiveRate) / mb,
+		CurrentRate:   float64(n.granted.GetRate()) / mb,
+		Connections:   n.connections,
+	}
+	for _, child := range n.children {
+		status.Children = append(status.Children, child.status())
+	}
+	return status
+}
@@ -0,0 +1,99 @@
+package hostlimiters
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// TreeConfig is a node of a limiter tree file. Rates are in MB/s.
+type TreeConfig struct {
+	Name string `json:"name"`
+	// Rate is the assured rate of the node. Zero gives the node a share of what its parent has left
+	// after the explicit rates of its active siblings, in proportion to Weight.
+	Rate float64 `json:"rate"`
+	// Ceil is the max rate of the node including borrowed tokens. Zero means no limit besides the ancestors'.
+	Ceil float64 `json:"ceil"`
+	// Weight is 1 if not set.
+	Weight float64 `json:"weight"`
+	// Clients are the client hosts whose connections become leaves of this node.
+	Clients []string `json:"clients"`
+	// Default marks the node of clients that are not listed anywhere, the root is used if there is none.
+	Default  bool         `json:"default"`
+	Children []TreeConfig `json:"children"`
+}
+
+// LoadTreeConfig reads the JSON limiter tree at path.
+func LoadTreeConfig(path string) (TreeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TreeConfig{}, fmt.Errorf("failed to read limiter tree: %s", err)
+	}
+
+	var config TreeConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return TreeConfig{}, fmt.Errorf("failed to parse limiter tree %q: %s", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return TreeConfig{}, fmt.Errorf("invalid limiter tree %q: %s", path, err)
+	}
+	return config, nil
+}
+
+func (c *TreeConfig) Validate() error {
+	if c.Rate <= 0 {
+		return fmt.Errorf("root node should have a positive rate")
+	}
+	return c.validate(map[string]bool{}, map[string]string{}, new(int))
+}
+
+func (c *TreeConfig) validate(names map[string]bool, clients map[string]string, defaults *int) error {
+	if c.Name == "" {
+		return fmt.Errorf("node without a name")
+	}
+	if names[c.Name] {
+		return fmt.Errorf("duplicate node name %q", c.Name)
+	}
+	names[c.Name] = true
+
+	if c.Rate < 0 || c.Ceil < 0 || c.Weight < 0 {
+		return fmt.Errorf("node %q: rate, ceil and weight should not be negative", c.Name)
+	}
+	if c.Ceil != 0 && c.Ceil < c.Rate {
+		return fmt.Errorf("node %q: ceil should not be less than rate", c.Name)
+	}
+
+	for _, client := range c.Clients {
+		if other, ok := clients[client]; ok {
+			return fmt.Errorf("client %q is listed in both %q and %q", client, other, c.Name)
+		}
+		clients[client] = c.Name
+	}
+
+	if c.Default {
+		*defaults++
+		if *defaults > 1 {
+			return fmt.Errorf("more than one default node")
+		}
+	}
+
+	childRates := 0.
+	for i := range c.Children {
+		child := &c.Children[i]
+		if err := child.validate(names, clients, defaults); err != nil {
+			return err
+		}
+		childRates += child.Rate
+	}
+	if c.Rate != 0 && childRates > c.Rate {
+		return fmt.Errorf("node %q: rates of the children add up to more than its rate", c.Name)
+	}
+	return nil
+}
+
+func (c *TreeConfig) weight() float64 {
+	if c.Weight == 0 {
+		return 1
+	}
+	return c.Weight
+}
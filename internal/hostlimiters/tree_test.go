@@ -0,0 +1,88 @@
+package hostlimiters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/ratelimit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeConfig_Validate(t *testing.T) {
+	valid := TreeConfig{Name: "root", Rate: 10, Children: []TreeConfig{
+		{Name: "a", Rate: 4, Clients: []string{"10.0.0.1"}},
+		{Name: "b", Weight: 2, Default: true},
+	}}
+	require.NoError(t, valid.Validate())
+
+	for name, config := range map[string]TreeConfig{
+		"no root rate":   {Name: "root"},
+		"duplicate name": {Name: "root", Rate: 10, Children: []TreeConfig{{Name: "root"}}},
+		"ceil below rate": {Name: "root", Rate: 10, Children: []TreeConfig{
+			{Name: "a", Rate: 4, Ceil: 2},
+		}},
+		"oversubscribed": {Name: "root", Rate: 10, Children: []TreeConfig{
+			{Name: "a", Rate: 6}, {Name: "b", Rate: 6},
+		}},
+		"duplicate client": {Name: "root", Rate: 10, Children: []TreeConfig{
+			{Name: "a", Clients: []string{"10.0.0.1"}}, {Name: "b", Clients: []string{"10.0.0.1"}},
+		}},
+		"two defaults": {Name: "root", Rate: 10, Children: []TreeConfig{
+			{Name: "a", Default: true}, {Name: "b", Default: true},
+		}},
+	} {
+		require.Error(t, config.Validate(), name)
+	}
+}
+
+func TestTree_EffectiveRates(t *testing.T) {
+	tree := NewTree(TreeConfig{Name: "root", Rate: 10, Children: []TreeConfig{
+		{Name: "a", Rate: 4, Clients: []string{"a"}},
+		{Name: "b", Clients: []string{"b"}},
+		{Name: "c", Weight: 3, Clients: []string{"c"}},
+	}}, mb, ratelimit.Pacing{})
+
+	a := tree.Open("a")
+	b := tree.Open("b")
+	c := tree.Open("c")
+
+	rates := func() map[string]float64 {
+		output := make(map[string]float64)
+		for _, child := range tree.Status().Children {
+			output[child.Name] = child.EffectiveRate
+		}
+		return output
+	}
+	require.InDeltaMapValues(t, map[string]float64{"a": 4, "b": 1.5, "c": 4.5}, rates(), 1e-9)
+
+	c.Close()
+	require.InDeltaMapValues(t, map[string]float64{"a": 4, "b": 6, "c": 0}, rates(), 1e-9)
+
+	a.Close()
+	b.Close()
+	require.Equal(t, 0, tree.Status().Connections)
+}
+
+func TestTree_Borrowing(t *testing.T) {
+	newTree := func() *Tree {
+		return NewTree(TreeConfig{Name: "root", Rate: 10, Children: []TreeConfig{
+			{Name: "capped", Rate: 1, Ceil: 2, Clients: []string{"capped"}},
+			{Name: "open", Rate: 1, Clients: []string{"open"}},
+		}}, mb, ratelimit.Pacing{})
+	}
+	now := time.Now().Add(time.Millisecond)
+
+	// The first megabyte is the burst, the second one is borrowed from the root at 10 MB/s.
+	open := newTree().Open("open")
+	defer open.Close()
+	require.Zero(t, open.ReserveN(now, mb).DelayFrom(now))
+	require.InDelta(t, 100*time.Millisecond, open.ReserveN(now, mb).DelayFrom(now), float64(10*time.Millisecond))
+
+	// Borrowing is limited by the ceil of 2 MB/s.
+	capped := newTree().Open("capped")
+	defer capped.Close()
+	require.Zero(t, capped.ReserveN(now, mb).DelayFrom(now))
+	require.InDelta(t, 500*time.Millisecond, capped.ReserveN(now, mb).DelayFrom(now), float64(10*time.Millisecond))
+
+	require.False(t, capped.ReserveN(now, 2*mb).OK())
+}
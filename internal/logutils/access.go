@@ -0,0 +1,175 @@
+package logutils
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"time"
+)
+
+type AccessLogFormat string
+
+const (
+	AccessLogNone   AccessLogFormat = "none"
+	AccessLogJSON   AccessLogFormat = "json"
+	AccessLogSquid  AccessLogFormat = "squid"
+	AccessLogCommon AccessLogFormat = "common"
+)
+
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch AccessLogFormat(s) {
+	case AccessLogNone, AccessLogJSON, AccessLogSquid, AccessLogCommon:
+		return AccessLogFormat(s), nil
+	}
+	return "", fmt.Errorf("unknown access log format %q", s)
+}
+
+// AccessRecord describes a single completed HTTP request or CONNECT tunnel.
+type AccessRecord struct {
+	Start       time.Time
+	TraceID     string
+	Client      string
+	ClientHost  string
+	Method      string
+	Destination string
+	URL         string
+	Proto       string
+	Status      int
+	ContentType string
+
+	// BytesSent is the number of bytes forwarded from the client to the destination,
+	// BytesReceived is the number of bytes forwarded back to the client.
+	BytesSent     int64
+	BytesReceived int64
+
+	Duration     time.Duration
+	ThrottleTime time.Duration
+}
+
+type AccessLogger interface {
+	Log(rec AccessRecord)
+}
+
+func NewAccessLogger(ws zapcore.WriteSyncer, format AccessLogFormat) (AccessLogger, error) {
+	switch format {
+	case AccessLogNone:
+		return nopAccessLogger{}, nil
+	case AccessLogJSON:
+		return newJSONAccessLogger(ws), nil
+	case AccessLogSquid:
+		return &lineAccessLogger{ws: ws, format: formatSquid}, nil
+	case AccessLogCommon:
+		return &lineAccessLogger{ws: ws, format: formatCommon}, nil
+	}
+	return nil, fmt.Errorf("unknown access log format %q", format)
+}
+
+type nopAccessLogger struct{}
+
+func (nopAccessLogger) Log(AccessRecord) {}
+
+type jsonAccessLogger struct {
+	logger *zap.Logger
+}
+
+func newJSONAccessLogger(ws zapcore.WriteSyncer) *jsonAccessLogger {
+	// Not sampled: every request must produce exactly one record.
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+			TimeKey:        "ts",
+			MessageKey:     "msg",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeTime:     zapcore.RFC3339NanoTimeEncoder,
+			EncodeDuration: zapcore.SecondsDurationEncoder,
+		}),
+		ws,
+		zap.NewAtomicLevelAt(zap.InfoLevel),
+	)
+	return &jsonAccessLogger{logger: zap.New(core)}
+}
+
+func (l *jsonAccessLogger) Log(rec AccessRecord) {
+	l.logger.Info("access",
+		zap.Time("start", rec.Start),
+		zap.String("trace_id", rec.TraceID),
+		zap.String("client", rec.Client),
+		zap.String("client_host", rec.ClientHost),
+		zap.String("method", rec.Method),
+		zap.String("destination", rec.Destination),
+		zap.String("url", rec.URL),
+		zap.Int("status", rec.Status),
+		zap.Int64("bytes_sent", rec.BytesSent),
+		zap.Int64("bytes_received", rec.BytesReceived),
+		zap.Duration("duration", rec.Duration),
+		zap.Duration("throttle_time", rec.ThrottleTime),
+	)
+}
+
+type lineAccessLogger struct {
+	ws     zapcore.WriteSyncer
+	format func(rec AccessRecord) string
+}
+
+func (l *lineAccessLogger) Log(rec AccessRecord) {
+	_, _ = l.ws.Write([]byte(l.format(rec) + "\n"))
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatSquid renders rec in the Squid native access.log format followed by
+// the trace id, bytes sent upstream and throttle time in milliseconds.
+func formatSquid(rec AccessRecord) string {
+	end := rec.Start.Add(rec.Duration)
+
+	action := "TCP_MISS"
+	if rec.Method == "CONNECT" {
+		action = "TCP_TUNNEL"
+	}
+	hierarchy := "HIER_DIRECT/" + dashIfEmpty(rec.Destination)
+	if rec.Status >= 500 {
+		action = "NONE"
+		hierarchy = "HIER_NONE/-"
+	}
+
+	return fmt.Sprintf("%d.%03d %6d %s %s/%03d %d %s %s - %s %s %s %d %d",
+		end.Unix(), end.Nanosecond()/int(time.Millisecond),
+		rec.Duration.Milliseconds(),
+		dashIfEmpty(rec.ClientHost),
+		action, rec.Status,
+		rec.BytesReceived,
+		dashIfEmpty(rec.Method),
+		dashIfEmpty(rec.URL),
+		hierarchy,
+		dashIfEmpty(rec.ContentType),
+		dashIfEmpty(rec.TraceID),
+		rec.BytesSent,
+		rec.ThrottleTime.Milliseconds(),
+	)
+}
+
+// formatCommon renders rec in the Common Log Format followed by the same
+// extra fields as formatSquid.
+func formatCommon(rec AccessRecord) string {
+	request := strings.Join([]string{
+		dashIfEmpty(rec.Method),
+		dashIfEmpty(rec.URL),
+		dashIfEmpty(rec.Proto),
+	}, " ")
+
+	return fmt.Sprintf("%s - - [%s] %q %d %d %s %d %d",
+		dashIfEmpty(rec.ClientHost),
+		rec.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		request,
+		rec.Status,
+		rec.BytesReceived,
+		dashIfEmpty(rec.TraceID),
+		rec.BytesSent,
+		rec.ThrottleTime.Milliseconds(),
+	)
+}
@@ -1,39 +1,214 @@
 package logutils
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
 	"go.uber.org/zap/zapcore"
-	"io"
 )
 
-type asyncWriteSyncer struct {
+type OverflowPolicy string
+
+const (
+	// OverflowBlock makes Write wait for a free slot in the queue.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest discards the message being written.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest discards the oldest queued message to make room.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch OverflowPolicy(s) {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+		return OverflowPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// AsyncWriteSyncer writes to inner from a background goroutine through a bounded queue.
+type AsyncWriteSyncer struct {
 	inner        zapcore.WriteSyncer
+	policy       OverflowPolicy
 	messageQueue chan []byte
+
+	// closeMu is held for reading while sending to messageQueue, so Close can close it safely.
+	closeMu sync.RWMutex
+	closed  bool
+	// closing is closed when Close starts, it releases writers blocked on a full queue.
+	closing     chan struct{}
+	closingOnce sync.Once
+	// loopDone is closed when writeLoop exits.
+	loopDone chan struct{}
+
+	dropped atomic.Int64
+
+	// accepted counts messages put into the queue, done counts messages written or dropped from it.
+	accepted   atomic.Int64
+	doneMu     sync.Mutex
+	done       int64
+	doneCond   *sync.Cond
+	loopExited bool
 }
 
-func NewAsyncWriter(ws zapcore.WriteSyncer, size int) (io.Writer, func() int) {
-	output := &asyncWriteSyncer{
+var _ zapcore.WriteSyncer = (*AsyncWriteSyncer)(nil)
+
+func NewAsyncWriter(ws zapcore.WriteSyncer, size int, policy OverflowPolicy) *AsyncWriteSyncer {
+	output := &AsyncWriteSyncer{
 		inner:        ws,
+		policy:       policy,
 		messageQueue: make(chan []byte, size),
+		closing:      make(chan struct{}),
+		loopDone:     make(chan struct{}),
 	}
+	output.doneCond = sync.NewCond(&output.doneMu)
 	go output.writeLoop()
-	return output, func() int {
-		return len(output.messageQueue)
-	}
+	return output
 }
 
-func (s *asyncWriteSyncer) Write(bs []byte) (int, error) {
+func (s *AsyncWriteSyncer) QueueSize() int {
+	return len(s.messageQueue)
+}
+
+// Dropped returns the number of messages discarded because of the overflow policy or after Close.
+func (s *AsyncWriteSyncer) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+func (s *AsyncWriteSyncer) Write(bs []byte) (int, error) {
 	n := len(bs)
 
 	buf := make([]byte, len(bs))
 	copy(buf, bs)
 
-	s.messageQueue <- buf
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		s.dropped.Add(1)
+		return n, nil
+	}
+
+	switch s.policy {
+	case OverflowDropNewest:
+		if !s.trySend(buf) {
+			s.dropped.Add(1)
+			return n, nil
+		}
+	case OverflowDropOldest:
+		for !s.trySend(buf) {
+			s.dropOldest()
+		}
+	default:
+		select {
+		case s.messageQueue <- buf:
+		case <-s.closing:
+			s.dropped.Add(1)
+			return n, nil
+		}
+	}
 
+	s.accepted.Add(1)
 	return n, nil
 }
 
-func (s *asyncWriteSyncer) writeLoop() {
+func (s *AsyncWriteSyncer) trySend(buf []byte) bool {
+	select {
+	case s.messageQueue <- buf:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *AsyncWriteSyncer) dropOldest() {
+	select {
+	case <-s.messageQueue:
+		s.dropped.Add(1)
+		s.markDone()
+	default:
+	}
+}
+
+func (s *AsyncWriteSyncer) markDone() {
+	s.doneMu.Lock()
+	s.done++
+	s.doneMu.Unlock()
+	s.doneCond.Broadcast()
+}
+
+// Sync waits until every message accepted before the call is written, then syncs inner.
+func (s *AsyncWriteSyncer) Sync() error {
+	target := s.accepted.Load()
+
+	s.doneMu.Lock()
+	for s.done < target && !s.loopExited {
+		s.doneCond.Wait()
+	}
+	s.doneMu.Unlock()
+
+	return s.inner.Sync()
+}
+
+// Close stops accepting messages, writes everything queued and syncs inner.
+func (s *AsyncWriteSyncer) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext is Close that gives up when ctx is done, for example because inner is stalled. The messages
+// still queued are then discarded and counted as dropped, and inner is not synced.
+func (s *AsyncWriteSyncer) CloseContext(ctx context.Context) error {
+	s.closingOnce.Do(func() { close(s.closing) })
+
+	s.closeMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.messageQueue)
+	}
+	s.closeMu.Unlock()
+
+	select {
+	case <-s.loopDone:
+	case <-ctx.Done():
+		// The write loop is stuck in inner.Write, take the rest of the queue away from it.
+		for range s.messageQueue {
+			s.dropped.Add(1)
+			s.markDone()
+		}
+		return fmt.Errorf("log queue not drained: %s", ctx.Err())
+	}
+
+	return runWithContext(ctx, s.inner.Sync)
+}
+
+// runWithContext runs f, but returns when ctx is done without waiting for f, which keeps running.
+func runWithContext(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *AsyncWriteSyncer) writeLoop() {
+	defer func() {
+		close(s.loopDone)
+		s.doneMu.Lock()
+		s.loopExited = true
+		s.doneMu.Unlock()
+		s.doneCond.Broadcast()
+	}()
+
 	for bs := range s.messageQueue {
 		_, _ = s.inner.Write(bs)
+		s.markDone()
 	}
 }
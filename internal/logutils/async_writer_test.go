@@ -0,0 +1,132 @@
+package logutils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gatedWriter blocks every Write until the gate is opened.
+type gatedWriter struct {
+	gate chan struct{}
+
+	mu       sync.Mutex
+	messages []string
+	syncs    int
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{gate: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, string(p))
+	return len(p), nil
+}
+
+func (w *gatedWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.syncs++
+	return nil
+}
+
+func (w *gatedWriter) written() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.messages...)
+}
+
+func TestAsyncWriter_DropNewest(t *testing.T) {
+	inner := newGatedWriter()
+	w := NewAsyncWriter(inner, 2, OverflowDropNewest)
+
+	// The first message may be taken by the write loop, which then blocks on the gate.
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		_, err := w.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, w.Dropped(), int64(2))
+
+	close(inner.gate)
+	require.NoError(t, w.Close())
+
+	written := inner.written()
+	require.Equal(t, int64(5), int64(len(written))+w.Dropped())
+	require.Equal(t, "a", written[0])
+	require.Equal(t, 1, inner.syncs)
+}
+
+func TestAsyncWriter_DropOldest(t *testing.T) {
+	inner := newGatedWriter()
+	w := NewAsyncWriter(inner, 2, OverflowDropOldest)
+
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		_, err := w.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, w.Dropped(), int64(2))
+
+	close(inner.gate)
+	require.NoError(t, w.Close())
+
+	written := inner.written()
+	require.Equal(t, int64(5), int64(len(written))+w.Dropped())
+	// The newest messages survive.
+	require.Equal(t, []string{"d", "e"}, written[len(written)-2:])
+}
+
+func TestAsyncWriter_SyncDrainsQueue(t *testing.T) {
+	inner := newGatedWriter()
+	close(inner.gate)
+	w := NewAsyncWriter(inner, 100, OverflowBlock)
+
+	for i := 0; i < 50; i++ {
+		_, err := w.Write([]byte("x"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Sync())
+	require.Len(t, inner.written(), 50)
+	require.Equal(t, 0, w.QueueSize())
+
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close())
+
+	_, err := w.Write([]byte("late"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), w.Dropped())
+	require.NoError(t, w.Sync())
+}
+
+func TestAsyncWriter_CloseStalled(t *testing.T) {
+	inner := newGatedWriter()
+	defer close(inner.gate)
+	w := NewAsyncWriter(inner, 2, OverflowBlock)
+
+	// The write loop takes "a" and blocks, "b" and "c" fill the queue, "d" waits for a slot.
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := w.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		_, _ = w.Write([]byte("d"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.Error(t, w.CloseContext(ctx))
+	require.Less(t, time.Since(start), time.Second)
+
+	<-blocked
+	require.Equal(t, int64(3), w.Dropped())
+	require.Empty(t, inner.written())
+}
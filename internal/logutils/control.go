@@ -0,0 +1,236 @@
+package logutils
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ClientKeyField is the field that identifies the client (fairness key) a logger belongs to.
+const ClientKeyField = "client_host"
+
+// SamplingConfig mirrors the arguments of zapcore.NewSamplerWithOptions:
+// within every Tick the First entries with a given level and message are logged,
+// and after that every Thereafter-th one. First == 0 disables sampling.
+type SamplingConfig struct {
+	Tick       time.Duration
+	First      int
+	Thereafter int
+}
+
+func (c SamplingConfig) Validate() error {
+	if c.First < 0 || c.Thereafter < 0 {
+		return fmt.Errorf("sampling first and thereafter should not be negative")
+	}
+	if c.First > 0 && c.Tick <= 0 {
+		return fmt.Errorf("sampling tick should be positive")
+	}
+	return nil
+}
+
+// LogControl holds the logger settings that can be changed at runtime.
+type LogControl struct {
+	level    zap.AtomicLevel
+	sampling atomic.Pointer[SamplingConfig]
+	counts   *sampleCounters
+
+	debugMu      sync.RWMutex
+	nDebugged    atomic.Int64
+	debugClients map[string]time.Time
+}
+
+func NewLogControl(level zapcore.Level, sampling SamplingConfig) (*LogControl, error) {
+	if err := sampling.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &LogControl{
+		level:        zap.NewAtomicLevelAt(level),
+		counts:       &sampleCounters{},
+		debugClients: make(map[string]time.Time),
+	}
+	c.sampling.Store(&sampling)
+	return c, nil
+}
+
+func (c *LogControl) Level() zap.AtomicLevel {
+	return c.level
+}
+
+func (c *LogControl) Sampling() SamplingConfig {
+	return *c.sampling.Load()
+}
+
+func (c *LogControl) SetSampling(sampling SamplingConfig) error {
+	if err := sampling.Validate(); err != nil {
+		return err
+	}
+	c.sampling.Store(&sampling)
+	return nil
+}
+
+// DebugClient logs everything (any level, unsampled) for loggers of client key until d passes.
+// A non-positive d stops debugging the client.
+func (c *LogControl) DebugClient(key string, d time.Duration) {
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+
+	if d <= 0 {
+		delete(c.debugClients, key)
+	} else {
+		c.debugClients[key] = time.Now().Add(d)
+	}
+	c.nDebugged.Store(int64(len(c.debugClients)))
+}
+
+// DebuggedClients returns the clients being debugged and when their sessions expire.
+func (c *LogControl) DebuggedClients() map[string]time.Time {
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+
+	c.expireDebugSessions(time.Now())
+
+	output := make(map[string]time.Time, len(c.debugClients))
+	for key, until := range c.debugClients {
+		output[key] = until
+	}
+	return output
+}
+
+func (c *LogControl) expireDebugSessions(now time.Time) {
+	for key, until := range c.debugClients {
+		if now.After(until) {
+			delete(c.debugClients, key)
+		}
+	}
+	c.nDebugged.Store(int64(len(c.debugClients)))
+}
+
+func (c *LogControl) isDebugged(key string) bool {
+	if key == "" || c.nDebugged.Load() == 0 {
+		return false
+	}
+
+	c.debugMu.RLock()
+	until, ok := c.debugClients[key]
+	c.debugMu.RUnlock()
+
+	if ok && time.Now().After(until) {
+		c.debugMu.Lock()
+		c.expireDebugSessions(time.Now())
+		c.debugMu.Unlock()
+		return false
+	}
+	return ok
+}
+
+func (c *LogControl) sample(ent zapcore.Entry) bool {
+	sampling := c.sampling.Load()
+	if sampling.First <= 0 {
+		return true
+	}
+
+	n := c.counts.get(ent.Level, ent.Message).incCheckReset(ent.Time, sampling.Tick)
+	if n <= uint64(sampling.First) {
+		return true
+	}
+	return sampling.Thereafter > 0 && (n-uint64(sampling.First))%uint64(sampling.Thereafter) == 0
+}
+
+// controlledCore applies the level, sampling and per-client debugging of a LogControl
+// on top of a core that accepts every level.
+type controlledCore struct {
+	zapcore.Core
+
+	control   *LogControl
+	clientKey string
+}
+
+func (c *controlledCore) Enabled(level zapcore.Level) bool {
+	return c.control.level.Enabled(level) || c.control.nDebugged.Load() != 0
+}
+
+func (c *controlledCore) With(fields []zapcore.Field) zapcore.Core {
+	clientKey := c.clientKey
+	for _, f := range fields {
+		if f.Key == ClientKeyField && f.Type == zapcore.StringType {
+			clientKey = f.String
+		}
+	}
+	return &controlledCore{
+		Core:      c.Core.With(fields),
+		control:   c.control,
+		clientKey: clientKey,
+	}
+}
+
+func (c *controlledCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.control.isDebugged(c.clientKey) {
+		return c.Core.Check(ent, ce)
+	}
+	if !c.control.level.Enabled(ent.Level) {
+		return ce
+	}
+	if !c.control.sample(ent) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// sampleCounters follows the layout of zap's sampler: a fixed table of counters per level,
+// indexed by the message hash.
+const (
+	countersPerLevel = 4096
+	nLevels          = int(zapcore.FatalLevel - zapcore.DebugLevel + 1)
+)
+
+type sampleCounters [nLevels][countersPerLevel]sampleCounter
+
+func (cs *sampleCounters) get(level zapcore.Level, message string) *sampleCounter {
+	i := int(level - zapcore.DebugLevel)
+	if i < 0 || i >= nLevels {
+		i = nLevels - 1
+	}
+	return &cs[i][fnv32a(message)%countersPerLevel]
+}
+
+type sampleCounter struct {
+	resetAt atomic.Int64
+	counter atomic.Uint64
+}
+
+func (c *sampleCounter) incCheckReset(t time.Time, tick time.Duration) uint64 {
+	tn := t.UnixNano()
+	resetAfter := c.resetAt.Load()
+	if resetAfter > tn {
+		return c.counter.Add(1)
+	}
+
+	c.counter.Store(1)
+
+	newResetAfter := tn + tick.Nanoseconds()
+	if !c.resetAt.CompareAndSwap(resetAfter, newResetAfter) {
+		// We raced with another goroutine trying to reset, and it also reset
+		// the counter to 1, so we need to reincrement the counter.
+		return c.counter.Add(1)
+	}
+
+	return 1
+}
+
+func fnv32a(s string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	hash := uint32(offset32)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= prime32
+	}
+	return hash
+}
@@ -0,0 +1,109 @@
+package logutils
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := strings.TrimSpace(b.buf.String())
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func newTestLogger(t *testing.T, level zapcore.Level, sampling SamplingConfig) (*zap.Logger, *LogControl, *syncBuffer) {
+	control, err := NewLogControl(level, sampling)
+	require.NoError(t, err)
+
+	buf := &syncBuffer{}
+	logger, err := NewLogger(zapcore.AddSync(buf), nil, FormatJSON, control)
+	require.NoError(t, err)
+	return logger, control, buf
+}
+
+func TestLogControl_Level(t *testing.T) {
+	logger, control, buf := newTestLogger(t, zapcore.InfoLevel, SamplingConfig{})
+
+	logger.Debug("hidden")
+	logger.Info("shown")
+	require.Len(t, buf.lines(), 1)
+
+	control.Level().SetLevel(zapcore.DebugLevel)
+	logger.Debug("shown")
+	require.Len(t, buf.lines(), 2)
+
+	control.Level().SetLevel(zapcore.WarnLevel)
+	logger.Info("hidden")
+	require.Len(t, buf.lines(), 2)
+}
+
+func TestLogControl_Sampling(t *testing.T) {
+	logger, control, buf := newTestLogger(t, zapcore.InfoLevel, SamplingConfig{Tick: time.Hour, First: 2, Thereafter: 3})
+
+	for i := 0; i < 8; i++ {
+		logger.Info("repeated")
+	}
+	// 1, 2, then every third: 5, 8.
+	require.Len(t, buf.lines(), 4)
+
+	require.NoError(t, control.SetSampling(SamplingConfig{}))
+	for i := 0; i < 5; i++ {
+		logger.Info("repeated")
+	}
+	require.Len(t, buf.lines(), 9)
+
+	require.Error(t, control.SetSampling(SamplingConfig{First: 1}))
+}
+
+func TestLogControl_DebugClient(t *testing.T) {
+	logger, control, buf := newTestLogger(t, zapcore.InfoLevel, SamplingConfig{Tick: time.Hour, First: 1})
+
+	debugged := logger.With(zap.String(ClientKeyField, "10.0.0.1"))
+	other := logger.With(zap.String(ClientKeyField, "10.0.0.2"))
+
+	control.DebugClient("10.0.0.1", time.Hour)
+	require.Contains(t, control.DebuggedClients(), "10.0.0.1")
+
+	for i := 0; i < 3; i++ {
+		debugged.Debug("details")
+		other.Debug("details")
+		other.Info("summary")
+	}
+
+	lines := buf.lines()
+	require.Len(t, lines, 4)
+	require.Equal(t, 3, strings.Count(strings.Join(lines, "\n"), "10.0.0.1"))
+
+	control.DebugClient("10.0.0.1", 0)
+	debugged.Debug("details")
+	require.Len(t, buf.lines(), 4)
+	require.Empty(t, control.DebuggedClients())
+
+	control.DebugClient("10.0.0.1", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	debugged.Debug("details")
+	require.Len(t, buf.lines(), 4)
+	require.Empty(t, control.DebuggedClients())
+}
@@ -1,73 +1,150 @@
 package logutils
 
 import (
+	"context"
+	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 )
 
-func NewLogger(options ...zap.Option) (*zap.Logger, func() int, error) {
-	// Exists infinitely, no ws.Stop() call
-	var ws zapcore.WriteSyncer = os.Stdout
+type Format string
 
-	ws = &zapcore.BufferedWriteSyncer{
+const (
+	FormatConsole Format = "console"
+	FormatJSON    Format = "json"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatConsole, FormatJSON:
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("unknown log format %q", s)
+}
+
+// Output is the buffered asynchronous writer shared by all loggers.
+type Output struct {
+	*AsyncWriteSyncer
+
+	buffered *zapcore.BufferedWriteSyncer
+}
+
+func NewOutput(ws zapcore.WriteSyncer, queueSize int, policy OverflowPolicy) *Output {
+	buffered := &zapcore.BufferedWriteSyncer{
 		WS:            ws,
 		Size:          1024 * 1024,
 		FlushInterval: time.Second * 10,
 	}
 
-	s, getQueueSize := NewAsyncWriter(ws, 1000)
-	ws = zapcore.AddSync(s)
-
-	encoderConfig := zapcore.EncoderConfig{
-		TimeKey:        "T",
-		LevelKey:       "L",
-		NameKey:        "N",
-		CallerKey:      "C",
-		FunctionKey:    zapcore.OmitKey,
-		MessageKey:     "M",
-		StacktraceKey:  "S",
-		LineEnding:     zapcore.DefaultLineEnding,
-		EncodeLevel:    zapcore.CapitalLevelEncoder,
-		EncodeTime:     zapcore.ISO8601TimeEncoder,
-		EncodeDuration: zapcore.StringDurationEncoder,
+	return &Output{
+		AsyncWriteSyncer: NewAsyncWriter(buffered, queueSize, policy),
+		buffered:         buffered,
 	}
+}
 
-	// Build the core with the buffered writer
-	core := zapcore.NewCore(
-		zapcore.NewConsoleEncoder(encoderConfig),
-		ws,
-		zap.NewAtomicLevelAt(zap.InfoLevel),
-	)
+// Close drains the queue, flushes the buffer and stops its flushing goroutine.
+func (o *Output) Close() error {
+	return o.CloseContext(context.Background())
+}
 
-	core = zapcore.NewSamplerWithOptions(
-		core,
-		time.Second,
-		10,
-		10,
-	)
+// CloseContext is Close that gives up when ctx is done, see AsyncWriteSyncer.CloseContext.
+func (o *Output) CloseContext(ctx context.Context) error {
+	err := o.AsyncWriteSyncer.CloseContext(ctx)
+	if err != nil {
+		return err
+	}
+	return runWithContext(ctx, o.buffered.Stop)
+}
+
+func encoderConfig(format Format) (zapcore.EncoderConfig, error) {
+	switch format {
+	case FormatConsole:
+		return zapcore.EncoderConfig{
+			TimeKey:        "T",
+			LevelKey:       "L",
+			NameKey:        "N",
+			CallerKey:      "C",
+			FunctionKey:    zapcore.OmitKey,
+			MessageKey:     "M",
+			StacktraceKey:  "S",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeLevel:    zapcore.CapitalLevelEncoder,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.StringDurationEncoder,
+		}, nil
+	case FormatJSON:
+		// The key set is part of the documented log schema (see README), keep it stable.
+		return zapcore.EncoderConfig{
+			TimeKey:        "ts",
+			LevelKey:       "level",
+			NameKey:        "logger",
+			CallerKey:      "caller",
+			FunctionKey:    zapcore.OmitKey,
+			MessageKey:     "msg",
+			StacktraceKey:  "stacktrace",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeLevel:    zapcore.LowercaseLevelEncoder,
+			EncodeTime:     zapcore.RFC3339NanoTimeEncoder,
+			EncodeDuration: zapcore.SecondsDurationEncoder,
+			EncodeCaller:   zapcore.ShortCallerEncoder,
+		}, nil
+	}
+	return zapcore.EncoderConfig{}, fmt.Errorf("unknown log format %q", format)
+}
+
+func newEncoder(format Format, config zapcore.EncoderConfig) zapcore.Encoder {
+	if format == FormatJSON {
+		return zapcore.NewJSONEncoder(config)
+	}
+	return zapcore.NewConsoleEncoder(config)
+}
+
+// NewLogger builds a logger whose level and sampling are governed by control.
+// It writes to ws, to syslog, or to both; either may be nil.
+func NewLogger(ws zapcore.WriteSyncer, syslog *SyslogOutput, format Format, control *LogControl, options ...zap.Option) (*zap.Logger, error) {
+	config, err := encoderConfig(format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the cores with the buffered writers, filtering is done by controlledCore
+	var cores []zapcore.Core
+	if ws != nil {
+		cores = append(cores, zapcore.NewCore(
+			newEncoder(format, config),
+			ws,
+			zap.NewAtomicLevelAt(zap.DebugLevel),
+		))
+	}
+	if syslog != nil {
+		cores = append(cores, syslog.newCore(format, config))
+	}
+	if len(cores) == 0 {
+		return nil, fmt.Errorf("logger needs at least one output")
+	}
+	core := zapcore.NewTee(cores...)
 
 	// Build and return the logger
-	return zap.New(core, options...), getQueueSize, nil
+	return zap.New(&controlledCore{Core: core, control: control}, options...), nil
 }
 
-func LogHttpRequest(logger *zap.Logger, r *http.Request) {
+func LogHttpRequest(logger *zap.Logger, r *http.Request, policy *RedactionPolicy) {
 	headers := make([]string, 0, len(r.Header))
 	for name, values := range r.Header {
 		for _, value := range values {
-			headers = append(headers, name+": "+value)
+			headers = append(headers, name+": "+policy.Header(name, value))
 		}
 	}
 
 	logger.Info("Got request",
 		zap.String("method", r.Method),
-		zap.String("url", r.URL.String()),
+		zap.String("url", policy.URL(r.URL.String())),
 		zap.String("host", r.Host),
 		zap.String("client_addr", r.RemoteAddr),
-		zap.String("user_agent", r.UserAgent()),
+		zap.String("user_agent", policy.Header("User-Agent", r.UserAgent())),
 		zap.String("headers", strings.Join(headers, ", ")),
 	)
 }
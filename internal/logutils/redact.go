@@ -0,0 +1,167 @@
+package logutils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type RedactionMode string
+
+const (
+	RedactMask RedactionMode = "mask"
+	RedactHash RedactionMode = "hash"
+)
+
+const redactedValue = "[REDACTED]"
+
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+func ParseRedactionMode(s string) (RedactionMode, error) {
+	switch RedactionMode(s) {
+	case RedactMask, RedactHash:
+		return RedactionMode(s), nil
+	}
+	return "", fmt.Errorf("unknown redaction mode %q", s)
+}
+
+// RedactionPolicy decides how header values and URLs appear in logs.
+// A nil *RedactionPolicy logs everything verbatim.
+type RedactionPolicy struct {
+	mode RedactionMode
+	// hashKey keys the HMAC of hash mode, so that logged values can not be brute-forced without it.
+	hashKey []byte
+
+	// In allow-list mode every header not in allowed is redacted and denied is ignored.
+	allowList bool
+	allowed   map[string]struct{}
+	denied    map[string]struct{}
+
+	// Zero means no limit.
+	maxURLLength int
+	// Negative means no limit, zero drops the query string entirely.
+	maxQueryLength int
+}
+
+type RedactionConfig struct {
+	Mode           RedactionMode
+	DenyHeaders    []string
+	AllowHeaders   []string
+	MaxURLLength   int
+	MaxQueryLength int
+	// HashKey is the HMAC key of hash mode. A random key is generated if it is empty, so hashes
+	// only correlate within the process.
+	HashKey []byte
+}
+
+func NewRedactionPolicy(cfg RedactionConfig) *RedactionPolicy {
+	p := &RedactionPolicy{
+		mode:           cfg.Mode,
+		allowList:      len(cfg.AllowHeaders) != 0,
+		allowed:        canonicalHeaderSet(cfg.AllowHeaders),
+		denied:         canonicalHeaderSet(cfg.DenyHeaders),
+		maxURLLength:   cfg.MaxURLLength,
+		maxQueryLength: cfg.MaxQueryLength,
+	}
+	if p.mode == "" {
+		p.mode = RedactMask
+	}
+	p.hashKey = cfg.HashKey
+	if p.mode == RedactHash && len(p.hashKey) == 0 {
+		p.hashKey = make([]byte, 32)
+		if _, err := rand.Read(p.hashKey); err != nil {
+			panic(fmt.Sprintf("failed to generate the redaction hash key: %s", err))
+		}
+	}
+	return p
+}
+
+func canonicalHeaderSet(names []string) map[string]struct{} {
+	output := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		output[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+	return output
+}
+
+func (p *RedactionPolicy) isRedacted(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if p.allowList {
+		_, ok := p.allowed[name]
+		return !ok
+	}
+	_, ok := p.denied[name]
+	return ok
+}
+
+func (p *RedactionPolicy) redact(value string) string {
+	if p.mode == RedactHash {
+		mac := hmac.New(sha256.New, p.hashKey)
+		mac.Write([]byte(value))
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return redactedValue
+}
+
+// Header returns the loggable representation of a header value.
+func (p *RedactionPolicy) Header(name, value string) string {
+	if p == nil || !p.isRedacted(name) {
+		return value
+	}
+	return p.redact(value)
+}
+
+// URL returns the loggable representation of a request URL.
+func (p *RedactionPolicy) URL(u string) string {
+	if p == nil {
+		return u
+	}
+
+	if p.maxQueryLength >= 0 {
+		if i := strings.IndexByte(u, '?'); i >= 0 {
+			query := u[i+1:]
+			u = u[:i]
+			if p.maxQueryLength > 0 {
+				u += "?" + truncate(query, p.maxQueryLength)
+			}
+		}
+	}
+
+	if p.maxURLLength > 0 {
+		u = truncate(u, p.maxURLLength)
+	}
+	return u
+}
+
+// Error returns err.Error() with the URL of a wrapped *url.Error passed through URL.
+func (p *RedactionPolicy) Error(err error) string {
+	var urlErr *url.Error
+	if p == nil || !errors.As(err, &urlErr) {
+		return err.Error()
+	}
+	redacted := *urlErr
+	redacted.URL = p.URL(urlErr.URL)
+	return redacted.Error()
+}
+
+func truncate(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	return s[:maxLength] + "..."
+}
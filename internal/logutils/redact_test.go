@@ -0,0 +1,73 @@
+package logutils
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactionPolicy_DenyList(t *testing.T) {
+	p := NewRedactionPolicy(RedactionConfig{DenyHeaders: DefaultRedactedHeaders, MaxQueryLength: -1})
+
+	require.Equal(t, redactedValue, p.Header("proxy-authorization", "Basic dXNlcjpwYXNz"))
+	require.Equal(t, redactedValue, p.Header("Cookie", "session=secret"))
+	require.Equal(t, "curl/8.0", p.Header("User-Agent", "curl/8.0"))
+}
+
+func TestRedactionPolicy_AllowList(t *testing.T) {
+	p := NewRedactionPolicy(RedactionConfig{
+		DenyHeaders:    DefaultRedactedHeaders,
+		AllowHeaders:   []string{"user-agent", " Accept "},
+		MaxQueryLength: -1,
+	})
+
+	require.Equal(t, "curl/8.0", p.Header("User-Agent", "curl/8.0"))
+	require.Equal(t, "*/*", p.Header("Accept", "*/*"))
+	require.Equal(t, redactedValue, p.Header("X-Api-Key", "secret"))
+}
+
+func TestRedactionPolicy_Hash(t *testing.T) {
+	p := NewRedactionPolicy(RedactionConfig{Mode: RedactHash, DenyHeaders: []string{"Cookie"}, MaxQueryLength: -1})
+
+	first := p.Header("Cookie", "session=secret")
+	require.True(t, strings.HasPrefix(first, "hmac-sha256:"))
+	require.NotContains(t, first, "secret")
+	require.Equal(t, first, p.Header("Cookie", "session=secret"))
+	require.NotEqual(t, first, p.Header("Cookie", "session=other"))
+
+	// Every process has a key of its own unless one is configured.
+	other := NewRedactionPolicy(RedactionConfig{Mode: RedactHash, DenyHeaders: []string{"Cookie"}, MaxQueryLength: -1})
+	require.NotEqual(t, first, other.Header("Cookie", "session=secret"))
+
+	key := []byte("configured key")
+	keyed := NewRedactionPolicy(RedactionConfig{Mode: RedactHash, DenyHeaders: []string{"Cookie"}, HashKey: key})
+	restarted := NewRedactionPolicy(RedactionConfig{Mode: RedactHash, DenyHeaders: []string{"Cookie"}, HashKey: key})
+	require.Equal(t, keyed.Header("Cookie", "session=secret"), restarted.Header("Cookie", "session=secret"))
+}
+
+func TestRedactionPolicy_URL(t *testing.T) {
+	u := "http://example.com/path?token=secret"
+
+	require.Equal(t, u, NewRedactionPolicy(RedactionConfig{MaxQueryLength: -1}).URL(u))
+	require.Equal(t, "http://example.com/path", NewRedactionPolicy(RedactionConfig{MaxQueryLength: 0}).URL(u))
+	require.Equal(t, "http://example.com/path?tok...", NewRedactionPolicy(RedactionConfig{MaxQueryLength: 3}).URL(u))
+	require.Equal(t, "http://exa...", NewRedactionPolicy(RedactionConfig{MaxURLLength: 10, MaxQueryLength: -1}).URL(u))
+}
+
+func TestRedactionPolicy_Error(t *testing.T) {
+	p := NewRedactionPolicy(RedactionConfig{MaxQueryLength: 0})
+
+	err := &url.Error{Op: "Get", URL: "http://example.com/?token=secret", Err: errors.New("timeout")}
+	require.NotContains(t, p.Error(err), "secret")
+	require.Equal(t, "plain", p.Error(errors.New("plain")))
+}
+
+func TestRedactionPolicy_Nil(t *testing.T) {
+	var p *RedactionPolicy
+
+	require.Equal(t, "secret", p.Header("Cookie", "secret"))
+	require.Equal(t, "http://example.com/?a=b", p.URL("http://example.com/?a=b"))
+}
@@ -0,0 +1,311 @@
+package logutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogSDID is the structured data element carrying the request fields. 32473 is the
+// enterprise number reserved for documentation (RFC 5612).
+const syslogSDID = "fairp@32473"
+
+const syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+func ParseSyslogFacility(s string) (int, error) {
+	facility, ok := syslogFacilities[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", s)
+	}
+	return facility, nil
+}
+
+// SyslogConfig describes where and how RFC 5424 messages are sent.
+type SyslogConfig struct {
+	// Network is udp, tcp or unixgram.
+	Network  string
+	Addr     string
+	Facility int
+	AppName  string
+	// Hostname defaults to os.Hostname.
+	Hostname string
+}
+
+// ParseSyslogAddr splits network:address, e.g. unixgram:/dev/log or udp:127.0.0.1:514.
+func ParseSyslogAddr(s string) (network string, addr string, err error) {
+	network, addr, ok := strings.Cut(s, ":")
+	if !ok || addr == "" {
+		return "", "", fmt.Errorf("invalid syslog address %q, expected network:address", s)
+	}
+	switch network {
+	case "udp", "tcp", "unixgram":
+		return network, addr, nil
+	}
+	return "", "", fmt.Errorf("unknown syslog network %q, expected udp, tcp or unixgram", network)
+}
+
+// SyslogOutput sends log entries to a syslog server from a background goroutine,
+// one message per write.
+type SyslogOutput struct {
+	*AsyncWriteSyncer
+
+	config SyslogConfig
+	conn   *syslogConn
+}
+
+func NewSyslogOutput(config SyslogConfig, queueSize int, policy OverflowPolicy) (*SyslogOutput, error) {
+	if config.Hostname == "" {
+		config.Hostname, _ = os.Hostname()
+	}
+
+	conn := &syslogConn{network: config.Network, addr: config.Addr}
+	if err := conn.dial(); err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog %s:%s: %s", config.Network, config.Addr, err)
+	}
+
+	return &SyslogOutput{
+		AsyncWriteSyncer: NewAsyncWriter(conn, queueSize, policy),
+		config:           config,
+		conn:             conn,
+	}, nil
+}
+
+// Close sends everything queued and closes the connection.
+func (o *SyslogOutput) Close() error {
+	return o.CloseContext(context.Background())
+}
+
+// CloseContext is Close that gives up sending when ctx is done, see AsyncWriteSyncer.CloseContext.
+func (o *SyslogOutput) CloseContext(ctx context.Context) error {
+	err := o.AsyncWriteSyncer.CloseContext(ctx)
+	if closeErr := o.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (o *SyslogOutput) newCore(format Format, config zapcore.EncoderConfig) zapcore.Core {
+	// Time and level are part of the syslog header.
+	config.TimeKey = zapcore.OmitKey
+	config.LevelKey = zapcore.OmitKey
+
+	return &syslogCore{
+		LevelEnabler: zapcore.DebugLevel,
+		encoder:      newEncoder(format, config),
+		output:       o,
+		header:       syslogHeaderFields(o.config),
+	}
+}
+
+// syslogHeaderFields returns the constant part of the header: HOSTNAME APP-NAME PROCID MSGID.
+func syslogHeaderFields(config SyslogConfig) string {
+	return strings.Join([]string{
+		syslogHeaderValue(config.Hostname, 255),
+		syslogHeaderValue(config.AppName, 48),
+		strconv.Itoa(os.Getpid()),
+		"-",
+	}, " ")
+}
+
+// syslogHeaderValue makes s a valid header field: printable ASCII without spaces, at most maxLen long.
+func syslogHeaderValue(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// syslogSeverity maps zap levels to RFC 5424 severities.
+func syslogSeverity(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	case zapcore.DPanicLevel:
+		return 2
+	case zapcore.PanicLevel:
+		return 1
+	}
+	return 0
+}
+
+// syslogCore formats entries as RFC 5424 messages. The trace_id and client fields are
+// copied into a structured data element.
+type syslogCore struct {
+	zapcore.LevelEnabler
+
+	encoder zapcore.Encoder
+	output  *SyslogOutput
+	header  string
+
+	traceID string
+	client  string
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.encoder = c.encoder.Clone()
+	for _, f := range fields {
+		f.AddTo(clone.encoder)
+	}
+	clone.traceID, clone.client = structuredFields(fields, c.traceID, c.client)
+	return &clone
+}
+
+func (c *syslogCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *syslogCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	body, err := c.encoder.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	defer body.Free()
+
+	traceID, client := structuredFields(fields, c.traceID, c.client)
+
+	var msg bytes.Buffer
+	pri := c.output.config.Facility*8 + syslogSeverity(ent.Level)
+	_, _ = fmt.Fprintf(&msg, "<%d>1 %s %s ", pri, ent.Time.Format(syslogTimeLayout), c.header)
+	writeStructuredData(&msg, traceID, client)
+	msg.WriteByte(' ')
+	msg.Write(bytes.TrimSuffix(body.Bytes(), []byte(zapcore.DefaultLineEnding)))
+
+	_, err = c.output.Write(msg.Bytes())
+	return err
+}
+
+func (c *syslogCore) Sync() error {
+	return c.output.Sync()
+}
+
+func structuredFields(fields []zapcore.Field, traceID string, client string) (string, string) {
+	for _, f := range fields {
+		if f.Type != zapcore.StringType {
+			continue
+		}
+		switch f.Key {
+		case "trace_id":
+			traceID = f.String
+		case ClientKeyField:
+			client = f.String
+		}
+	}
+	return traceID, client
+}
+
+func writeStructuredData(buf *bytes.Buffer, traceID string, client string) {
+	if traceID == "" && client == "" {
+		buf.WriteByte('-')
+		return
+	}
+
+	buf.WriteString("[" + syslogSDID)
+	if traceID != "" {
+		buf.WriteString(` trace_id="` + escapeSDParam(traceID) + `"`)
+	}
+	if client != "" {
+		buf.WriteString(` client="` + escapeSDParam(client) + `"`)
+	}
+	buf.WriteByte(']')
+}
+
+var sdParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeSDParam(s string) string {
+	return sdParamEscaper.Replace(s)
+}
+
+// syslogConn writes one message per Write. Messages are framed by octet counting (RFC 6587) over tcp.
+// After a failed write the connection is redialed and the message is retried once.
+type syslogConn struct {
+	network string
+	addr    string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (c *syslogConn) dial() error {
+	conn, err := net.DialTimeout(c.network, c.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+func (c *syslogConn) Write(msg []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The framing is not a part of msg, the caller must not see it in the written length.
+	n := len(msg)
+	if c.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.conn == nil {
+			if err = c.dial(); err != nil {
+				continue
+			}
+		}
+		if _, err = c.conn.Write(msg); err == nil {
+			return n, nil
+		}
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	return 0, err
+}
+
+func (c *syslogConn) Sync() error {
+	return nil
+}
+
+func (c *syslogConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
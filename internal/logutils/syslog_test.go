@@ -0,0 +1,134 @@
+package logutils
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func newSyslogLogger(t *testing.T, network string, addr string) (*zap.Logger, *SyslogOutput) {
+	control, err := NewLogControl(zapcore.DebugLevel, SamplingConfig{})
+	require.NoError(t, err)
+
+	output, err := NewSyslogOutput(SyslogConfig{
+		Network:  network,
+		Addr:     addr,
+		Facility: 16,
+		AppName:  "passer",
+		Hostname: "proxy-1",
+	}, 10, OverflowBlock)
+	require.NoError(t, err)
+
+	logger, err := NewLogger(nil, output, FormatJSON, control)
+	require.NoError(t, err)
+	return logger, output
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	logger, output := newSyslogLogger(t, "udp", conn.LocalAddr().String())
+	logger.With(zap.String("trace_id", "abc"), zap.String(ClientKeyField, `10.0.0.1"]`)).Warn("Tunnel closed", zap.Int("bytes_sent", 5))
+	logger.Debug("plain")
+	require.NoError(t, output.Close())
+
+	buf := make([]byte, 4096)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	pid := strconv.Itoa(os.Getpid())
+
+	// local0 (16) * 8 + warning (4).
+	require.True(t, strings.HasPrefix(msg, "<132>1 "), msg)
+	fields := strings.SplitN(msg, " ", 7)
+	_, err = time.Parse(time.RFC3339Nano, fields[1])
+	require.NoError(t, err)
+	require.Equal(t, []string{"proxy-1", "passer", pid, "-"}, fields[2:6])
+	require.Equal(t, `[fairp@32473 trace_id="abc" client="10.0.0.1\"\]"] {"msg":"Tunnel closed","trace_id":"abc","client_host":"10.0.0.1\"]","bytes_sent":5}`, fields[6])
+
+	n, _, err = conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:n]), "<135>1 "))
+	require.True(t, strings.HasSuffix(string(buf[:n]), ` proxy-1 passer `+pid+` - - {"msg":"plain"}`), string(buf[:n]))
+}
+
+func TestSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	logger, output := newSyslogLogger(t, "tcp", listener.Addr().String())
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	logger.Info("first")
+	logger.Error("second")
+	require.NoError(t, output.Close())
+
+	// Octet counting: "LEN MSG" without delimiters.
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{`<134>1 `, `<131>1 `} {
+		length, err := r.ReadString(' ')
+		require.NoError(t, err)
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		require.NoError(t, err)
+
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(string(msg), expected), string(msg))
+	}
+}
+
+func TestSyslogConn_WriteLength(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	c := &syslogConn{network: "tcp", addr: listener.Addr().String()}
+	defer c.Close()
+
+	n, err := c.Write([]byte("<134>1 msg"))
+	require.NoError(t, err)
+	require.Equal(t, len("<134>1 msg"), n)
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, len("10 <134>1 msg"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "10 <134>1 msg", string(buf))
+}
+
+func TestParseSyslogAddr(t *testing.T) {
+	network, addr, err := ParseSyslogAddr("unixgram:/dev/log")
+	require.NoError(t, err)
+	require.Equal(t, "unixgram", network)
+	require.Equal(t, "/dev/log", addr)
+
+	network, addr, err = ParseSyslogAddr("udp:127.0.0.1:514")
+	require.NoError(t, err)
+	require.Equal(t, "udp", network)
+	require.Equal(t, "127.0.0.1:514", addr)
+
+	_, _, err = ParseSyslogAddr("unix:/dev/log")
+	require.Error(t, err)
+	_, _, err = ParseSyslogAddr("/dev/log")
+	require.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package rate_counter
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+var DefaultHorizons = []time.Duration{time.Second, 10 * time.Second, time.Minute, 5 * time.Minute}
+
+// Rates holds the estimates for a single horizon.
+type Rates struct {
+	Horizon time.Duration
+	// Window is the average rate over the last Horizon (sliding window).
+	Window Rate
+	// EWMA is the exponentially weighted moving average with time constant Horizon.
+	EWMA Rate
+}
+
+// MultiRateWriter is an io.Writer that estimates the writing rate over several horizons at once.
+// Bytes are accumulated into tick-sized buckets. Every completed bucket updates one sliding window
+// and one EWMA per horizon.
+type MultiRateWriter struct {
+	mu sync.Mutex
+
+	tick     time.Duration
+	horizons []time.Duration
+	alphas   []float64
+
+	bucketStart time.Time
+	bucketBytes int64
+
+	// ring holds the byte counts of the last len(ring) completed buckets.
+	ring       []int64
+	ringPos    int
+	ringFilled int
+
+	ewma []float64
+}
+
+var _ io.Writer = (*MultiRateWriter)(nil)
+
+func NewMultiRateWriter(tick time.Duration, horizons []time.Duration) *MultiRateWriter {
+	maxBuckets := 1
+	alphas := make([]float64, len(horizons))
+	for i, horizon := range horizons {
+		buckets := int(horizon / tick)
+		if buckets < 1 {
+			buckets = 1
+		}
+		if buckets > maxBuckets {
+			maxBuckets = buckets
+		}
+		alphas[i] = 1 - math.Exp(-tick.Seconds()/horizon.Seconds())
+	}
+
+	return &MultiRateWriter{
+		tick:        tick,
+		horizons:    horizons,
+		alphas:      alphas,
+		bucketStart: time.Now(),
+		ring:        make([]int64, maxBuckets),
+		ewma:        make([]float64, len(horizons)),
+	}
+}
+
+func (w *MultiRateWriter) Write(p []byte) (n int, err error) {
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.advance(now)
+	w.bucketBytes += int64(len(p))
+
+	return len(p), nil
+}
+
+// advance closes every bucket that ended before now.
+func (w *MultiRateWriter) advance(now time.Time) {
+	elapsed := now.Sub(w.bucketStart)
+	if elapsed < w.tick {
+		return
+	}
+	nBuckets := int64(elapsed / w.tick)
+
+	w.pushBucket(w.bucketBytes)
+	w.bucketBytes = 0
+
+	idle := nBuckets - 1
+	for i := int64(0); i < idle && i < int64(len(w.ring)); i++ {
+		w.ring[w.ringPos] = 0
+		w.ringPos = (w.ringPos + 1) % len(w.ring)
+		if w.ringFilled < len(w.ring) {
+			w.ringFilled++
+		}
+	}
+	if idle > 0 {
+		for i, alpha := range w.alphas {
+			w.ewma[i] *= math.Pow(1-alpha, float64(idle))
+		}
+	}
+
+	w.bucketStart = w.bucketStart.Add(time.Duration(nBuckets) * w.tick)
+}
+
+func (w *MultiRateWriter) pushBucket(bytes int64) {
+	w.ring[w.ringPos] = bytes
+	w.ringPos = (w.ringPos + 1) % len(w.ring)
+	if w.ringFilled < len(w.ring) {
+		w.ringFilled++
+	}
+
+	instant := float64(bytes) / w.tick.Seconds()
+	for i, alpha := range w.alphas {
+		w.ewma[i] += alpha * (instant - w.ewma[i])
+	}
+}
+
+func (w *MultiRateWriter) windowRate(horizon time.Duration) Rate {
+	buckets := int(horizon / w.tick)
+	if buckets < 1 {
+		buckets = 1
+	}
+	if buckets > w.ringFilled {
+		buckets = w.ringFilled
+	}
+	if buckets == 0 {
+		return 0
+	}
+
+	var sum int64
+	for i := 1; i <= buckets; i++ {
+		sum += w.ring[(w.ringPos-i+len(w.ring))%len(w.ring)]
+	}
+	return Rate(float64(sum) / (time.Duration(buckets) * w.tick).Seconds())
+}
+
+// GetRates returns the estimates for every horizon, in the order passed to NewMultiRateWriter.
+func (w *MultiRateWriter) GetRates() []Rates {
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.advance(now)
+
+	output := make([]Rates, len(w.horizons))
+	for i, horizon := range w.horizons {
+		output[i] = Rates{
+			Horizon: horizon,
+			Window:  w.windowRate(horizon),
+			EWMA:    Rate(w.ewma[i]),
+		}
+	}
+	return output
+}
+
+// GetRate returns the rate over the last completed tick, same as RateCountingWriter.GetRate.
+func (w *MultiRateWriter) GetRate() Rate {
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.advance(now)
+	return w.windowRate(w.tick)
+}
@@ -0,0 +1,87 @@
+package rate_counter
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiRateWriter_Window(t *testing.T) {
+	tick := 50 * time.Millisecond
+	w := NewMultiRateWriter(tick, []time.Duration{tick, 4 * tick})
+
+	data := make([]byte, 100)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+
+	rates := w.GetRates()
+	require.Len(t, rates, 2)
+	require.Equal(t, Rate(0), rates[0].Window)
+	require.Equal(t, Rate(0), rates[1].Window)
+
+	time.Sleep(tick + tick/2)
+
+	rates = w.GetRates()
+	perTick := Rate(float64(len(data)) / tick.Seconds())
+	require.InDelta(t, float64(perTick), float64(rates[0].Window), 1e-6)
+	require.Equal(t, tick, rates[0].Horizon)
+	require.Equal(t, 4*tick, rates[1].Horizon)
+	require.Equal(t, rates[0].Window, w.GetRate())
+
+	time.Sleep(6 * tick)
+
+	rates = w.GetRates()
+	require.Equal(t, Rate(0), rates[0].Window)
+	require.Equal(t, Rate(0), rates[1].Window)
+}
+
+func TestMultiRateWriter_EWMA(t *testing.T) {
+	tick := 20 * time.Millisecond
+	w := NewMultiRateWriter(tick, []time.Duration{tick, 50 * tick})
+
+	data := make([]byte, 1000)
+	for i := 0; i < 10; i++ {
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		time.Sleep(tick)
+	}
+
+	rates := w.GetRates()
+	require.Greater(t, float64(rates[0].EWMA), 0.)
+	require.Greater(t, float64(rates[1].EWMA), 0.)
+	// The long horizon reacts slower than the short one.
+	require.Less(t, float64(rates[1].EWMA), float64(rates[0].EWMA))
+
+	time.Sleep(20 * tick)
+
+	decayed := w.GetRates()
+	require.Less(t, float64(decayed[0].EWMA), float64(rates[0].EWMA))
+	require.Less(t, float64(decayed[1].EWMA), float64(rates[1].EWMA))
+}
+
+func TestMultiRateWriter_Concurrent(t *testing.T) {
+	tick := 50 * time.Millisecond
+	w := NewMultiRateWriter(tick, DefaultHorizons)
+
+	data := []byte("test data")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := w.Write(data)
+			require.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			require.Len(t, w.GetRates(), len(DefaultHorizons))
+		}()
+	}
+	wg.Wait()
+
+	time.Sleep(tick + tick/2)
+	require.InDelta(t, float64(len(data)*10)/tick.Seconds(), float64(w.GetRate()), 1e-6)
+}
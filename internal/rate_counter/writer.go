@@ -35,6 +35,12 @@ func NewRateCountingWriter(intervalDuration time.Duration) *RateCountingWriter {
 }
 
 func (r *RateCountingWriter) Write(p []byte) (n int, err error) {
+	r.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Add counts n bytes as written.
+func (r *RateCountingWriter) Add(n int64) {
 	now := time.Now()
 
 	r.mu.Lock()
@@ -47,12 +53,10 @@ func (r *RateCountingWriter) Write(p []byte) (n int, err error) {
 	}
 
 	if now.After(r.lastIntervalFinish) {
-		r.thisIntervalBytes += int64(len(p))
+		r.thisIntervalBytes += n
 	} else {
-		r.lastIntervalBytes += int64(len(p))
+		r.lastIntervalBytes += n
 	}
-
-	return len(p), nil
 }
 
 func (r *RateCountingWriter) GetRate() Rate {
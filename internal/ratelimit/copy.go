@@ -1,12 +1,15 @@
 package ratelimit
 
 import (
+	"context"
 	"io"
 )
 
-func Copy(dst io.Writer, src io.Reader, limiters []Limiter) (written int64, err error) {
+// Copy copies from src to dst, waiting for every limiter before each chunk is written.
+// It stops with the context's cause as soon as ctx is done, even while waiting.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, limiters []Limiter) (written int64, err error) {
 	for _, limiter := range limiters {
-		src = NewRateLimitedReader(src, limiter)
+		src = NewRateLimitedReader(ctx, src, limiter)
 	}
 
 	return io.Copy(dst, src)
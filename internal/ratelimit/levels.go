@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the layer of the limiter stack a wait is attributed to.
+type Level int
+
+const (
+	// LevelHost is the client's own share.
+	LevelHost Level = iota
+	// LevelShared is the pool clients borrow from when their share is exhausted.
+	LevelShared
+	// LevelMain is the total throughput.
+	LevelMain
+
+	numLevels
+)
+
+var Levels = []Level{LevelHost, LevelShared, LevelMain}
+
+func (l Level) String() string {
+	switch l {
+	case LevelHost:
+		return "host"
+	case LevelShared:
+		return "shared"
+	case LevelMain:
+		return "main"
+	}
+	return "unknown"
+}
+
+// WaitObserver is told about every wait attributed to a level.
+type WaitObserver interface {
+	ObserveWait(level Level, d time.Duration)
+}
+
+// LevelTimers accumulates the time spent waiting at every level.
+type LevelTimers struct {
+	timers [numLevels]WaitTimer
+}
+
+func (t *LevelTimers) ObserveWait(level Level, d time.Duration) {
+	t.timers[level].Add(d)
+}
+
+func (t *LevelTimers) Get(level Level) time.Duration {
+	return t.timers[level].Get()
+}
+
+// WaitHistogramBounds are the upper bounds of the WaitHistogram buckets.
+var WaitHistogramBounds = [...]time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// WaitHistogram counts waits per level in the buckets of WaitHistogramBounds.
+type WaitHistogram struct {
+	levels [numLevels]waitHistogram
+}
+
+type waitHistogram struct {
+	// counts has a last bucket for waits above every bound.
+	counts [len(WaitHistogramBounds) + 1]atomic.Int64
+	sum    WaitTimer
+}
+
+func (h *WaitHistogram) ObserveWait(level Level, d time.Duration) {
+	bucket := len(WaitHistogramBounds)
+	for i, bound := range WaitHistogramBounds {
+		if d <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.levels[level].counts[bucket].Add(1)
+	h.levels[level].sum.Add(d)
+}
+
+// Snapshot returns the non-cumulative count of every bucket, the last one counting the waits above every bound,
+// and the total waiting time.
+func (h *WaitHistogram) Snapshot(level Level) ([]int64, time.Duration) {
+	counts := make([]int64, len(WaitHistogramBounds)+1)
+	for i := range counts {
+		counts[i] = h.levels[level].counts[i].Load()
+	}
+	return counts, h.levels[level].sum.Get()
+}
+
+type labeledLimiter struct {
+	Limiter
+	level     Level
+	observers []WaitObserver
+}
+
+// Labeled returns a limiter that attributes the waits it causes to level and reports them to observers.
+// Inside AllOf or FirstOf a wait is attributed to the limiter that had the longest delay.
+func Labeled(inner Limiter, level Level, observers ...WaitObserver) Limiter {
+	return &labeledLimiter{Limiter: inner, level: level, observers: observers}
+}
+
+func (l *labeledLimiter) observe(d time.Duration) {
+	for _, observer := range l.observers {
+		observer.ObserveWait(l.level, d)
+	}
+}
+
+func (l *labeledLimiter) ReserveN(t time.Time, n int) Reservation {
+	return &labeledReservation{Reservation: l.Limiter.ReserveN(t, n), limiter: l}
+}
+
+func (l *labeledLimiter) WaitN(ctx context.Context, n int) error {
+	start := time.Now()
+	err := l.Limiter.WaitN(ctx, n)
+	l.observe(time.Since(start))
+	return err
+}
+
+// attributor is implemented by reservations that report waits to the levels that caused them.
+type attributor interface {
+	// attribute reports waited to the part of the reservation made at t with the longest delay.
+	attribute(t time.Time, waited time.Duration)
+}
+
+func attributeWait(r Reservation, t time.Time, waited time.Duration) {
+	if a, ok := r.(attributor); ok {
+		a.attribute(t, waited)
+	}
+}
+
+type labeledReservation struct {
+	Reservation
+	limiter *labeledLimiter
+}
+
+func (r *labeledReservation) attribute(t time.Time, waited time.Duration) {
+	r.limiter.observe(waited)
+}
+
+func (rs multiReservation) attribute(t time.Time, waited time.Duration) {
+	var slowest Reservation
+	var delay time.Duration
+	for _, r := range rs {
+		if d := r.DelayFrom(t); slowest == nil || d > delay {
+			slowest, delay = r, d
+		}
+	}
+	if slowest != nil {
+		attributeWait(slowest, t, waited)
+	}
+}
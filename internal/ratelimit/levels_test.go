@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestLabeled_AttributesWaitToSlowestLevel(t *testing.T) {
+	timers := &LevelTimers{}
+	histogram := &WaitHistogram{}
+	host := NewBucket(rate.Limit(1000), 10)
+	main := NewBucket(rate.Limit(100), 10)
+	l := AllOf(Labeled(host, LevelHost, timers, histogram), Labeled(main, LevelMain, timers, histogram))
+
+	require.NoError(t, l.WaitN(context.Background(), 10))
+	require.Zero(t, timers.Get(LevelMain))
+
+	// main needs 50ms to refill 5 tokens, host only 5ms. The wait lands in the (50ms, 100ms] bucket.
+	require.NoError(t, l.WaitN(context.Background(), 5))
+	require.GreaterOrEqual(t, timers.Get(LevelMain), 40*time.Millisecond)
+	require.Zero(t, timers.Get(LevelHost))
+
+	counts, sum := histogram.Snapshot(LevelMain)
+	require.Equal(t, []int64{0, 0, 0, 0, 1, 0, 0, 0, 0}, counts)
+	require.Equal(t, timers.Get(LevelMain), sum)
+
+	// Waits outside of combinators are attributed to the label as a whole.
+	shared := Labeled(NewBucket(rate.Limit(100), 10), LevelShared, timers)
+	require.NoError(t, shared.WaitN(context.Background(), 10))
+	require.NoError(t, shared.WaitN(context.Background(), 5))
+	require.GreaterOrEqual(t, timers.Get(LevelShared), 40*time.Millisecond)
+}
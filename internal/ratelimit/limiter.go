@@ -2,43 +2,281 @@ package ratelimit
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type Limiter interface {
 	Burst() int
-	WaitN(ctx context.Context, n int) (err error)
-	AllowN(t time.Time, n int) bool
+	// Tokens is the number of tokens available now.
 	Tokens() float64
+	AllowN(t time.Time, n int) bool
+	// ReserveN takes n tokens at t, possibly in advance. The reservation is not OK
+	// if the tokens can never be granted, e.g. because n exceeds the burst.
+	ReserveN(t time.Time, n int) Reservation
+	WaitN(ctx context.Context, n int) (err error)
 }
 
-type combinedLimiter struct {
-	guaranteed Limiter
-	shared     Limiter
+// Reservation holds tokens taken from one or more limiters. *rate.Reservation implements it.
+type Reservation interface {
+	OK() bool
+	// DelayFrom is how long after t the tokens may be used.
+	DelayFrom(t time.Time) time.Duration
+	// CancelAt returns the tokens that have not been used by t.
+	CancelAt(t time.Time)
 }
 
-func NewCombinedLimiter(guaranteed, shared Limiter) Limiter {
-	return &combinedLimiter{guaranteed: guaranteed, shared: shared}
+// Bucket is a token bucket from golang.org/x/time/rate.
+type Bucket struct {
+	*rate.Limiter
+
+	maxBurst int
+	pacing   Pacing
 }
 
-func (p *combinedLimiter) Burst() int {
-	return p.guaranteed.Burst()
+// Pacing makes a bucket hold at most Slice worth of tokens at its current limit, so data is released
+// in small chunks at the target rate instead of lumps of the max burst. The burst follows SetLimit
+// and is at least MinBurst. A zero Slice disables pacing.
+type Pacing struct {
+	Slice    time.Duration
+	MinBurst int
 }
 
-func (p *combinedLimiter) WaitN(ctx context.Context, n int) (err error) {
-	if p.guaranteed.AllowN(time.Now(), n) {
+func NewBucket(limit rate.Limit, burst int) *Bucket {
+	return NewPacedBucket(limit, burst, Pacing{})
+}
+
+// NewPacedBucket returns a bucket whose burst is scaled with its limit by pacing, up to maxBurst.
+func NewPacedBucket(limit rate.Limit, maxBurst int, pacing Pacing) *Bucket {
+	b := &Bucket{maxBurst: maxBurst, pacing: pacing}
+	b.Limiter = rate.NewLimiter(limit, b.burstFor(limit))
+	return b
+}
+
+func (b *Bucket) burstFor(limit rate.Limit) int {
+	if b.pacing.Slice <= 0 || limit == rate.Inf {
+		return b.maxBurst
+	}
+	burst := int(float64(limit) * b.pacing.Slice.Seconds())
+	return min(max(burst, b.pacing.MinBurst, 1), b.maxBurst)
+}
+
+// SetLimit changes the limit, and the burst if the bucket is paced.
+func (b *Bucket) SetLimit(limit rate.Limit) {
+	b.Limiter.SetLimit(limit)
+	if b.pacing.Slice > 0 {
+		b.Limiter.SetBurst(b.burstFor(limit))
+	}
+}
+
+func (b *Bucket) ReserveN(t time.Time, n int) Reservation {
+	return b.Limiter.ReserveN(t, n)
+}
+
+// WaitReserved implements WaitN with ReserveN: the reservation is cancelled, returning its tokens,
+// if ctx is done before the tokens can be used.
+func WaitReserved(ctx context.Context, limiter Limiter, n int) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	now := time.Now()
+	r := limiter.ReserveN(now, n)
+	if !r.OK() {
+		return fmt.Errorf("ratelimit: wait(n=%d) exceeds limiter's burst %d", n, limiter.Burst())
+	}
+
+	delay := r.DelayFrom(now)
+	if delay == 0 {
 		return nil
 	}
-	if p.shared.Burst() >= n && p.shared.AllowN(time.Now(), n) {
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		r.CancelAt(now)
+		return fmt.Errorf("ratelimit: wait(n=%d) would exceed context deadline", n)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		attributeWait(r, now, time.Since(now))
 		return nil
+	case <-ctx.Done():
+		r.CancelAt(time.Now())
+		attributeWait(r, now, time.Since(now))
+		return ctx.Err()
+	}
+}
+
+type multiReservation []Reservation
+
+func (rs multiReservation) OK() bool {
+	for _, r := range rs {
+		if !r.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs multiReservation) DelayFrom(t time.Time) time.Duration {
+	var delay time.Duration
+	for _, r := range rs {
+		delay = max(delay, r.DelayFrom(t))
+	}
+	return delay
+}
+
+func (rs multiReservation) CancelAt(t time.Time) {
+	for _, r := range rs {
+		r.CancelAt(t)
+	}
+}
+
+type allOfLimiter struct {
+	limiters []Limiter
+}
+
+// AllOf returns a limiter that grants tokens only when every one of limiters does.
+// Tokens are taken from all of them at once; if one refuses, the others get theirs back.
+func AllOf(limiters ...Limiter) Limiter {
+	if len(limiters) == 0 {
+		panic("AllOf needs at least one limiter")
+	}
+	return &allOfLimiter{limiters: limiters}
+}
+
+func (l *allOfLimiter) Burst() int {
+	burst := math.MaxInt
+	for _, limiter := range l.limiters {
+		burst = min(burst, limiter.Burst())
 	}
-	return p.guaranteed.WaitN(ctx, n)
+	return burst
+}
+
+func (l *allOfLimiter) Tokens() float64 {
+	tokens := math.Inf(1)
+	for _, limiter := range l.limiters {
+		tokens = min(tokens, limiter.Tokens())
+	}
+	return tokens
+}
+
+func (l *allOfLimiter) AllowN(t time.Time, n int) bool {
+	r := l.ReserveN(t, n)
+	if r.OK() && r.DelayFrom(t) == 0 {
+		return true
+	}
+	r.CancelAt(t)
+	return false
+}
+
+func (l *allOfLimiter) ReserveN(t time.Time, n int) Reservation {
+	rs := make(multiReservation, 0, len(l.limiters))
+	for _, limiter := range l.limiters {
+		r := limiter.ReserveN(t, n)
+		rs = append(rs, r)
+		if !r.OK() {
+			rs.CancelAt(t)
+			return rs
+		}
+	}
+	return rs
+}
+
+func (l *allOfLimiter) WaitN(ctx context.Context, n int) error {
+	return WaitReserved(ctx, l, n)
+}
+
+type firstOfLimiter struct {
+	limiters []Limiter
+}
+
+// FirstOf returns a limiter that takes tokens from the first of limiters that has them available now,
+// and waits for the first one otherwise. Burst and Tokens are those of the first limiter.
+//
+// FirstOf(guaranteed, shared) lets a connection use its guaranteed share and borrow from a shared pool
+// when the share is exhausted.
+func FirstOf(limiters ...Limiter) Limiter {
+	if len(limiters) == 0 {
+		panic("FirstOf needs at least one limiter")
+	}
+	return &firstOfLimiter{limiters: limiters}
+}
+
+func (l *firstOfLimiter) Burst() int {
+	return l.limiters[0].Burst()
+}
+
+func (l *firstOfLimiter) Tokens() float64 {
+	return l.limiters[0].Tokens()
+}
+
+func (l *firstOfLimiter) AllowN(t time.Time, n int) bool {
+	for _, limiter := range l.limiters {
+		if limiter.Burst() >= n && limiter.AllowN(t, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *firstOfLimiter) ReserveN(t time.Time, n int) Reservation {
+	for _, limiter := range l.limiters {
+		if limiter.Burst() < n {
+			continue
+		}
+		r := limiter.ReserveN(t, n)
+		if r.OK() && r.DelayFrom(t) == 0 {
+			return r
+		}
+		r.CancelAt(t)
+	}
+	return l.limiters[0].ReserveN(t, n)
+}
+
+func (l *firstOfLimiter) WaitN(ctx context.Context, n int) error {
+	return WaitReserved(ctx, l, n)
+}
+
+type weightedLimiter struct {
+	inner  Limiter
+	weight float64
+}
+
+// Weighted returns a limiter that lets weight tokens through for every token of inner:
+// with weight 2 it is twice as fast as inner, with weight 0.5 half as fast.
+func Weighted(inner Limiter, weight float64) Limiter {
+	if weight <= 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		panic(fmt.Sprintf("invalid limiter weight: %v", weight))
+	}
+	return &weightedLimiter{inner: inner, weight: weight}
+}
+
+// cost is the number of inner tokens n tokens take.
+func (l *weightedLimiter) cost(n int) int {
+	return int(math.Ceil(float64(n) / l.weight))
+}
+
+func (l *weightedLimiter) Burst() int {
+	return int(float64(l.inner.Burst()) * l.weight)
+}
+
+func (l *weightedLimiter) Tokens() float64 {
+	return l.inner.Tokens() * l.weight
+}
+
+func (l *weightedLimiter) AllowN(t time.Time, n int) bool {
+	return l.inner.AllowN(t, l.cost(n))
 }
 
-func (p *combinedLimiter) Tokens() float64 {
-	return p.guaranteed.Tokens()
+func (l *weightedLimiter) ReserveN(t time.Time, n int) Reservation {
+	return l.inner.ReserveN(t, l.cost(n))
 }
 
-func (p *combinedLimiter) AllowN(t time.Time, n int) bool {
-	panic("not implemented")
+func (l *weightedLimiter) WaitN(ctx context.Context, n int) error {
+	return l.inner.WaitN(ctx, l.cost(n))
 }
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestAllOf(t *testing.T) {
+	now := time.Now()
+	a := NewBucket(rate.Limit(1), 10)
+	b := NewBucket(rate.Limit(1), 5)
+	l := AllOf(a, b)
+
+	require.Equal(t, 5, l.Burst())
+	require.True(t, l.AllowN(now, 4))
+	require.InDelta(t, 6, a.TokensAt(now), 0.01)
+	require.InDelta(t, 1, b.TokensAt(now), 0.01)
+
+	// b refuses, so a gets its tokens back.
+	require.False(t, l.AllowN(now, 3))
+	require.InDelta(t, 6, a.TokensAt(now), 0.01)
+	require.InDelta(t, 1, b.TokensAt(now), 0.01)
+
+	// More than the burst of b can never be granted.
+	r := l.ReserveN(now, 6)
+	require.False(t, r.OK())
+	require.InDelta(t, 6, a.TokensAt(now), 0.01)
+
+	// A reservation waits for the slowest limiter and can be cancelled.
+	r = l.ReserveN(now, 3)
+	require.True(t, r.OK())
+	require.Equal(t, 2*time.Second, r.DelayFrom(now))
+	r.CancelAt(now)
+	require.InDelta(t, 6, a.TokensAt(now), 0.01)
+	require.InDelta(t, 1, b.TokensAt(now), 0.01)
+}
+
+func TestFirstOf(t *testing.T) {
+	now := time.Now()
+	guaranteed := NewBucket(rate.Limit(1), 4)
+	shared := NewBucket(rate.Limit(1), 10)
+	l := FirstOf(guaranteed, shared)
+
+	require.Equal(t, 4, l.Burst())
+	require.True(t, l.AllowN(now, 4))
+	require.InDelta(t, 0, guaranteed.TokensAt(now), 0.01)
+	require.InDelta(t, 10, shared.TokensAt(now), 0.01)
+
+	// The guaranteed bucket is empty, so the shared one is used.
+	r := l.ReserveN(now, 3)
+	require.True(t, r.OK())
+	require.Equal(t, time.Duration(0), r.DelayFrom(now))
+	require.InDelta(t, 0, guaranteed.TokensAt(now), 0.01)
+	require.InDelta(t, 7, shared.TokensAt(now), 0.01)
+
+	// Neither has enough, so it waits for the guaranteed bucket.
+	require.True(t, shared.AllowN(now, 7))
+	r = l.ReserveN(now, 2)
+	require.True(t, r.OK())
+	require.Equal(t, 2*time.Second, r.DelayFrom(now))
+	require.InDelta(t, -2, guaranteed.TokensAt(now), 0.01)
+	require.InDelta(t, 0, shared.TokensAt(now), 0.01)
+	require.False(t, l.AllowN(now, 1))
+}
+
+func TestWeighted(t *testing.T) {
+	now := time.Now()
+	inner := NewBucket(rate.Limit(10), 10)
+
+	fast := Weighted(inner, 2)
+	require.Equal(t, 20, fast.Burst())
+	require.True(t, fast.AllowN(now, 8))
+	require.InDelta(t, 6, inner.TokensAt(now), 0.01)
+
+	slow := Weighted(inner, 0.5)
+	require.Equal(t, 5, slow.Burst())
+	require.False(t, slow.AllowN(now, 4))
+	require.True(t, slow.AllowN(now, 3))
+	require.InDelta(t, 0, inner.TokensAt(now), 0.01)
+
+	require.Panics(t, func() { Weighted(inner, 0) })
+}
+
+func TestWaitNCancelRefunds(t *testing.T) {
+	bucket := NewBucket(rate.Limit(1), 1)
+	l := AllOf(bucket, NewBucket(rate.Inf, 1))
+	require.NoError(t, l.WaitN(context.Background(), 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	require.ErrorIs(t, l.WaitN(ctx, 1), context.Canceled)
+
+	// The cancelled wait did not keep its token.
+	require.Greater(t, bucket.Tokens(), -0.5)
+
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, l.WaitN(deadline, 1))
+}
+
+func TestPacedBucket(t *testing.T) {
+	b := NewPacedBucket(rate.Limit(1000), 2000, Pacing{Slice: 100 * time.Millisecond, MinBurst: 50})
+	require.Equal(t, 100, b.Burst())
+
+	b.SetLimit(rate.Limit(10))
+	require.Equal(t, 50, b.Burst())
+
+	b.SetLimit(rate.Limit(1e6))
+	require.Equal(t, 2000, b.Burst())
+
+	b.SetLimit(rate.Inf)
+	require.Equal(t, 2000, b.Burst())
+
+	// Without pacing the burst is fixed.
+	b = NewBucket(rate.Limit(1000), 2000)
+	b.SetLimit(rate.Limit(10))
+	require.Equal(t, 2000, b.Burst())
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// PriorityConfig describes the priority classes of a Scheduler and how connections are classified.
+type PriorityConfig struct {
+	Classes []PriorityClassConfig `json:"classes"`
+	// Rules are checked in order, the first match wins.
+	Rules []PriorityRule `json:"rules"`
+	// Default is the class of connections no rule matches, the first class if empty.
+	Default string `json:"default"`
+	// Background is the class of connections whose client opted in to background priority.
+	// The opt-in is ignored if empty.
+	Background string `json:"background"`
+}
+
+type PriorityClassConfig struct {
+	Name string `json:"name"`
+	// Quantum is in KB per round.
+	Quantum int `json:"quantum"`
+}
+
+// PriorityRule matches connections by destination port and domain. Empty lists match everything,
+// but at least one should be set.
+type PriorityRule struct {
+	Class string `json:"class"`
+	Ports []int  `json:"ports"`
+	// Domains match the domain itself and its subdomains. A leading "*." is allowed.
+	Domains []string `json:"domains"`
+}
+
+// LoadPriorityConfig reads the JSON priority classes at path.
+func LoadPriorityConfig(path string) (PriorityConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PriorityConfig{}, fmt.Errorf("failed to read priority classes: %s", err)
+	}
+
+	var config PriorityConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return PriorityConfig{}, fmt.Errorf("failed to parse priority classes %q: %s", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return PriorityConfig{}, fmt.Errorf("invalid priority classes %q: %s", path, err)
+	}
+	return config, nil
+}
+
+func (c *PriorityConfig) Validate() error {
+	if len(c.Classes) == 0 {
+		return fmt.Errorf("no priority classes")
+	}
+
+	names := make(map[string]bool)
+	for _, class := range c.Classes {
+		if class.Name == "" {
+			return fmt.Errorf("class without a name")
+		}
+		if names[class.Name] {
+			return fmt.Errorf("duplicate class %q", class.Name)
+		}
+		if class.Quantum <= 0 {
+			return fmt.Errorf("class %q: quantum should be positive", class.Name)
+		}
+		names[class.Name] = true
+	}
+
+	for i, rule := range c.Rules {
+		if !names[rule.Class] {
+			return fmt.Errorf("rule %d: unknown class %q", i, rule.Class)
+		}
+		if len(rule.Ports) == 0 && len(rule.Domains) == 0 {
+			return fmt.Errorf("rule %d: ports or domains should be set", i)
+		}
+	}
+
+	if c.Default != "" && !names[c.Default] {
+		return fmt.Errorf("unknown default class %q", c.Default)
+	}
+	if c.Background != "" && !names[c.Background] {
+		return fmt.Errorf("unknown background class %q", c.Background)
+	}
+	return nil
+}
+
+// SchedulerClasses returns the classes with quanta in bytes.
+func (c *PriorityConfig) SchedulerClasses() []SchedulerClass {
+	output := make([]SchedulerClass, 0, len(c.Classes))
+	for _, class := range c.Classes {
+		output = append(output, SchedulerClass{Name: class.Name, Quantum: class.Quantum * 1024})
+	}
+	return output
+}
+
+// Classify returns the class of a connection to host:port. background is set if the client opted in.
+func (c *PriorityConfig) Classify(host string, port int, background bool) string {
+	if background && c.Background != "" {
+		return c.Background
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, rule := range c.Rules {
+		if rule.matches(host, port) {
+			return rule.Class
+		}
+	}
+
+	if c.Default != "" {
+		return c.Default
+	}
+	return c.Classes[0].Name
+}
+
+func (r *PriorityRule) matches(host string, port int) bool {
+	if len(r.Ports) != 0 && !slices.Contains(r.Ports, port) {
+		return false
+	}
+	if len(r.Domains) == 0 {
+		return true
+	}
+	for _, domain := range r.Domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(domain, "*.")), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
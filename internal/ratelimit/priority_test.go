@@ -0,0 +1,29 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityConfig_Classify(t *testing.T) {
+	config := PriorityConfig{
+		Classes: []PriorityClassConfig{{Name: "interactive", Quantum: 64}, {Name: "bulk", Quantum: 16}, {Name: "background", Quantum: 1}},
+		Rules: []PriorityRule{
+			{Class: "interactive", Ports: []int{22}},
+			{Class: "bulk", Domains: []string{"*.googlevideo.com", "example.org"}},
+			{Class: "interactive", Ports: []int{443}, Domains: []string{"api.example.org"}},
+		},
+		Background: "background",
+	}
+	require.NoError(t, config.Validate())
+
+	require.Equal(t, "interactive", config.Classify("github.com", 22, false))
+	require.Equal(t, "bulk", config.Classify("rr1.GoogleVideo.com.", 443, false))
+	require.Equal(t, "bulk", config.Classify("api.example.org", 443, false))
+	require.Equal(t, "interactive", config.Classify("notexample.org", 443, false))
+	require.Equal(t, "background", config.Classify("github.com", 22, true))
+
+	config.Rules = append(config.Rules, PriorityRule{Class: "missing", Ports: []int{80}})
+	require.Error(t, config.Validate())
+}
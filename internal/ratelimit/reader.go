@@ -2,40 +2,77 @@ package ratelimit
 
 import (
 	"context"
+	"errors"
 	"io"
 )
 
+// ErrInvalidBurst is returned when a limiter's burst does not allow reading even a single byte.
+var ErrInvalidBurst = errors.New("ratelimit: limiter burst is not positive")
+
 type reader struct {
+	ctx     context.Context
 	inner   io.Reader
 	limiter Limiter
 }
 
-func NewRateLimitedReader(r io.Reader, limiter Limiter) io.Reader {
+// NewRateLimitedReader returns a reader that reads at most a burst at a time and waits for limiter
+// after every read. Once ctx is done, reads fail with its cause.
+func NewRateLimitedReader(ctx context.Context, r io.Reader, limiter Limiter) io.Reader {
 	return &reader{
+		ctx:     ctx,
 		inner:   r,
 		limiter: limiter,
 	}
 }
 
 func (r *reader) Read(p []byte) (n int, err error) {
-	toRead := len(p)
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
 
 	burst := r.limiter.Burst()
-
-	if toRead > burst {
-		toRead = burst
+	if burst <= 0 {
+		return 0, ErrInvalidBurst
 	}
-
-	if toRead <= 0 {
-		panic("invalid Read")
+	if len(p) > burst {
+		p = p[:burst]
 	}
 
-	n, err = r.inner.Read(p[:toRead])
+	n, err = r.inner.Read(p)
 
-	waitErr := r.limiter.WaitN(context.Background(), n)
-	if waitErr != nil {
-		panic("invalid limiter.WaitN call")
+	if n > 0 {
+		// The bytes are dropped if the wait fails: the copy is being cancelled.
+		if waitErr := waitN(r.ctx, r.limiter, n); waitErr != nil {
+			return 0, waitErr
+		}
 	}
 
 	return n, err
 }
+
+// waitN waits for n tokens in chunks of at most the current burst, which may have shrunk since the read.
+func waitN(ctx context.Context, limiter Limiter, n int) error {
+	for n > 0 {
+		burst := limiter.Burst()
+		if burst <= 0 {
+			return ErrInvalidBurst
+		}
+
+		chunk := min(n, burst)
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			if limiter.Burst() < chunk {
+				// Reconfigured concurrently, retry with the new burst.
+				continue
+			}
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
@@ -2,9 +2,12 @@ package ratelimit
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
@@ -19,8 +22,8 @@ func testCopy(t *testing.T, smallBurst bool) {
 		burst = 1
 	}
 
-	limiter := rate.NewLimiter(100, burst)
-	ratelimitedReader := NewRateLimitedReader(readerData, limiter)
+	limiter := NewBucket(100, burst)
+	ratelimitedReader := NewRateLimitedReader(context.Background(), readerData, limiter)
 
 	dst := &strings.Builder{}
 	n, err := io.Copy(dst, ratelimitedReader)
@@ -47,7 +50,7 @@ func TestCopy_NoLimiter(t *testing.T) {
 	src := bytes.NewReader(srcContent)
 	dst := &bytes.Buffer{}
 
-	written, err := Copy(dst, src, []Limiter{})
+	written, err := Copy(context.Background(), dst, src, []Limiter{})
 	require.NoError(t, err)
 	require.Equal(t, int64(len(srcContent)), written)
 	require.Equal(t, srcContent, dst.Bytes())
@@ -58,10 +61,10 @@ func TestCopy_SingleLimiter(t *testing.T) {
 	src := bytes.NewReader(srcContent)
 	dst := &bytes.Buffer{}
 
-	limiter := rate.NewLimiter(rate.Limit(10), 10)
+	limiter := NewBucket(rate.Limit(10), 10)
 	limiters := []Limiter{limiter}
 
-	written, err := Copy(dst, src, limiters)
+	written, err := Copy(context.Background(), dst, src, limiters)
 	require.NoError(t, err)
 	require.Equal(t, int64(len(srcContent)), written)
 	require.Equal(t, srcContent, dst.Bytes())
@@ -79,6 +82,61 @@ func TestCopy_Error(t *testing.T) {
 
 	limiters := []Limiter{}
 
-	_, err := Copy(dst, src, limiters)
+	_, err := Copy(context.Background(), dst, src, limiters)
 	require.Error(t, err)
 }
+
+func TestCopy_Cancel(t *testing.T) {
+	src := bytes.NewReader(make([]byte, 100))
+	dst := &bytes.Buffer{}
+
+	// The first byte is free, the second one takes 100 seconds.
+	limiter := NewBucket(rate.Limit(0.01), 1)
+
+	cause := errors.New("killed")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() { cancel(cause) })
+
+	start := time.Now()
+	written, err := Copy(ctx, dst, src, []Limiter{limiter})
+	require.ErrorIs(t, err, cause)
+	require.Equal(t, int64(1), written)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	_, err = Copy(ctx, dst, src, []Limiter{limiter})
+	require.ErrorIs(t, err, cause)
+}
+
+func TestCopy_InvalidBurst(t *testing.T) {
+	src := bytes.NewReader([]byte("test content"))
+	dst := &bytes.Buffer{}
+
+	_, err := Copy(context.Background(), dst, src, []Limiter{NewBucket(rate.Limit(10), 0)})
+	require.ErrorIs(t, err, ErrInvalidBurst)
+}
+
+type shrinkingLimiter struct {
+	*Bucket
+}
+
+// Burst shrinks the burst after every call, as if the limiter was reconfigured between Read and WaitN.
+func (l shrinkingLimiter) Burst() int {
+	burst := l.Bucket.Burst()
+	if burst > 1 {
+		l.Bucket.SetBurst(burst / 2)
+	}
+	return burst
+}
+
+func TestCopy_BurstShrinks(t *testing.T) {
+	srcContent := []byte("test content")
+	src := bytes.NewReader(srcContent)
+	dst := &bytes.Buffer{}
+
+	limiter := shrinkingLimiter{NewBucket(rate.Limit(1e9), 8)}
+
+	written, err := Copy(context.Background(), dst, src, []Limiter{limiter})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(srcContent)), written)
+	require.Equal(t, srcContent, dst.Bytes())
+}
@@ -0,0 +1,189 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SchedulerClass is a priority class of a Scheduler.
+type SchedulerClass struct {
+	Name string
+	// Quantum is the number of tokens the class gets per round while several classes are waiting.
+	Quantum int
+}
+
+// Scheduler shares a limiter between priority classes with deficit round-robin. Waiters of every class
+// are queued, and the queues take turns at the limiter: a class may take up to its quantum per round,
+// plus what it did not use in the previous rounds while it was waiting. A class with little traffic
+// has a short queue, so its waiters are let through without waiting behind bulk classes.
+type Scheduler struct {
+	inner Limiter
+
+	mu      sync.Mutex
+	classes []*schedulerClass
+	byName  map[string]*schedulerClass
+	current int
+	queued  int
+	// busy is set while a dispatched waiter is waiting for inner.
+	busy bool
+}
+
+type schedulerClass struct {
+	SchedulerClass
+	scheduler *Scheduler
+
+	deficit int
+	queue   []*schedulerRequest
+}
+
+type schedulerRequest struct {
+	n     int
+	ready chan struct{}
+}
+
+func NewScheduler(inner Limiter, classes []SchedulerClass) *Scheduler {
+	if len(classes) == 0 {
+		panic("scheduler needs at least one class")
+	}
+
+	s := &Scheduler{
+		inner:  inner,
+		byName: make(map[string]*schedulerClass),
+	}
+	for _, class := range classes {
+		if class.Quantum <= 0 {
+			panic(fmt.Sprintf("invalid quantum of class %q: %d", class.Name, class.Quantum))
+		}
+		c := &schedulerClass{SchedulerClass: class, scheduler: s}
+		s.classes = append(s.classes, c)
+		s.byName[class.Name] = c
+	}
+	return s
+}
+
+// Class returns the limiter of the class with the given name. WaitN is scheduled, the other methods
+// use the inner limiter directly.
+func (s *Scheduler) Class(name string) Limiter {
+	c, ok := s.byName[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown scheduler class %q", name))
+	}
+	return c
+}
+
+// Queued returns the number of waiters of every class.
+func (s *Scheduler) Queued() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	output := make(map[string]int, len(s.classes))
+	for _, c := range s.classes {
+		output[c.Name] = len(c.queue)
+	}
+	return output
+}
+
+func (c *schedulerClass) Burst() int {
+	return c.scheduler.inner.Burst()
+}
+
+func (c *schedulerClass) Tokens() float64 {
+	return c.scheduler.inner.Tokens()
+}
+
+func (c *schedulerClass) AllowN(t time.Time, n int) bool {
+	return c.scheduler.inner.AllowN(t, n)
+}
+
+func (c *schedulerClass) ReserveN(t time.Time, n int) Reservation {
+	return c.scheduler.inner.ReserveN(t, n)
+}
+
+func (c *schedulerClass) WaitN(ctx context.Context, n int) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := c.scheduler
+	req := &schedulerRequest{n: n, ready: make(chan struct{})}
+
+	s.mu.Lock()
+	c.queue = append(c.queue, req)
+	s.queued++
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-req.ready:
+	case <-ctx.Done():
+		s.mu.Lock()
+		removed := c.remove(req)
+		s.mu.Unlock()
+		if !removed {
+			// Dispatched concurrently, pass the turn on.
+			s.release()
+		}
+		return ctx.Err()
+	}
+
+	defer s.release()
+	return s.inner.WaitN(ctx, n)
+}
+
+func (c *schedulerClass) remove(req *schedulerRequest) bool {
+	for i, queued := range c.queue {
+		if queued == req {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			c.scheduler.queued--
+			return true
+		}
+	}
+	return false
+}
+
+// release ends the turn of the dispatched waiter.
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.busy = false
+	s.dispatch()
+}
+
+// dispatch lets the next waiter through unless one is already waiting for inner.
+func (s *Scheduler) dispatch() {
+	if s.busy || s.queued == 0 {
+		return
+	}
+
+	req := s.next()
+	s.queued--
+	s.busy = true
+	close(req.ready)
+}
+
+// next dequeues the next waiter in deficit round-robin order.
+func (s *Scheduler) next() *schedulerRequest {
+	for {
+		c := s.classes[s.current]
+		if len(c.queue) > 0 && c.queue[0].n <= c.deficit {
+			req := c.queue[0]
+			c.queue = c.queue[1:]
+			c.deficit -= req.n
+			if len(c.queue) == 0 {
+				c.deficit = 0
+			}
+			return req
+		}
+		if len(c.queue) == 0 {
+			c.deficit = 0
+		}
+
+		s.current = (s.current + 1) % len(s.classes)
+		if next := s.classes[s.current]; len(next.queue) > 0 {
+			next.deficit += next.Quantum
+		}
+	}
+}
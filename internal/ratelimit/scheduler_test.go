@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// gateLimiter reports every WaitN and blocks it until proceed.
+type gateLimiter struct {
+	Limiter
+	waits   chan int
+	proceed chan struct{}
+}
+
+func (l *gateLimiter) WaitN(ctx context.Context, n int) error {
+	l.waits <- n
+	<-l.proceed
+	return nil
+}
+
+func totalQueued(s *Scheduler) int {
+	total := 0
+	for _, n := range s.Queued() {
+		total += n
+	}
+	return total
+}
+
+func TestScheduler_DeficitRoundRobin(t *testing.T) {
+	inner := &gateLimiter{Limiter: NewBucket(rate.Inf, 100), waits: make(chan int), proceed: make(chan struct{})}
+	s := NewScheduler(inner, []SchedulerClass{{Name: "interactive", Quantum: 20}, {Name: "bulk", Quantum: 10}})
+
+	wg := sync.WaitGroup{}
+	wait := func(class string, n int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, s.Class(class).WaitN(context.Background(), n))
+		}()
+	}
+
+	// The first waiter goes through at once, the others queue up behind it in this order.
+	wait("bulk", 1)
+	require.Equal(t, 1, <-inner.waits)
+	for i, w := range []struct {
+		class string
+		n     int
+	}{{"bulk", 2}, {"bulk", 3}, {"bulk", 4}, {"interactive", 5}, {"interactive", 6}} {
+		wait(w.class, w.n)
+		require.Eventually(t, func() bool { return totalQueued(s) == i+1 }, time.Second, time.Millisecond)
+	}
+
+	// Interactive waiters overtake the bulk backlog.
+	for _, expected := range []int{5, 6, 2, 3, 4} {
+		inner.proceed <- struct{}{}
+		require.Equal(t, expected, <-inner.waits)
+	}
+	inner.proceed <- struct{}{}
+	wg.Wait()
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	inner := &gateLimiter{Limiter: NewBucket(rate.Inf, 100), waits: make(chan int), proceed: make(chan struct{})}
+	s := NewScheduler(inner, []SchedulerClass{{Name: "bulk", Quantum: 10}})
+
+	go func() {
+		_ = s.Class("bulk").WaitN(context.Background(), 1)
+	}()
+	require.Equal(t, 1, <-inner.waits)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- s.Class("bulk").WaitN(ctx, 2)
+	}()
+	require.Eventually(t, func() bool { return totalQueued(s) == 1 }, time.Second, time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-errs, context.Canceled)
+	require.Equal(t, 0, totalQueued(s))
+
+	// The next waiter still gets its turn.
+	inner.proceed <- struct{}{}
+	go func() {
+		_ = s.Class("bulk").WaitN(context.Background(), 3)
+	}()
+	require.Equal(t, 3, <-inner.waits)
+	inner.proceed <- struct{}{}
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// WaitTimer accumulates time spent waiting inside limiters.
+type WaitTimer struct {
+	nanos atomic.Int64
+}
+
+func (t *WaitTimer) Add(d time.Duration) {
+	t.nanos.Add(int64(d))
+}
+
+func (t *WaitTimer) Get() time.Duration {
+	return time.Duration(t.nanos.Load())
+}
+
+// Reset returns the accumulated time and starts over from zero.
+func (t *WaitTimer) Reset() time.Duration {
+	return time.Duration(t.nanos.Swap(0))
+}
+
+type timedLimiter struct {
+	Limiter
+	timers []*WaitTimer
+}
+
+// NewTimedLimiter returns a limiter that adds the duration of every WaitN call to each of timers.
+// Nil timers are ignored.
+func NewTimedLimiter(inner Limiter, timers ...*WaitTimer) Limiter {
+	return &timedLimiter{Limiter: inner, timers: timers}
+}
+
+func (l *timedLimiter) WaitN(ctx context.Context, n int) (err error) {
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		for _, timer := range l.timers {
+			if timer != nil {
+				timer.Add(d)
+			}
+		}
+	}()
+	return l.Limiter.WaitN(ctx, n)
+}
@@ -0,0 +1,247 @@
+package rotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galqiwi/fair-p/internal/utils"
+)
+
+const (
+	archiveStampLayout = "2006-01-02_15:04:05"
+	tmpSuffix          = ".tmp"
+)
+
+// archiveSuffix matches what follows the stamp and the extension in an archive name: the counter that
+// archiveFile adds on collisions and the compression suffixes.
+var archiveSuffix = regexp.MustCompile(`^(\.[0-9]+)?(\.gz(\.tmp)?)?$`)
+
+// compressor gzips archived log files in the background, one at a time and in the order they were
+// rotated, and applies the retention policy after each of them. The list of pending files is unbounded,
+// so Add never blocks the writer when compression falls behind.
+type compressor struct {
+	logPath   string
+	level     int
+	retention RetentionPolicy
+	logger    *log.Logger
+
+	mu      sync.Mutex
+	pending []string
+	closed  bool
+	// wake is signalled when a file is added or the compressor is closed.
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCompressor(logPath string, level int, retention RetentionPolicy, logger *log.Logger) *compressor {
+	c := &compressor{
+		logPath:   logPath,
+		level:     level,
+		retention: retention,
+		logger:    logger,
+		wake:      make(chan struct{}, 1),
+	}
+	c.wg.Add(1)
+	go c.loop()
+	return c
+}
+
+func (c *compressor) loop() {
+	defer c.wg.Done()
+
+	err := applyRetention(c.logPath, c.retention, time.Now(), c.logger)
+	if err != nil {
+		c.logger.Printf("failed to apply retention: %s", err)
+	}
+
+	for {
+		filename, ok := c.next()
+		if !ok {
+			return
+		}
+		err := compressFileInplace(filename, c.level)
+		if err != nil {
+			// The uncompressed file stays on disk and is picked up by recover on the next start.
+			c.logger.Printf("failed to compress %q: %s", filename, err)
+			continue
+		}
+		err = applyRetention(c.logPath, c.retention, time.Now(), c.logger)
+		if err != nil {
+			c.logger.Printf("failed to apply retention: %s", err)
+		}
+	}
+}
+
+// next waits for the next pending file. It returns false once the compressor is closed and every
+// file is done.
+func (c *compressor) next() (string, bool) {
+	for {
+		c.mu.Lock()
+		if len(c.pending) > 0 {
+			filename := c.pending[0]
+			c.pending = c.pending[1:]
+			c.mu.Unlock()
+			return filename, true
+		}
+		closed := c.closed
+		c.mu.Unlock()
+
+		if closed {
+			return "", false
+		}
+		<-c.wake
+	}
+}
+
+func (c *compressor) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *compressor) Add(filename string) {
+	c.mu.Lock()
+	c.pending = append(c.pending, filename)
+	c.mu.Unlock()
+	c.signal()
+}
+
+// Close waits until every pending file is compressed.
+func (c *compressor) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.signal()
+	c.wg.Wait()
+}
+
+// recover removes partially written archives left by a crash and queues the archives that were
+// rotated but not compressed yet.
+func (c *compressor) recover() error {
+	dir := filepath.Dir(c.logPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isArchiveName(c.logPath, name) {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, ".gz"+tmpSuffix):
+			err := os.Remove(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			c.logger.Printf("removed partial archive %q", filepath.Join(dir, name))
+		case !strings.HasSuffix(name, ".gz"):
+			pending = append(pending, name)
+		}
+	}
+
+	// The stamp makes names sort in rotation order.
+	sort.Strings(pending)
+	for _, name := range pending {
+		c.Add(filepath.Join(dir, name))
+	}
+	return nil
+}
+
+// isArchiveName reports whether name was produced by archiveFile for logPath, possibly compressed or
+// being compressed. The whole name is matched, so that archives of a log named <base>_x.log next to
+// <base>.log are not taken for archives of the latter.
+func isArchiveName(logPath string, name string) bool {
+	base := filepath.Base(logPath)
+	ext := filepath.Ext(base)
+	prefix := base[:len(base)-len(ext)] + "_"
+	if !strings.HasPrefix(name, prefix) || len(name) < len(prefix)+len(archiveStampLayout) {
+		return false
+	}
+	stamp := name[len(prefix) : len(prefix)+len(archiveStampLayout)]
+	if _, err := time.Parse(archiveStampLayout, stamp); err != nil {
+		return false
+	}
+	rest := name[len(prefix)+len(archiveStampLayout):]
+	return strings.HasPrefix(rest, ext) && archiveSuffix.MatchString(rest[len(ext):])
+}
+
+// archiveFile renames filename to a unique timestamped name and returns it.
+// The caller is responsible for compressing the result.
+func archiveFile(filename string) (string, error) {
+	stamp := time.Now().Format(archiveStampLayout)
+	ext := filepath.Ext(filename)
+	newNamePrefix := fmt.Sprintf("%s_%s%s", filename[:len(filename)-len(ext)], stamp, ext)
+
+	newName := newNamePrefix
+
+	for i := 1; utils.FileExists(newName) || utils.FileExists(newName+".gz"); i++ {
+		newName = fmt.Sprintf("%s.%v", newNamePrefix, i)
+	}
+
+	err := os.Rename(filename, newName)
+	if err != nil {
+		return "", err
+	}
+
+	return newName, nil
+}
+
+// compressFileInplace replaces filename with filename.gz. The archive is written to a temporary
+// file and renamed only once it is complete, so a crash never leaves a truncated .gz behind.
+func compressFileInplace(filename string, level int) error {
+	sourceFile, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open source file: %v", err)
+	}
+	defer sourceFile.Close()
+
+	destinationFilename := filename + ".gz"
+	tmpFilename := destinationFilename + tmpSuffix
+	destinationFile, err := os.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("could not create destination file: %v", err)
+	}
+	defer func() {
+		destinationFile.Close()
+		if err != nil {
+			os.Remove(tmpFilename)
+		}
+	}()
+
+	gzipWriter, err := gzip.NewWriterLevel(destinationFile, level)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(gzipWriter, sourceFile)
+	if err != nil {
+		return fmt.Errorf("could not copy data to gzip writer: %v", err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return fmt.Errorf("could not finish gzip stream: %v", err)
+	}
+	err = destinationFile.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync destination file: %v", err)
+	}
+
+	err = os.Rename(tmpFilename, destinationFilename)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
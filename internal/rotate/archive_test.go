@@ -0,0 +1,111 @@
+package rotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestCompressor_Recover(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+
+	first := filepath.Join(dir, "passer_2024-01-01_10:00:00.log")
+	second := filepath.Join(dir, "passer_2024-01-01_11:00:00.log")
+	require.NoError(t, os.WriteFile(first, []byte("first\n"), 0644))
+	require.NoError(t, os.WriteFile(second, []byte("second\n"), 0644))
+	// Left by a crash in the middle of compression.
+	require.NoError(t, os.WriteFile(second+".gz"+tmpSuffix, []byte("garbage"), 0644))
+	// Not an archive.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "passer_notes.log"), []byte("keep"), 0644))
+
+	c := newCompressor(logPath, gzip.BestSpeed, RetentionPolicy{}, log.Default())
+	require.NoError(t, c.recover())
+	c.Close()
+
+	require.NoFileExists(t, first)
+	require.NoFileExists(t, second)
+	require.NoFileExists(t, second+".gz"+tmpSuffix)
+	require.FileExists(t, filepath.Join(dir, "passer_notes.log"))
+
+	require.Equal(t, "first\n", readGzip(t, first+".gz"))
+	require.Equal(t, "second\n", readGzip(t, second+".gz"))
+}
+
+func TestCompressor_Retention(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+
+	c := newCompressor(logPath, gzip.DefaultCompression, RetentionPolicy{MaxArchives: 2}, log.Default())
+	for i := 0; i < 4; i++ {
+		require.NoError(t, os.WriteFile(logPath, []byte("line\n"), 0644))
+		archived, err := archiveFile(logPath)
+		require.NoError(t, err)
+		c.Add(archived)
+	}
+	c.Close()
+
+	archives, err := ListArchives(logPath)
+	require.NoError(t, err)
+	require.Len(t, archives, 2)
+}
+
+func TestCompressor_AddDoesNotBlock(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+
+	// Not started yet, as if stuck on a large archive.
+	c := &compressor{
+		logPath: logPath,
+		level:   gzip.BestSpeed,
+		logger:  log.Default(),
+		wake:    make(chan struct{}, 1),
+	}
+
+	var archives []string
+	for i := 0; i < 100; i++ {
+		archived := filepath.Join(dir, fmt.Sprintf("passer_2024-01-01_10:00:00.log.%d", i))
+		require.NoError(t, os.WriteFile(archived, []byte("line\n"), 0644))
+		archives = append(archives, archived)
+	}
+
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		for _, archived := range archives {
+			c.Add(archived)
+		}
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add blocked")
+	}
+
+	c.wg.Add(1)
+	go c.loop()
+	c.Close()
+
+	for _, archived := range archives {
+		require.Equal(t, "line\n", readGzip(t, archived+".gz"))
+	}
+}
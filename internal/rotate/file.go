@@ -0,0 +1,200 @@
+package rotate
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when the log file is fsynced. If both limits are zero, every write is synced.
+type SyncPolicy struct {
+	Interval time.Duration
+	Bytes    int64
+}
+
+func (p SyncPolicy) everyWrite() bool {
+	return p.Interval == 0 && p.Bytes == 0
+}
+
+// logFile is the file currently being written to.
+type logFile struct {
+	mu sync.Mutex
+
+	path   string
+	f      *os.File
+	policy SyncPolicy
+	logger *log.Logger
+
+	written  int64
+	unsynced int64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// createFile opens path for appending, so that writes keep landing at the end if an external tool
+// truncates the file (logrotate copytruncate).
+func createFile(path string, truncate bool) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	return os.OpenFile(path, flags, 0644)
+}
+
+func openLogFile(path string, policy SyncPolicy, logger *log.Logger) (*logFile, error) {
+	f, err := createFile(path, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %s", path, err)
+	}
+
+	l := &logFile{
+		path:   path,
+		f:      f,
+		policy: policy,
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+	if policy.Interval > 0 {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+func (l *logFile) syncLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		err := l.syncLocked()
+		l.mu.Unlock()
+		if err != nil {
+			l.logger.Printf("failed to sync: %s", err)
+		}
+	}
+}
+
+func (l *logFile) syncLocked() error {
+	if l.unsynced == 0 {
+		return nil
+	}
+	err := l.f.Sync()
+	if err != nil {
+		return err
+	}
+	l.unsynced = 0
+	return nil
+}
+
+// Written returns the number of bytes written since the file was created.
+func (l *logFile) Written() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n, err := l.f.Write(p)
+	l.written += int64(n)
+	l.unsynced += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write: %s", err)
+	}
+
+	if l.policy.everyWrite() || (l.policy.Bytes > 0 && l.unsynced >= l.policy.Bytes) {
+		err = l.syncLocked()
+		if err != nil {
+			return n, fmt.Errorf("failed to sync: %s", err)
+		}
+	}
+	return n, nil
+}
+
+func (l *logFile) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncLocked()
+}
+
+// Rotate closes the current file, renames it with archiveFile and starts a new one.
+// It returns the name of the archived file.
+func (l *logFile) Rotate() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.closeLocked()
+	if err != nil {
+		return "", err
+	}
+
+	archived, err := archiveFile(l.path)
+	if err != nil {
+		return "", fmt.Errorf("error archiving: %s", err)
+	}
+
+	l.f, err = createFile(l.path, true)
+	if err != nil {
+		return "", fmt.Errorf("error creating new file: %s", err)
+	}
+	l.written = 0
+	return archived, nil
+}
+
+// Reopen closes the current file and opens path again without archiving it. If the file is still
+// there, writing continues at its end.
+func (l *logFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.closeLocked()
+	if err != nil {
+		return err
+	}
+
+	l.f, err = createFile(l.path, false)
+	if err != nil {
+		return fmt.Errorf("failed to reopen %q: %s", l.path, err)
+	}
+	info, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	l.written = info.Size()
+	return nil
+}
+
+func (l *logFile) closeLocked() error {
+	err := l.syncLocked()
+	if err != nil {
+		return fmt.Errorf("failed to sync: %s", err)
+	}
+	err = l.f.Close()
+	if err != nil {
+		return fmt.Errorf("error closing: %s", err)
+	}
+	return nil
+}
+
+func (l *logFile) Close() error {
+	close(l.stop)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closeLocked()
+}
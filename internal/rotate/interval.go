@@ -0,0 +1,41 @@
+package rotate
+
+import (
+	"fmt"
+	"time"
+)
+
+// Interval is the period of time-based rotation.
+type Interval string
+
+const (
+	IntervalNone   Interval = "none"
+	IntervalHourly Interval = "hourly"
+	IntervalDaily  Interval = "daily"
+)
+
+func ParseInterval(s string) (Interval, error) {
+	switch Interval(s) {
+	case IntervalNone, IntervalHourly, IntervalDaily:
+		return Interval(s), nil
+	}
+	return "", fmt.Errorf("unknown rotate interval %q", s)
+}
+
+// nextRotation returns the start of the period following now, or the zero time for IntervalNone.
+func nextRotation(now time.Time, interval Interval, utc bool) time.Time {
+	if utc {
+		now = now.UTC()
+	} else {
+		now = now.Local()
+	}
+
+	year, month, day := now.Date()
+	switch interval {
+	case IntervalHourly:
+		return time.Date(year, month, day, now.Hour()+1, 0, 0, 0, now.Location())
+	case IntervalDaily:
+		return time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Time{}
+}
@@ -0,0 +1,119 @@
+package rotate
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy limits the archives kept next to the log file. Zero values mean unlimited.
+type RetentionPolicy struct {
+	MaxArchives int
+	MaxAge      time.Duration
+	// MaxTotalSize is the limit for all archives together, in bytes.
+	MaxTotalSize int64
+}
+
+// Archive is a compressed log file created by rotation.
+type Archive struct {
+	Path string
+	// ModTime is roughly the time of the rotation, so the archive holds no later records.
+	ModTime time.Time
+	Size    int64
+}
+
+// ListArchives returns the .gz archives created by archiveFile for logPath, oldest first.
+func ListArchives(logPath string) ([]Archive, error) {
+	return listArchives(logPath, false)
+}
+
+// ListAllArchives is ListArchives that also returns the archives that are not compressed yet, either
+// still queued or left by a failed compression. Compressing removes them, so they may be gone by the
+// time they are read, the .gz should be read instead then.
+func ListAllArchives(logPath string) ([]Archive, error) {
+	return listArchives(logPath, true)
+}
+
+func listArchives(logPath string, uncompressed bool) ([]Archive, error) {
+	dir := filepath.Dir(logPath)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	var output []Archive
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isArchiveName(logPath, name) || strings.HasSuffix(name, tmpSuffix) {
+			continue
+		}
+		if !strings.HasSuffix(name, ".gz") && (!uncompressed || names[name+".gz"]) {
+			// Compressed a moment ago if the .gz exists, the original is about to be removed.
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Deleted concurrently.
+			continue
+		}
+		output = append(output, Archive{
+			Path:    filepath.Join(dir, name),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		})
+	}
+
+	sort.Slice(output, func(i, j int) bool {
+		if !output[i].ModTime.Equal(output[j].ModTime) {
+			return output[i].ModTime.Before(output[j].ModTime)
+		}
+		return output[i].Path < output[j].Path
+	})
+	return output, nil
+}
+
+// applyRetention deletes the oldest archives of logPath until every limit of policy is satisfied.
+func applyRetention(logPath string, policy RetentionPolicy, now time.Time, logger *log.Logger) error {
+	archives, err := ListArchives(logPath)
+	if err != nil {
+		return err
+	}
+
+	var totalSize int64
+	for _, a := range archives {
+		totalSize += a.Size
+	}
+
+	for i, a := range archives {
+		var reason string
+		switch {
+		case policy.MaxArchives > 0 && len(archives)-i > policy.MaxArchives:
+			reason = "archive count"
+		case policy.MaxAge > 0 && now.Sub(a.ModTime) > policy.MaxAge:
+			reason = "archive age"
+		case policy.MaxTotalSize > 0 && totalSize > policy.MaxTotalSize:
+			reason = "total archive size"
+		default:
+			// Archives are sorted oldest first, so the rest are within limits too.
+			return nil
+		}
+
+		err := os.Remove(a.Path)
+		if err != nil {
+			return err
+		}
+		totalSize -= a.Size
+		logger.Printf("deleted archive %q (%d bytes, modified %s): %s limit exceeded",
+			a.Path, a.Size, a.ModTime.Format(time.RFC3339), reason)
+	}
+	return nil
+}
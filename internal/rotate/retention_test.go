@@ -0,0 +1,69 @@
+package rotate
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextRotation(t *testing.T) {
+	now := time.Date(2024, 3, 31, 23, 42, 10, 0, time.UTC)
+
+	require.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), nextRotation(now, IntervalHourly, true))
+	require.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), nextRotation(now, IntervalDaily, true))
+	require.True(t, nextRotation(now, IntervalNone, true).IsZero())
+
+	local := nextRotation(now, IntervalDaily, false)
+	require.Equal(t, time.Local, local.Location())
+	require.Equal(t, 0, local.Hour())
+	require.True(t, local.After(now))
+}
+
+func writeArchive(t *testing.T, path string, size int, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+	now := time.Now()
+
+	for i, name := range []string{"10", "11", "12", "13", "14"} {
+		writeArchive(t, filepath.Join(dir, "passer_2024-01-01_"+name+":00:00.log.gz"), 100, now.Add(-time.Duration(5-i)*time.Hour))
+	}
+	// Not archives of passer.log.
+	writeArchive(t, filepath.Join(dir, "other_2024-01-01_10:00:00.log.gz"), 100, now.Add(-24*time.Hour))
+	writeArchive(t, filepath.Join(dir, "passer_x_2024-01-01_10:00:00.log.gz"), 100, now.Add(-24*time.Hour))
+	writeArchive(t, logPath, 100, now.Add(-24*time.Hour))
+
+	names := func() []string {
+		archives, err := ListArchives(logPath)
+		require.NoError(t, err)
+		var output []string
+		for _, a := range archives {
+			output = append(output, filepath.Base(a.Path))
+		}
+		return output
+	}
+
+	require.NoError(t, applyRetention(logPath, RetentionPolicy{}, now, log.Default()))
+	require.Len(t, names(), 5)
+
+	require.NoError(t, applyRetention(logPath, RetentionPolicy{MaxArchives: 4}, now, log.Default()))
+	require.Equal(t, []string{"passer_2024-01-01_11:00:00.log.gz", "passer_2024-01-01_12:00:00.log.gz", "passer_2024-01-01_13:00:00.log.gz", "passer_2024-01-01_14:00:00.log.gz"}, names())
+
+	require.NoError(t, applyRetention(logPath, RetentionPolicy{MaxAge: 150 * time.Minute}, now, log.Default()))
+	require.Equal(t, []string{"passer_2024-01-01_13:00:00.log.gz", "passer_2024-01-01_14:00:00.log.gz"}, names())
+
+	require.NoError(t, applyRetention(logPath, RetentionPolicy{MaxTotalSize: 150}, now, log.Default()))
+	require.Equal(t, []string{"passer_2024-01-01_14:00:00.log.gz"}, names())
+
+	require.FileExists(t, logPath)
+	require.FileExists(t, filepath.Join(dir, "other_2024-01-01_10:00:00.log.gz"))
+	require.FileExists(t, filepath.Join(dir, "passer_x_2024-01-01_10:00:00.log.gz"))
+}
@@ -0,0 +1,322 @@
+// Package rotate writes log files that are rotated by size or time, gzipped in the background and
+// pruned by a retention policy.
+package rotate
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/galqiwi/fair-p/internal/utils"
+)
+
+var ErrClosed = errors.New("log file is closed")
+
+type Config struct {
+	Path string
+	// MaxSize is the size in bytes at which the file is rotated, 0 for unlimited.
+	MaxSize int64
+	// Interval additionally rotates the file at the start of every hour or day.
+	Interval Interval
+	// UTC aligns Interval to UTC instead of the local time zone.
+	UTC bool
+
+	Retention RetentionPolicy
+	Sync      SyncPolicy
+	// GzipLevel is the compression level of archives, gzip.DefaultCompression if 0.
+	GzipLevel int
+
+	// CurrentLink, if set, is kept as a symlink to Path.
+	CurrentLink string
+	// StatusPath, if set, receives the Status as JSON every second while it changes.
+	StatusPath string
+
+	// Logger receives rotation events such as deleted archives, log.Default() if nil.
+	Logger *log.Logger
+}
+
+// Writer is a rotated log file. Each Write is appended to the file as a whole, so concurrent
+// writers never interleave within a single call.
+type Writer struct {
+	mu sync.Mutex
+
+	cfg      Config
+	file     *logFile
+	archiver *compressor
+	rotateAt time.Time
+	// rotateTimer rotates the file at rotateAt even if nothing is written, nil for IntervalNone.
+	rotateTimer *time.Timer
+	closed      bool
+
+	bytesWritten    int64
+	archivesCreated int64
+	lastRotation    time.Time
+	statusChanged   bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ zapcore.WriteSyncer = (*Writer)(nil)
+
+// Open archives the file at cfg.Path if it exists, finishes the compression of archives left by a
+// previous run and starts a new file.
+func Open(cfg Config) (*Writer, error) {
+	if cfg.Interval == "" {
+		cfg.Interval = IntervalNone
+	}
+	if cfg.GzipLevel == 0 {
+		cfg.GzipLevel = gzip.DefaultCompression
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+
+	archiver := newCompressor(cfg.Path, cfg.GzipLevel, cfg.Retention, cfg.Logger)
+
+	err := archiver.recover()
+	if err != nil {
+		archiver.Close()
+		return nil, fmt.Errorf("failed to recover archives: %s", err)
+	}
+
+	if utils.FileExists(cfg.Path) {
+		archived, err := archiveFile(cfg.Path)
+		if err != nil {
+			archiver.Close()
+			return nil, err
+		}
+		archiver.Add(archived)
+	}
+
+	f, err := openLogFile(cfg.Path, cfg.Sync, cfg.Logger)
+	if err != nil {
+		archiver.Close()
+		return nil, err
+	}
+
+	w := &Writer{
+		cfg:           cfg,
+		file:          f,
+		archiver:      archiver,
+		statusChanged: true,
+		stop:          make(chan struct{}),
+	}
+	w.mu.Lock()
+	w.scheduleRotation(nextRotation(time.Now(), cfg.Interval, cfg.UTC))
+	w.mu.Unlock()
+
+	w.updateLink()
+	if cfg.StatusPath != "" {
+		w.wg.Add(1)
+		go w.statusLoop()
+	}
+	return w, nil
+}
+
+func (w *Writer) updateLink() {
+	if w.cfg.CurrentLink == "" {
+		return
+	}
+	err := updateLink(w.cfg.CurrentLink, w.cfg.Path)
+	if err != nil {
+		w.cfg.Logger.Printf("failed to update %q: %s", w.cfg.CurrentLink, err)
+	}
+}
+
+func (w *Writer) statusLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		w.flushStatus()
+		select {
+		case <-w.stop:
+			w.flushStatus()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Writer) flushStatus() {
+	w.mu.Lock()
+	changed := w.statusChanged
+	w.statusChanged = false
+	status := w.statusLocked()
+	w.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	err := writeStatus(w.cfg.StatusPath, status)
+	if err != nil {
+		w.cfg.Logger.Printf("failed to write status to %q: %s", w.cfg.StatusPath, err)
+	}
+}
+
+func (w *Writer) statusLocked() Status {
+	return Status{
+		CurrentFile:      w.cfg.Path,
+		CurrentFileBytes: w.file.Written(),
+		BytesWritten:     w.bytesWritten,
+		ArchivesCreated:  w.archivesCreated,
+		LastRotation:     w.lastRotation,
+		UpdatedAt:        time.Now(),
+	}
+}
+
+func (w *Writer) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.statusLocked()
+}
+
+func (w *Writer) Path() string {
+	return w.cfg.Path
+}
+
+// Write appends p to the file, rotating it first if p does not fit or the rotation period is over.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	now := time.Now()
+	written := w.file.Written()
+	full := w.cfg.MaxSize > 0 && written > 0 && int64(len(p)) > w.cfg.MaxSize-written
+	if full || (!w.rotateAt.IsZero() && !now.Before(w.rotateAt)) {
+		err := w.rotateLocked(now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.bytesWritten += int64(n)
+	w.statusChanged = true
+	return n, err
+}
+
+func (w *Writer) rotateLocked(now time.Time) error {
+	archived, err := w.file.Rotate()
+	if err != nil {
+		return err
+	}
+	w.archiver.Add(archived)
+
+	w.scheduleRotation(nextRotation(now, w.cfg.Interval, w.cfg.UTC))
+	w.archivesCreated++
+	w.lastRotation = now
+	w.statusChanged = true
+	return nil
+}
+
+// scheduleRotation sets the time of the next time-based rotation, the zero time for none.
+func (w *Writer) scheduleRotation(at time.Time) {
+	w.rotateAt = at
+	if at.IsZero() {
+		return
+	}
+	if w.rotateTimer == nil {
+		w.rotateTimer = time.AfterFunc(time.Until(at), w.rotateOnTimer)
+		return
+	}
+	w.rotateTimer.Reset(time.Until(at))
+}
+
+// rotateOnTimer rotates the file at the end of its period, so that a quiet log is archived on time too.
+// An empty file is kept for the next period.
+func (w *Writer) rotateOnTimer() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.rotateAt.IsZero() {
+		return
+	}
+	now := time.Now()
+	if now.Before(w.rotateAt) {
+		// The wall clock was moved back.
+		w.scheduleRotation(w.rotateAt)
+		return
+	}
+	if w.file.Written() == 0 {
+		w.scheduleRotation(nextRotation(now, w.cfg.Interval, w.cfg.UTC))
+		return
+	}
+
+	err := w.rotateLocked(now)
+	if err != nil {
+		w.cfg.Logger.Printf("failed to rotate %q: %s", w.cfg.Path, err)
+	}
+}
+
+// Rotate archives the current file and starts a new one, regardless of its size and age.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	return w.rotateLocked(time.Now())
+}
+
+// Reopen closes the file and opens Path again without archiving it. It is meant for external tools
+// such as logrotate that rename or truncate the file themselves.
+func (w *Writer) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	err := w.file.Reopen()
+	if err != nil {
+		return err
+	}
+	w.updateLink()
+	w.statusChanged = true
+	return nil
+}
+
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	return w.file.Sync()
+}
+
+// Close closes the file and waits until the pending archives are compressed.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	if w.rotateTimer != nil {
+		w.rotateTimer.Stop()
+	}
+	err := w.file.Close()
+	w.statusChanged = true
+	w.mu.Unlock()
+
+	w.archiver.Close()
+	close(w.stop)
+	w.wg.Wait()
+	return err
+}
@@ -0,0 +1,175 @@
+package rotate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestWriter_RotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+
+	w, err := Open(Config{Path: logPath, MaxSize: 100})
+	require.NoError(t, err)
+
+	core := zapcore.NewCore(
+		zapcore.NewConsoleEncoder(zapcore.EncoderConfig{MessageKey: "M", LineEnding: zapcore.DefaultLineEnding}),
+		w,
+		zap.DebugLevel,
+	)
+	logger := zap.New(core)
+	for i := 0; i < 10; i++ {
+		logger.Info(strings.Repeat("x", 39))
+	}
+	require.NoError(t, logger.Sync())
+	require.NoError(t, w.Close())
+
+	_, err = w.Write([]byte("late\n"))
+	require.ErrorIs(t, err, ErrClosed)
+
+	archives, err := ListArchives(logPath)
+	require.NoError(t, err)
+	// Two 40 byte lines fit into 100 bytes, so 10 lines make 4 archives and the current file.
+	require.Len(t, archives, 4)
+
+	var contents []string
+	for _, a := range archives {
+		contents = append(contents, readGzip(t, a.Path))
+	}
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	contents = append(contents, string(data))
+
+	sort.Strings(contents)
+	line := strings.Repeat("x", 39) + "\n"
+	for _, content := range contents {
+		require.Equal(t, line+line, content)
+	}
+}
+
+func TestWriter_OversizedWrite(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+
+	w, err := Open(Config{Path: logPath, MaxSize: 10})
+	require.NoError(t, err)
+
+	// A write larger than MaxSize goes into a file of its own instead of rotating an empty file.
+	_, err = w.Write([]byte(strings.Repeat("y", 20) + "\n"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("z\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	archives, err := ListArchives(logPath)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	require.Equal(t, strings.Repeat("y", 20)+"\n", readGzip(t, archives[0].Path))
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, "z\n", string(data))
+}
+
+func TestWriter_ReopenAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+	cfg := Config{
+		Path:        logPath,
+		CurrentLink: filepath.Join(dir, "current"),
+		StatusPath:  filepath.Join(dir, "status.json"),
+	}
+
+	w, err := Open(cfg)
+	require.NoError(t, err)
+
+	target, err := os.Readlink(cfg.CurrentLink)
+	require.NoError(t, err)
+	require.Equal(t, "passer.log", target)
+
+	_, err = w.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	// logrotate with create: the file is renamed and the writer is told to reopen.
+	moved := filepath.Join(dir, "passer.log.1")
+	require.NoError(t, os.Rename(logPath, moved))
+	require.NoError(t, w.Reopen())
+	_, err = w.Write([]byte("second\n"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(moved)
+	require.NoError(t, err)
+	require.Equal(t, "first\n", string(data))
+
+	// logrotate with copytruncate: the file is truncated in place and writes continue at its start.
+	require.NoError(t, os.Truncate(logPath, 0))
+	_, err = w.Write([]byte("third\n"))
+	require.NoError(t, err)
+	data, err = os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, "third\n", string(data))
+
+	require.NoError(t, w.Rotate())
+	_, err = w.Write([]byte("fourth\n"))
+	require.NoError(t, err)
+
+	status := w.Status()
+	require.Equal(t, logPath, status.CurrentFile)
+	require.Equal(t, int64(len("first\nsecond\nthird\nfourth\n")), status.BytesWritten)
+	require.Equal(t, int64(len("fourth\n")), status.CurrentFileBytes)
+	require.Equal(t, int64(1), status.ArchivesCreated)
+
+	require.NoError(t, w.Close())
+
+	archives, err := ListArchives(logPath)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	require.Equal(t, "third\n", readGzip(t, archives[0].Path))
+
+	data, err = os.ReadFile(cfg.StatusPath)
+	require.NoError(t, err)
+	var written Status
+	require.NoError(t, json.Unmarshal(data, &written))
+	require.Equal(t, status.BytesWritten, written.BytesWritten)
+	require.Equal(t, status.ArchivesCreated, written.ArchivesCreated)
+}
+
+func TestWriter_RotateOnTimer(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "passer.log")
+
+	w, err := Open(Config{Path: logPath, Interval: IntervalHourly})
+	require.NoError(t, err)
+	defer w.Close()
+
+	// An empty file is not archived at the end of the period.
+	w.mu.Lock()
+	w.scheduleRotation(time.Now().Add(50 * time.Millisecond))
+	w.mu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	require.Zero(t, w.Status().ArchivesCreated)
+
+	_, err = w.Write([]byte("quiet\n"))
+	require.NoError(t, err)
+	w.mu.Lock()
+	w.scheduleRotation(time.Now().Add(50 * time.Millisecond))
+	w.mu.Unlock()
+
+	// Archived without another write.
+	require.Eventually(t, func() bool {
+		return w.Status().ArchivesCreated == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w.mu.Lock()
+	require.Equal(t, nextRotation(time.Now(), IntervalHourly, false), w.rotateAt)
+	w.mu.Unlock()
+}
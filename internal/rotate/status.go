@@ -0,0 +1,61 @@
+package rotate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Status describes a Writer. It is written to Config.StatusPath as JSON.
+type Status struct {
+	CurrentFile string `json:"current_file"`
+	// CurrentFileBytes is the size of the current file as far as the writer knows.
+	CurrentFileBytes int64 `json:"current_file_bytes"`
+	// BytesWritten is the number of bytes written since Open.
+	BytesWritten    int64     `json:"bytes_written"`
+	ArchivesCreated int64     `json:"archives_created"`
+	LastRotation    time.Time `json:"last_rotation"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+const statusInterval = time.Second
+
+// writeFileAtomic replaces path with data, so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + tmpSuffix
+	err := os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeStatus(path string, status Status) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// updateLink points the symlink at link to target, replacing whatever was there.
+func updateLink(link string, target string) error {
+	if filepath.Dir(link) == filepath.Dir(target) {
+		target = filepath.Base(target)
+	} else if abs, err := filepath.Abs(target); err == nil {
+		target = abs
+	}
+
+	if current, err := os.Readlink(link); err == nil && current == target {
+		return nil
+	}
+
+	tmp := link + tmpSuffix
+	_ = os.Remove(tmp)
+	err := os.Symlink(target, tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
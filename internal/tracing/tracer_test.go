@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type collector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req otlpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestTracer_ExportOTLP(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	tracer := NewTracer(NewOTLPExporter(server.URL+"/v1/traces", "test"), 16, time.Hour, func(err error) {
+		t.Errorf("export failed: %s", err)
+	})
+
+	traceID := TraceID{1, 2, 3}
+	root := tracer.Start(traceID, nil, "accept", SpanKindServer)
+	child := root.StartChild("dial", SpanKindClient)
+	child.SetAttributes(String("destination", "example.com:443"), Int64("bytes", 42), Float64("ms", 1.5))
+	child.SetError(errors.New("refused"))
+	child.End()
+	root.End()
+	root.End()
+
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	require.Len(t, c.spans, 2)
+	require.Equal(t, "dial", c.spans[0].Name)
+	require.Equal(t, "accept", c.spans[1].Name)
+	require.Equal(t, hex.EncodeToString(traceID[:]), c.spans[0].TraceID)
+	require.Equal(t, c.spans[1].SpanID, c.spans[0].ParentSpanID)
+	require.Empty(t, c.spans[1].ParentSpanID)
+	require.Equal(t, 2, c.spans[0].Status.Code)
+	require.Len(t, c.spans[0].Attributes, 3)
+	require.Equal(t, "42", *c.spans[0].Attributes[1].Value.IntValue)
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var tracer *Tracer
+
+	span := tracer.Start(TraceID{}, nil, "accept", SpanKindServer)
+	require.Nil(t, span)
+	require.Nil(t, span.StartChild("dial", SpanKindClient))
+
+	span.SetAttributes(String("a", "b"))
+	span.SetError(errors.New("err"))
+	span.End()
+	require.NoError(t, tracer.Shutdown(context.Background()))
+}
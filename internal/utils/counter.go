@@ -29,6 +29,25 @@ func (c *Counter) Add(value int64) {
 	}
 }
 
+// Subscribe registers f to be called with the new value after every change and returns
+// an id for Unsubscribe. f is called with the counter locked, so it must be cheap and
+// must not use the counter.
+func (c *Counter) Subscribe(f func(int64)) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nSubscribed++
+	c.subscribers[c.nSubscribed] = f
+	return c.nSubscribed
+}
+
+func (c *Counter) Unsubscribe(id int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.subscribers, id)
+}
+
 func (c *Counter) Sub(value int64) {
 	c.Add(-value)
 }
@@ -64,3 +64,26 @@ func TestCounter_ConcurrentSub(t *testing.T) {
 	wg.Wait()
 	require.Equal(t, int64(0), c.Get())
 }
+
+func TestCounter_Subscribe(t *testing.T) {
+	c := NewCounter()
+
+	var first, second []int64
+	firstId := c.Subscribe(func(v int64) { first = append(first, v) })
+	secondId := c.Subscribe(func(v int64) { second = append(second, v) })
+	require.NotEqual(t, firstId, secondId)
+
+	c.Add(2)
+	c.Sub(1)
+
+	c.Unsubscribe(firstId)
+	c.Add(5)
+
+	require.Equal(t, []int64{2, 1}, first)
+	require.Equal(t, []int64{2, 1, 6}, second)
+
+	c.Unsubscribe(secondId)
+	c.Unsubscribe(secondId)
+	c.Add(1)
+	require.Equal(t, []int64{2, 1, 6}, second)
+}